@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+
+	"github.com/ninjasphere/gatt"
+)
+
+// advertisements is the registry shared by all the sub drivers, each driver registers the
+// advertisements it is interested in when it is created.
+var advertisements = NewAdvertisementRegistry()
+
+// AdvertisementMatcher describes the advertisements a handler is interested in. Every field
+// which is set must match, fields left as their zero value are ignored.
+type AdvertisementMatcher struct {
+	ServiceUuid            string
+	LocalName              *regexp.Regexp
+	ManufacturerDataPrefix []byte
+	MinRSSI                int8 // the device rssi must be greater than this
+}
+
+// Matches returns true if the discovered device satisfies the matcher.
+func (m *AdvertisementMatcher) Matches(device *gatt.DiscoveredDevice) bool {
+
+	if device.Advertisement == nil {
+		return false
+	}
+
+	if m.ServiceUuid != "" && !hasServiceUuid(device, m.ServiceUuid) {
+		return false
+	}
+
+	if m.LocalName != nil && !m.LocalName.MatchString(device.Advertisement.LocalName) {
+		return false
+	}
+
+	if m.ManufacturerDataPrefix != nil && !bytes.HasPrefix(device.Advertisement.ManufacturerData, m.ManufacturerDataPrefix) {
+		return false
+	}
+
+	if m.MinRSSI != 0 && device.Rssi <= m.MinRSSI {
+		return false
+	}
+
+	return true
+}
+
+func hasServiceUuid(device *gatt.DiscoveredDevice, serviceUuid string) bool {
+	for uuid := range device.Advertisement.ServiceUuids {
+		if uuid == serviceUuid {
+			return true
+		}
+	}
+	return false
+}
+
+type advertisementHandler struct {
+	name    string
+	matcher *AdvertisementMatcher
+	handle  func(device *gatt.DiscoveredDevice)
+}
+
+// AdvertisementRegistry dispatches discovered devices to the handlers whose matcher they satisfy.
+type AdvertisementRegistry struct {
+	sync.Mutex
+	handlers []*advertisementHandler
+}
+
+func NewAdvertisementRegistry() *AdvertisementRegistry {
+	return &AdvertisementRegistry{}
+}
+
+// Register adds a handler which is called for every advertisement matching the matcher.
+func (r *AdvertisementRegistry) Register(name string, matcher *AdvertisementMatcher, handle func(device *gatt.DiscoveredDevice)) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.handlers = append(r.handlers, &advertisementHandler{
+		name:    name,
+		matcher: matcher,
+		handle:  handle,
+	})
+}
+
+// Matching returns the names of the handlers which would be called for the device.
+func (r *AdvertisementRegistry) Matching(device *gatt.DiscoveredDevice) []string {
+	names := []string{}
+	for _, h := range r.matching(device) {
+		names = append(names, h.name)
+	}
+	return names
+}
+
+// Handle passes the device to every handler with a matching matcher.
+func (r *AdvertisementRegistry) Handle(device *gatt.DiscoveredDevice) {
+	for _, h := range r.matching(device) {
+		h.handle(device)
+	}
+}
+
+func (r *AdvertisementRegistry) matching(device *gatt.DiscoveredDevice) []*advertisementHandler {
+	r.Lock()
+	defer r.Unlock()
+
+	matched := []*advertisementHandler{}
+	for _, h := range r.handlers {
+		if h.matcher.Matches(device) {
+			matched = append(matched, h)
+		}
+	}
+	return matched
+}
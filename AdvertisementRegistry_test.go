@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/ninjasphere/gatt"
+)
+
+func newTestDevice(localName string, rssi int8, manufacturerData []byte, serviceUuids ...string) *gatt.DiscoveredDevice {
+	uuids := make(map[string]bool)
+	for _, uuid := range serviceUuids {
+		uuids[uuid] = true
+	}
+	return &gatt.DiscoveredDevice{
+		Address: "f6:5f:20:4c:b0:db",
+		Rssi:    rssi,
+		Advertisement: &gatt.Advertisement{
+			LocalName:        localName,
+			ManufacturerData: manufacturerData,
+			ServiceUuids:     uuids,
+		},
+	}
+}
+
+func TestAdvertisementMatcher(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		matcher *AdvertisementMatcher
+		device  *gatt.DiscoveredDevice
+		matches bool
+	}{
+		{"service uuid", &AdvertisementMatcher{ServiceUuid: flowerPowerServiceUuid}, newTestDevice("", -70, nil, flowerPowerServiceUuid), true},
+		{"other service uuid", &AdvertisementMatcher{ServiceUuid: flowerPowerServiceUuid}, newTestDevice("", -70, nil, stickNFindServiceUuid), false},
+		{"local name", &AdvertisementMatcher{LocalName: regexp.MustCompile("^NinjaSphere")}, newTestDevice(waypointLocalName, -70, nil), true},
+		{"other local name", &AdvertisementMatcher{LocalName: regexp.MustCompile("^NinjaSphere")}, newTestDevice("Flower power", -70, nil), false},
+		{"manufacturer prefix", &AdvertisementMatcher{ManufacturerDataPrefix: []byte{0x4c, 0x00}}, newTestDevice("", -70, []byte{0x4c, 0x00, 0x02, 0x15}), true},
+		{"short manufacturer data", &AdvertisementMatcher{ManufacturerDataPrefix: []byte{0x4c, 0x00}}, newTestDevice("", -70, []byte{0x4c}), false},
+		{"close enough", &AdvertisementMatcher{ServiceUuid: stickNFindServiceUuid, MinRSSI: minRSSI}, newTestDevice("", -40, nil, stickNFindServiceUuid), true},
+		{"too far away", &AdvertisementMatcher{ServiceUuid: stickNFindServiceUuid, MinRSSI: minRSSI}, newTestDevice("", minRSSI, nil, stickNFindServiceUuid), false},
+		{"empty matcher", &AdvertisementMatcher{}, newTestDevice("", -70, nil), true},
+	}
+
+	for _, test := range tests {
+		if got := test.matcher.Matches(test.device); got != test.matches {
+			t.Errorf("%s: expected match %t, got %t", test.name, test.matches, got)
+		}
+	}
+}
+
+func TestAdvertisementMatcherNoAdvertisement(t *testing.T) {
+	matcher := &AdvertisementMatcher{}
+
+	if matcher.Matches(&gatt.DiscoveredDevice{}) {
+		t.Errorf("matched a device without an advertisement")
+	}
+}
+
+func TestAdvertisementRegistryHandle(t *testing.T) {
+	registry := NewAdvertisementRegistry()
+
+	handled := []string{}
+
+	registry.Register("flowerpower", &AdvertisementMatcher{ServiceUuid: flowerPowerServiceUuid}, func(device *gatt.DiscoveredDevice) {
+		handled = append(handled, "flowerpower")
+	})
+	registry.Register("near", &AdvertisementMatcher{MinRSSI: minRSSI}, func(device *gatt.DiscoveredDevice) {
+		handled = append(handled, "near")
+	})
+
+	registry.Handle(newTestDevice("", -30, nil, flowerPowerServiceUuid))
+
+	if !reflect.DeepEqual(handled, []string{"flowerpower", "near"}) {
+		t.Errorf("bad handlers called %v", handled)
+	}
+
+	if names := registry.Matching(newTestDevice("", -80, nil, flowerPowerServiceUuid)); !reflect.DeepEqual(names, []string{"flowerpower"}) {
+		t.Errorf("bad matching handlers %v", names)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	calibrationDataDir = "data"
+
+	// the sunlight sensor reports 0 when it has no reading, every other value is a period
+	sunlightNoReading = 0.1
+)
+
+// calibrationTable maps raw sensor readings to calibrated values, interpolating between points.
+type calibrationTable struct {
+	raw    []float64
+	values []float64
+}
+
+// calibrationTables holds the FlowerPower calibration data, it is loaded once at startup.
+type calibrationTables struct {
+	sunlight    *calibrationTable
+	moisture    *calibrationTable
+	temperature *calibrationTable
+}
+
+// loadCalibrationTables loads and validates the three FlowerPower calibration tables from dir.
+func loadCalibrationTables(dir string) (*calibrationTables, error) {
+
+	sunlight, err := loadCalibrationTable(filepath.Join(dir, "sunlight.json"), 10, 65530, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	moisture, err := loadCalibrationTable(filepath.Join(dir, "soil-moisture.json"), 210, 700, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	temperature, err := loadCalibrationTable(filepath.Join(dir, "temperature.json"), 210, 1372, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &calibrationTables{
+		sunlight:    sunlight,
+		moisture:    moisture,
+		temperature: temperature,
+	}, nil
+}
+
+// loadCalibrationTable reads a json map of raw reading to calibrated value, points outside
+// minRaw and maxRaw are ignored. See newCalibrationTable for the meaning of tolerance.
+func loadCalibrationTable(filename string, minRaw, maxRaw, tolerance float64) (*calibrationTable, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading calibration file %s: %s", filename, err)
+	}
+
+	var mapping map[string]float64
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("Error parsing calibration file %s: %s", filename, err)
+	}
+
+	points := make(map[float64]float64)
+
+	for key, value := range mapping {
+		raw, err := strconv.ParseFloat(key, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid raw value %q in calibration file %s", key, filename)
+		}
+		if raw < minRaw || raw > maxRaw {
+			continue
+		}
+		if _, ok := points[raw]; ok {
+			return nil, fmt.Errorf("Duplicate raw value %q in calibration file %s", key, filename)
+		}
+		points[raw] = value
+	}
+
+	table, err := newCalibrationTable(points, tolerance)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid calibration file %s: %s", filename, err)
+	}
+
+	return table, nil
+}
+
+// newCalibrationTable builds a table from raw -> calibrated points. The calibrated values must
+// be monotonic, in the direction of the first to last point, although steps against that
+// direction of up to tolerance are allowed to cope with rounding in the source data.
+func newCalibrationTable(points map[float64]float64, tolerance float64) (*calibrationTable, error) {
+	if len(points) < 2 {
+		return nil, fmt.Errorf("Need at least 2 points, got %d", len(points))
+	}
+
+	table := &calibrationTable{}
+
+	for raw := range points {
+		table.raw = append(table.raw, raw)
+	}
+	sort.Float64s(table.raw)
+
+	for _, raw := range table.raw {
+		table.values = append(table.values, points[raw])
+	}
+
+	direction := 1.0
+	if table.values[len(table.values)-1] < table.values[0] {
+		direction = -1.0
+	}
+
+	for i := 1; i < len(table.values); i++ {
+		step := (table.values[i] - table.values[i-1]) * direction
+		if step < -tolerance {
+			return nil, fmt.Errorf("Not monotonic at raw value %v (%v -> %v)", table.raw[i], table.values[i-1], table.values[i])
+		}
+	}
+
+	return table, nil
+}
+
+// Lookup returns the calibrated value for a raw reading, interpolating linearly between the
+// surrounding points. Readings outside the table are clamped to the first or last point.
+func (t *calibrationTable) Lookup(raw float64) float64 {
+	last := len(t.raw) - 1
+
+	if raw <= t.raw[0] {
+		return t.values[0]
+	}
+	if raw >= t.raw[last] {
+		return t.values[last]
+	}
+
+	// index of the first point above raw
+	i := sort.Search(len(t.raw), func(i int) bool {
+		return t.raw[i] > raw
+	})
+
+	x0, x1 := t.raw[i-1], t.raw[i]
+	y0, y1 := t.values[i-1], t.values[i]
+
+	return y0 + (y1-y0)*(raw-x0)/(x1-x0)
+}
+
+func (c *calibrationTables) parseSunlight(data []byte) (float64, error) {
+	if c == nil {
+		return 0, fmt.Errorf("Calibration tables not loaded")
+	}
+	sensorVal, err := parseUint(data)
+	if err != nil {
+		return 0, err
+	}
+	if sensorVal == 0 {
+		return sunlightNoReading, nil
+	}
+	return roundCalibrated(c.sunlight.Lookup(float64(sensorVal))), nil
+}
+
+func (c *calibrationTables) parseMoisture(data []byte) (float64, error) {
+	if c == nil {
+		return 0, fmt.Errorf("Calibration tables not loaded")
+	}
+	sensorVal, err := parseUint(data)
+	if err != nil {
+		return 0, err
+	}
+	return roundCalibrated(c.moisture.Lookup(float64(sensorVal))), nil
+}
+
+func (c *calibrationTables) parseTemperature(data []byte) (float64, error) {
+	if c == nil {
+		return 0, fmt.Errorf("Calibration tables not loaded")
+	}
+	sensorVal, err := parseUint(data)
+	if err != nil {
+		return 0, err
+	}
+	return roundCalibrated(c.temperature.Lookup(float64(sensorVal))), nil
+}
+
+func parseUint(data []byte) (uint16, error) {
+	if len(data) < 2 {
+		return 0, fmt.Errorf("Expected 2 bytes, got % X", data)
+	}
+	return bytesToUint(data), nil
+}
+
+// roundCalibrated rounds to the two decimal places used in the calibration data.
+func roundCalibrated(value float64) float64 {
+	return math.Floor(value*100+0.5) / 100
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+const testCalibrationDataDir = "ninjapack/root/opt/ninjablocks/drivers/driver-go-blecombined/data"
+
+func rawReading(value uint16) []byte {
+	data := make([]byte, 2)
+	binary.LittleEndian.PutUint16(data, value)
+	return data
+}
+
+func TestCalibrationTableLookup(t *testing.T) {
+	table, err := newCalibrationTable(map[float64]float64{10: 100, 20: 50, 40: 10}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[float64]float64{
+		0:  100, // clamped
+		10: 100,
+		15: 75,
+		20: 50,
+		25: 40,
+		40: 10,
+		90: 10, // clamped
+	}
+
+	for raw, expected := range tests {
+		if value := table.Lookup(raw); value != expected {
+			t.Errorf("Lookup(%v) expected %v, got %v", raw, expected, value)
+		}
+	}
+}
+
+func TestCalibrationTableValidation(t *testing.T) {
+	if _, err := newCalibrationTable(map[float64]float64{10: 1}, 0); err == nil {
+		t.Errorf("expected an error for a single point table")
+	}
+
+	if _, err := newCalibrationTable(map[float64]float64{10: 1, 20: 5, 30: 3, 40: 8}, 0); err == nil {
+		t.Errorf("expected an error for a non monotonic table")
+	}
+
+	if _, err := newCalibrationTable(map[float64]float64{10: 1, 20: 5, 30: 4.5, 40: 8}, 1); err != nil {
+		t.Errorf("unexpected error for a reversal within tolerance: %s", err)
+	}
+}
+
+func TestCalibrationTablesKnownValues(t *testing.T) {
+	tables, err := loadCalibrationTables(testCalibrationDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		parse  func([]byte) (float64, error)
+		raw    uint16
+		result float64
+	}{
+		{"sunlight", tables.parseSunlight, 0, 0.1},
+		{"sunlight", tables.parseSunlight, 150, 948.31},
+		{"sunlight", tables.parseSunlight, 155, 916.94},
+		{"sunlight", tables.parseSunlight, 65535, 1.5},
+		{"moisture", tables.parseMoisture, 100, 0},
+		{"moisture", tables.parseMoisture, 210, 0},
+		{"moisture", tables.parseMoisture, 700, 60},
+		{"temperature", tables.parseTemperature, 210, -10},
+		{"temperature", tables.parseTemperature, 1359, 54},
+		{"temperature", tables.parseTemperature, 1372, 55},
+		{"temperature", tables.parseTemperature, 2000, 55},
+	}
+
+	for _, test := range tests {
+		value, err := test.parse(rawReading(test.raw))
+		if err != nil {
+			t.Errorf("%s %d: %s", test.name, test.raw, err)
+			continue
+		}
+		if value != test.result {
+			t.Errorf("%s %d: expected %v, got %v", test.name, test.raw, test.result, value)
+		}
+	}
+}
+
+func TestCalibrationTablesErrors(t *testing.T) {
+	if _, err := loadCalibrationTables("does-not-exist"); err == nil {
+		t.Errorf("expected an error for a missing data directory")
+	}
+
+	var tables *calibrationTables
+	if _, err := tables.parseTemperature(rawReading(500)); err == nil {
+		t.Errorf("expected an error without calibration tables")
+	}
+
+	tables, err := loadCalibrationTables(testCalibrationDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tables.parseMoisture([]byte{0x01}); err == nil {
+		t.Errorf("expected an error for a short reading")
+	}
+}
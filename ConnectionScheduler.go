@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// connections is the scheduler shared by all the sub drivers, every connection to a device goes
+// through it so they don't fight over the radio.
+var connections = NewConnectionScheduler(maxConnections)
+
+// ConnectionPriority orders the queue, higher priorities are connected first.
+type ConnectionPriority int
+
+const (
+	PriorityDiscovery ConnectionPriority = iota // reading characteristics before a device is announced
+	PriorityFlowerPower
+	PriorityTagAlert
+	PriorityWaypoint
+)
+
+func (p ConnectionPriority) String() string {
+	switch p {
+	case PriorityDiscovery:
+		return "discovery"
+	case PriorityFlowerPower:
+		return "flowerpower"
+	case PriorityTagAlert:
+		return "tag alert"
+	case PriorityWaypoint:
+		return "waypoint"
+	}
+	return fmt.Sprintf("priority %d", int(p))
+}
+
+// Scanner is the part of the gatt client which is paused while we connect.
+type Scanner interface {
+	StartScanning(allowDuplicates bool) error
+	StopScanning() error
+}
+
+type connectionRequest struct {
+	priority  ConnectionPriority
+	address   string
+	connected bool          // the link is kept while the device stays connected
+	ready     chan struct{} // closed when the request is given a link
+}
+
+// ScheduledConnection is a link given out by the scheduler, which must be released once the
+// device has disconnected, or the operation it was for has finished.
+type ScheduledConnection struct {
+	scheduler *ConnectionScheduler
+	address   string
+	connected bool
+	once      sync.Once
+}
+
+// Release gives the link back to the scheduler. It may be called more than once, and on nil.
+func (c *ScheduledConnection) Release() {
+	if c == nil {
+		return
+	}
+	c.once.Do(func() {
+		log.Debugf("Released connection to %s", c.address)
+		c.scheduler.release(c.connected)
+	})
+}
+
+// ConnectionScheduler queues connections by priority, so no more than the controller supports
+// are open at once. Devices which stay connected can't take the last link, so however many
+// waypoints and flower powers are connected, discovery and tag alerts still get through.
+type ConnectionScheduler struct {
+	sync.Mutex
+	maxLinks        int
+	active          int
+	connected       int // links kept by devices which stay connected
+	queue           []*connectionRequest
+	scanner         Scanner
+	allowDuplicates bool
+	inProgress      int // connections being made, while scanning is paused
+}
+
+func NewConnectionScheduler(maxLinks int) *ConnectionScheduler {
+	return &ConnectionScheduler{maxLinks: maxLinks}
+}
+
+// SetScanner has scanning paused while connecting, then restarted with allowDuplicates.
+func (s *ConnectionScheduler) SetScanner(scanner Scanner, allowDuplicates bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.scanner = scanner
+	s.allowDuplicates = allowDuplicates
+}
+
+// QueueDepth returns the number of requests waiting for a link.
+func (s *ConnectionScheduler) QueueDepth() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.queue)
+}
+
+// Active returns the number of links which have been given out.
+func (s *ConnectionScheduler) Active() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.active
+}
+
+// Connect waits for a link, then connects the transport, giving up on the connection after
+// connectTimeout. The link is held until it is released, which should be when the transport
+// sends its Disconnected event. The context only limits the wait in the queue.
+func (s *ConnectionScheduler) Connect(ctx context.Context, priority ConnectionPriority, address string, transport Transport) (*ScheduledConnection, error) {
+
+	link, err := s.acquire(ctx, priority, address, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.connecting(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		defer cancel()
+		return transport.Connect(ctx)
+	})
+
+	if err != nil {
+		link.Release()
+		return nil, err
+	}
+
+	return link, nil
+}
+
+// Run waits for a link, then holds it while running an operation which connects and disconnects
+// by itself, eg. a gatttool command. The context only limits the wait in the queue.
+func (s *ConnectionScheduler) Run(ctx context.Context, priority ConnectionPriority, address string, operation func() error) error {
+
+	link, err := s.acquire(ctx, priority, address, false)
+	if err != nil {
+		return err
+	}
+	defer link.Release()
+
+	return s.connecting(operation)
+}
+
+func (s *ConnectionScheduler) acquire(ctx context.Context, priority ConnectionPriority, address string, connected bool) (*ScheduledConnection, error) {
+
+	s.Lock()
+	request := &connectionRequest{
+		priority:  priority,
+		address:   address,
+		connected: connected,
+		ready:     make(chan struct{}),
+	}
+	s.queue = append(s.queue, request)
+	s.dispatch()
+	depth := len(s.queue)
+	s.Unlock()
+
+	link := &ScheduledConnection{scheduler: s, address: address, connected: connected}
+
+	select {
+	case <-request.ready:
+		return link, nil
+	default:
+	}
+
+	log.Infof("Queued %s connection to %s, %d waiting", priority, address, depth)
+
+	select {
+	case <-request.ready:
+		return link, nil
+	case <-ctx.Done():
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for i, queued := range s.queue {
+		if queued == request {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return nil, fmt.Errorf("Gave up waiting to connect to %s: %s", address, ctx.Err())
+		}
+	}
+
+	// we were given the link as we gave up
+	s.unlink(connected)
+	s.dispatch()
+	return nil, fmt.Errorf("Gave up waiting to connect to %s: %s", address, ctx.Err())
+}
+
+func (s *ConnectionScheduler) release(connected bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.unlink(connected)
+	s.dispatch()
+}
+
+// unlink frees a link, it must be called with the lock held.
+func (s *ConnectionScheduler) unlink(connected bool) {
+	s.active--
+	if connected {
+		s.connected--
+	}
+}
+
+// dispatch hands out the free links, highest priority first then in the order they were asked for.
+// Requests to stay connected wait while only the last link is free. It must be called with the
+// lock held.
+func (s *ConnectionScheduler) dispatch() {
+	for s.active < s.maxLinks {
+		next := -1
+		for i, request := range s.queue {
+			if request.connected && s.connected >= s.maxLinks-1 && s.maxLinks > 1 {
+				continue
+			}
+			if next < 0 || request.priority > s.queue[next].priority {
+				next = i
+			}
+		}
+
+		if next < 0 {
+			return
+		}
+
+		request := s.queue[next]
+		s.queue = append(s.queue[:next], s.queue[next+1:]...)
+		s.active++
+		if request.connected {
+			s.connected++
+		}
+		close(request.ready)
+	}
+}
+
+// connecting runs connect with scanning paused, if there is a scanner.
+func (s *ConnectionScheduler) connecting(connect func() error) error {
+
+	s.Lock()
+	s.inProgress++
+	if s.inProgress == 1 && s.scanner != nil {
+		if err := s.scanner.StopScanning(); err != nil {
+			log.Warningf("Failed to pause scanning: %s", err)
+		}
+	}
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		s.inProgress--
+		if s.inProgress == 0 && s.scanner != nil {
+			if err := s.scanner.StartScanning(s.allowDuplicates); err != nil {
+				log.Errorf("Failed to restart scanning: %s", err)
+			}
+		}
+		s.Unlock()
+	}()
+
+	return connect()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+)
+
+type fakeScanner struct {
+	sync.Mutex
+	calls []string
+}
+
+func (s *fakeScanner) StartScanning(allowDuplicates bool) error {
+	s.Lock()
+	defer s.Unlock()
+	s.calls = append(s.calls, "start")
+	return nil
+}
+
+func (s *fakeScanner) StopScanning() error {
+	s.Lock()
+	defer s.Unlock()
+	s.calls = append(s.calls, "stop")
+	return nil
+}
+
+// failingTransport can't connect.
+type failingTransport struct {
+	fakeTransport
+}
+
+func (f *failingTransport) Connect(ctx context.Context) error {
+	return errors.New("Connection refused")
+}
+
+// waitForQueue waits until the scheduler has the given number of requests queued.
+func waitForQueue(t *testing.T, s *ConnectionScheduler, depth int) {
+	for i := 0; i < 100; i++ {
+		if s.QueueDepth() == depth {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("expected %d queued, got %d", depth, s.QueueDepth())
+}
+
+func TestConnectionSchedulerPriority(t *testing.T) {
+
+	s := NewConnectionScheduler(1)
+
+	first, err := s.acquire(context.Background(), PriorityFlowerPower, "first", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lkOrder sync.Mutex
+	order := []string{}
+
+	var wg sync.WaitGroup
+
+	queue := func(priority ConnectionPriority, address string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Run(context.Background(), priority, address, func() error {
+				lkOrder.Lock()
+				order = append(order, address)
+				lkOrder.Unlock()
+				return nil
+			})
+		}()
+	}
+
+	// queued one at a time, so the order they arrive in is known
+	queue(PriorityFlowerPower, "flowerpower")
+	waitForQueue(t, s, 1)
+	queue(PriorityTagAlert, "tag")
+	waitForQueue(t, s, 2)
+	queue(PriorityWaypoint, "waypoint")
+	waitForQueue(t, s, 3)
+	queue(PriorityTagAlert, "another tag")
+	waitForQueue(t, s, 4)
+
+	if s.Active() != 1 {
+		t.Errorf("expected 1 active link, got %d", s.Active())
+	}
+
+	first.Release()
+	first.Release()
+	wg.Wait()
+
+	expected := []string{"waypoint", "tag", "another tag", "flowerpower"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected %v, got %v", expected, order)
+	}
+
+	if s.Active() != 0 || s.QueueDepth() != 0 {
+		t.Errorf("expected everything to be released, got %d active and %d queued", s.Active(), s.QueueDepth())
+	}
+}
+
+func TestConnectionSchedulerLimit(t *testing.T) {
+
+	s := NewConnectionScheduler(2)
+
+	link, err := s.Connect(context.Background(), PriorityWaypoint, "a", newFakeTransport())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.acquire(context.Background(), PriorityDiscovery, "b", false); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if _, err := s.acquire(ctx, PriorityWaypoint, "c", false); err == nil {
+		t.Errorf("expected a third connection to wait")
+	}
+
+	if s.QueueDepth() != 0 {
+		t.Errorf("expected the request to leave the queue when it gave up")
+	}
+
+	link.Release()
+
+	if _, err := s.Connect(context.Background(), PriorityWaypoint, "c", newFakeTransport()); err != nil {
+		t.Errorf("expected the released link to be reused: %s", err)
+	}
+}
+
+func TestConnectionSchedulerFailedConnect(t *testing.T) {
+
+	s := NewConnectionScheduler(1)
+
+	scanner := &fakeScanner{}
+	s.SetScanner(scanner, true)
+
+	if _, err := s.Connect(context.Background(), PriorityFlowerPower, "a", &failingTransport{}); err == nil {
+		t.Fatal("expected the connection to fail")
+	}
+
+	if s.Active() != 0 {
+		t.Errorf("expected the link to be released")
+	}
+
+	if !reflect.DeepEqual(scanner.calls, []string{"stop", "start"}) {
+		t.Errorf("expected scanning to be paused while connecting, got %v", scanner.calls)
+	}
+}
+
+func TestConnectionSchedulerReserve(t *testing.T) {
+
+	s := NewConnectionScheduler(2)
+
+	// the waypoint keeps its link while it stays connected
+	waypoint, err := s.Connect(context.Background(), PriorityWaypoint, "waypoint", newFakeTransport())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if _, err := s.Connect(ctx, PriorityWaypoint, "another waypoint", newFakeTransport()); err == nil {
+		t.Errorf("expected the last link to be kept from devices which stay connected")
+	}
+
+	ran := false
+	if err := s.Run(context.Background(), PriorityDiscovery, "tag", func() error {
+		ran = true
+		return nil
+	}); err != nil || !ran {
+		t.Errorf("expected discovery to get the last link: %v", err)
+	}
+
+	waypoint.Release()
+
+	if s.Active() != 0 {
+		t.Errorf("expected the link to be released, got %d active", s.Active())
+	}
+
+	if _, err := s.Connect(context.Background(), PriorityFlowerPower, "flowerpower", newFakeTransport()); err != nil {
+		t.Errorf("expected the flower power to connect once the waypoint disconnected: %s", err)
+	}
+}
+
+func TestConnectionSchedulerTagAlert(t *testing.T) {
+
+	alertChar := &bluez.Characteristic{UUID: stickNFindWriteUUID, Handle: 0x0024, CharValueHandle: 0x0025, Properties: bluez.PropWrite}
+
+	s := connections
+	defer func() { connections = s }()
+	connections = NewConnectionScheduler(1)
+
+	waypoint, err := connections.Connect(context.Background(), PriorityWaypoint, "waypoint", newFakeTransport())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := newFakeTransport(alertChar)
+	tag := &BLETag{address: "tag", transport: transport, alertChar: alertChar}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tag.alert()
+	}()
+
+	waitForQueue(t, connections, 1)
+	waypoint.Release()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if connections.Active() != 0 {
+		t.Errorf("expected the alert to release its link")
+	}
+}
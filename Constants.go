@@ -5,20 +5,25 @@ import "time"
 const (
 	flowerPowerServiceUuid = "39e1fa0084a811e2afba0002a5d5c51b"
 	stickNFindServiceUuid  = "bec26202a8d84a9480fc9ac1de37daa6"
+	sunlightUuid           = "39e1fa0184a811e2afba0002a5d5c51b"
+	temperatureUuid        = "39e1fa0484a811e2afba0002a5d5c51b"
+	moistureUuid           = "39e1fa0584a811e2afba0002a5d5c51b"
 	liveModeUuid           = "39e1fa0684a811e2afba0002a5d5c51b"
-	sunlightHandle         = 37
-	temperatureHandle      = 49
-	moistureHandle         = 53
-	batteryHandle          = 68
-	sunlightStartHandle    = 36
-	sunlightEndHandle      = 39
-	moistureStartHandle    = 52
-	moistureEndHandle      = 55
-	temperatureStartHandle = 48
-	temperatureEndHandle   = 51
+	batteryLevelUuid       = "00002a1900001000800000805f9b34fb"
+	waypointLocalName      = "NinjaSphereWaypoint"
 	waypointStartHandle    = 45
 	waypointEndHandle      = 48
 	dataInterval           = time.Second * 5
 	sleepInterval          = time.Minute * 30
 	minRSSI                = -50
 )
+
+const (
+	readTimeout                = time.Second * 10
+	connectTimeout             = time.Second * 10
+	connectionQueueTimeout     = time.Minute      // the longest anything waits for a link
+	maxConnections             = 3                // links the controller can hold at once
+	gatttoolTimeout            = time.Second * 15 // for each gatttool command, including connecting
+	defaultLowBatteryThreshold = 10               // percent
+	lowBatteryRearmMargin      = 5                // percent above the threshold before the alert can fire again
+)
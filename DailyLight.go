@@ -0,0 +1,188 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// readings further apart than this aren't integrated, the gap is left out of the day's coverage
+const maxLightGap = time.Hour * 2
+
+// DailyLightIntegral is the light received over a local day, sent at midnight.
+type DailyLightIntegral struct {
+	Date     string  `json:"date"`     // 2006-01-02
+	Value    float64 `json:"value"`    // mol/m²/day
+	Coverage float64 `json:"coverage"` // fraction of the day the readings covered
+}
+
+// dailyLight integrates sunlight readings, which the calibration gives as photosynthetic photon
+// flux density in µmol/m²/s, into the light received over a local day. The readings arrive
+// irregularly, in bursts while live mode is on and then not for the sample interval, so each gap
+// between readings is integrated with the trapezoid rule. It is persisted in the device
+// configuration after each burst, at each midnight and on shutdown, so the running total
+// survives restarts, even when the driver is killed without stopping.
+type dailyLight struct {
+	sync.Mutex `json:"-"`
+	Day        time.Time `json:"day"`       // local midnight of the day being accumulated
+	Total      float64   `json:"total"`     // mol/m²
+	Covered    float64   `json:"covered"`   // seconds of the day which have been integrated
+	LastTime   time.Time `json:"lastTime"`  // time of the last reading
+	LastValue  float64   `json:"lastValue"` // µmol/m²/s
+	unsaved    bool      // readings have been added since the last save
+}
+
+// add integrates a reading, returning the integrals of any days completed before it.
+func (l *dailyLight) add(at time.Time, ppfd float64) []*DailyLightIntegral {
+	l.Lock()
+	defer l.Unlock()
+
+	completed := l.rollover(at)
+
+	if !l.LastTime.IsZero() && !at.After(l.LastTime) {
+		return completed
+	}
+
+	if l.LastTime.IsZero() {
+		l.Day = localMidnight(at)
+	} else if at.Sub(l.LastTime) <= maxLightGap {
+		l.Total += trapezoid(l.LastTime, l.LastValue, at, ppfd)
+		l.Covered += at.Sub(l.LastTime).Seconds()
+	}
+
+	l.LastTime, l.LastValue = at, ppfd
+	l.unsaved = true
+
+	return completed
+}
+
+// complete finishes every day which ended before now, returning their integrals.
+func (l *dailyLight) complete(now time.Time) []*DailyLightIntegral {
+	l.Lock()
+	defer l.Unlock()
+	return l.rollover(now)
+}
+
+func (l *dailyLight) rollover(now time.Time) []*DailyLightIntegral {
+	completed := []*DailyLightIntegral{}
+
+	if l.LastTime.IsZero() {
+		return completed
+	}
+
+	for localMidnight(now).After(l.Day) {
+		midnight := l.Day.AddDate(0, 0, 1)
+
+		// the last reading holds until midnight, unless it is too old
+		if midnight.Sub(l.LastTime) <= maxLightGap {
+			l.Total += l.LastValue * midnight.Sub(l.LastTime).Seconds() / 1e6
+			l.Covered += midnight.Sub(l.LastTime).Seconds()
+			l.LastTime = midnight
+		}
+
+		completed = append(completed, &DailyLightIntegral{
+			Date:     l.Day.Format("2006-01-02"),
+			Value:    l.Total,
+			Coverage: l.Covered / midnight.Sub(l.Day).Seconds(),
+		})
+
+		l.Day, l.Total, l.Covered = midnight, 0, 0
+	}
+
+	return completed
+}
+
+// state returns a copy of the integrator for persisting.
+func (l *dailyLight) state() *dailyLight {
+	l.Lock()
+	defer l.Unlock()
+	l.unsaved = false
+	return l.copy()
+}
+
+// unsavedState returns a copy of the integrator if readings have been added since it was last
+// persisted, otherwise nil.
+func (l *dailyLight) unsavedState() *dailyLight {
+	l.Lock()
+	defer l.Unlock()
+	if !l.unsaved {
+		return nil
+	}
+	l.unsaved = false
+	return l.copy()
+}
+
+// copy must be called with the lock held.
+func (l *dailyLight) copy() *dailyLight {
+	return &dailyLight{
+		Day:       l.Day,
+		Total:     l.Total,
+		Covered:   l.Covered,
+		LastTime:  l.LastTime,
+		LastValue: l.LastValue,
+	}
+}
+
+// trapezoid integrates a µmol/m²/s reading linearly between two times, returning mol/m².
+func trapezoid(t0 time.Time, v0 float64, t1 time.Time, v1 float64) float64 {
+	return (v0 + v1) / 2 * t1.Sub(t0).Seconds() / 1e6
+}
+
+func localMidnight(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// addSunlight integrates a sunlight reading in µmol/m²/s into the daily light.
+func (fp *FlowerPower) addSunlight(at time.Time, ppfd float64) {
+	completed := fp.light.add(at, ppfd)
+	if len(completed) > 0 {
+		fp.publishDailyLight(completed)
+		fp.saveDailyLight(fp.light.state())
+	}
+}
+
+// startDailyLightLoop publishes the daily light integral at each local midnight.
+func (fp *FlowerPower) startDailyLightLoop() {
+	go func() {
+		for {
+			now := time.Now()
+			time.Sleep(localMidnight(now).AddDate(0, 0, 1).Sub(now) + time.Second)
+
+			completed := fp.light.complete(time.Now())
+			if len(completed) > 0 {
+				fp.publishDailyLight(completed)
+				fp.saveDailyLight(fp.light.state())
+			}
+		}
+	}()
+}
+
+func (fp *FlowerPower) publishDailyLight(completed []*DailyLightIntegral) {
+	for _, integral := range completed {
+		fplog.Infof("Flower power %s daily light integral for %s: %f mol/m² (%.0f%% coverage)",
+			fp.gattDevice.Address, integral.Date, integral.Value, integral.Coverage*100)
+
+		if fp.sendEvent != nil {
+			if err := fp.sendEvent("daily-light-integral", integral); err != nil {
+				fplog.Errorf("Failed to send daily-light-integral event: %s", err)
+			}
+		}
+
+		fp.checkPlant(func(profile *PlantProfile, send alertSender) {
+			fp.alerts.dailyLight(profile, integral.Value, send)
+		})
+	}
+}
+
+// saveUnsavedDailyLight persists the running total if readings have been added since it was saved.
+func (fp *FlowerPower) saveUnsavedDailyLight() {
+	if state := fp.light.unsavedState(); state != nil {
+		fp.saveDailyLight(state)
+	}
+}
+
+func (fp *FlowerPower) saveDailyLight(state *dailyLight) {
+	if err := fp.driver.saveDailyLight(fp.gattDevice.Address, state); err != nil {
+		fplog.Errorf("Failed to save daily light: %s", err)
+	}
+}
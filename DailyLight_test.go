@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/gatt"
+)
+
+// µmol/m²/s, about the flux density of bright shade
+const testPPFD = 1000
+
+func TestDailyLightWholeDay(t *testing.T) {
+	light := &dailyLight{}
+
+	day := time.Date(2014, 10, 1, 0, 0, 0, 0, time.Local)
+
+	for minutes := 0; minutes < 24*60; minutes += 30 {
+		if completed := light.add(day.Add(time.Duration(minutes)*time.Minute), 1000); len(completed) != 0 {
+			t.Fatalf("day completed early %#v", completed)
+		}
+	}
+
+	completed := light.complete(day.AddDate(0, 0, 1).Add(time.Second))
+
+	if len(completed) != 1 {
+		t.Fatalf("expected one completed day, got %d", len(completed))
+	}
+
+	if completed[0].Date != "2014-10-01" {
+		t.Errorf("bad date %s", completed[0].Date)
+	}
+
+	if expected := testPPFD * 86400 / 1e6; math.Abs(completed[0].Value-expected) > 1e-9 {
+		t.Errorf("expected %f mol/m², got %f", expected, completed[0].Value)
+	}
+
+	if completed[0].Coverage != 1 {
+		t.Errorf("expected full coverage, got %f", completed[0].Coverage)
+	}
+
+	if again := light.complete(day.AddDate(0, 0, 1).Add(time.Minute)); len(again) != 0 {
+		t.Errorf("day completed twice")
+	}
+}
+
+func TestDailyLightIrregularSamples(t *testing.T) {
+	light := &dailyLight{}
+
+	day := time.Date(2014, 10, 1, 0, 0, 0, 0, time.Local)
+
+	// a burst of live readings, then nothing until the next sample
+	light.add(day.Add(12*time.Hour), 0)
+	light.add(day.Add(12*time.Hour+time.Second), 1000)
+	light.add(day.Add(12*time.Hour+2*time.Second), 1000)
+	light.add(day.Add(12*time.Hour+30*time.Minute), 1000)
+
+	expected := (testPPFD/2*1 + testPPFD*(30*60-1)) / 1e6
+
+	if math.Abs(light.Total-expected) > 1e-9 {
+		t.Errorf("expected %f mol/m², got %f", expected, light.Total)
+	}
+}
+
+func TestDailyLightSkipsLongGaps(t *testing.T) {
+	light := &dailyLight{}
+
+	day := time.Date(2014, 10, 1, 0, 0, 0, 0, time.Local)
+
+	light.add(day.Add(6*time.Hour), 1000)
+	light.add(day.Add(12*time.Hour), 1000)
+	light.add(day.Add(13*time.Hour), 1000)
+
+	if expected := testPPFD * 3600 / 1e6; math.Abs(light.Total-expected) > 1e-9 {
+		t.Errorf("expected only the last hour to be integrated, %f mol/m², got %f", expected, light.Total)
+	}
+
+	if light.Covered != 3600 {
+		t.Errorf("expected an hour of coverage, got %f seconds", light.Covered)
+	}
+}
+
+func TestDailyLightSplitsAtMidnight(t *testing.T) {
+	light := &dailyLight{}
+
+	evening := time.Date(2014, 10, 1, 23, 0, 0, 0, time.Local)
+
+	light.add(evening, 1000)
+	completed := light.add(evening.Add(2*time.Hour), 1000)
+
+	if len(completed) != 1 {
+		t.Fatalf("expected the day to be complete")
+	}
+
+	hour := testPPFD * 3600 / 1e6
+
+	if math.Abs(completed[0].Value-hour) > 1e-9 {
+		t.Errorf("expected %f for the first day, got %f", hour, completed[0].Value)
+	}
+
+	if math.Abs(light.Total-hour) > 1e-9 {
+		t.Errorf("expected %f carried into the next day, got %f", hour, light.Total)
+	}
+}
+
+func TestDailyLightPersistence(t *testing.T) {
+	light := &dailyLight{}
+
+	day := time.Date(2014, 10, 1, 0, 0, 0, 0, time.Local)
+
+	light.add(day.Add(8*time.Hour), 1000)
+	light.add(day.Add(9*time.Hour), 1000)
+
+	data, err := json.Marshal(light.state())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &dailyLight{}
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+
+	restored.add(day.Add(10*time.Hour), 1000)
+	completed := restored.complete(day.AddDate(0, 0, 1))
+
+	if expected := testPPFD * 2 * 3600 / 1e6; len(completed) != 1 || math.Abs(completed[0].Value-expected) > 1e-9 {
+		t.Errorf("expected %f mol/m² after restoring, got %#v", expected, completed)
+	}
+}
+
+func TestDailyLightFromSunlightSensor(t *testing.T) {
+	tables, err := loadCalibrationTables(testCalibrationDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the calibrated sunlight is already a flux density, 192773.17 * raw^-1.0606619
+	ppfd, err := tables.parseSunlight(rawReading(150))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ppfd != 948.31 {
+		t.Fatalf("expected raw 150 to be 948.31 µmol/m²/s, got %f", ppfd)
+	}
+
+	light := &dailyLight{}
+
+	day := time.Date(2014, 10, 1, 0, 0, 0, 0, time.Local)
+	for minutes := 0; minutes < 24*60; minutes += 15 {
+		light.add(day.Add(time.Duration(minutes)*time.Minute), ppfd)
+	}
+
+	completed := light.complete(day.AddDate(0, 0, 1))
+
+	// 948.31 µmol/m²/s for 86400 seconds
+	if len(completed) != 1 || math.Abs(completed[0].Value-81.934) > 0.001 {
+		t.Errorf("expected 81.934 mol/m²/day, got %#v", completed)
+	}
+}
+
+func TestDailyLightSavedOnStop(t *testing.T) {
+	saved := 0
+	driver := &FlowerPowerDriver{
+		Config:       &FlowerPowerConfig{},
+		flowerPowers: make(map[string]*FlowerPower),
+		sendEvent: func(event string, payload interface{}) error {
+			saved++
+			return nil
+		},
+	}
+
+	fp := &FlowerPower{driver: driver, gattDevice: &gatt.DiscoveredDevice{Address: "a0:14:3d:08:b4:90"}, light: &dailyLight{}, alerts: newPlantAlerts()}
+	driver.flowerPowers[fp.gattDevice.Address] = fp
+
+	day := time.Date(2014, 10, 1, 0, 0, 0, 0, time.Local)
+	fp.addSunlight(day.Add(8*time.Hour), testPPFD)
+	fp.addSunlight(day.Add(9*time.Hour), testPPFD)
+
+	if saved != 0 {
+		t.Errorf("expected readings during the day not to save the config, saved %d times", saved)
+	}
+
+	driver.Stop()
+
+	light := driver.deviceConfig(fp.gattDevice.Address).DailyLight
+	if saved != 1 || light == nil || light.Total != testPPFD*3600/1e6 {
+		t.Fatalf("expected the running total to be saved on stop, saved %d times, got %+v", saved, light)
+	}
+
+	driver.Stop()
+	if saved != 1 {
+		t.Errorf("expected an unchanged total not to be saved again")
+	}
+
+	// the first reading of the next day saves the completed one
+	fp.addSunlight(day.AddDate(0, 0, 1).Add(time.Minute), testPPFD)
+	if saved != 2 {
+		t.Errorf("expected the rollover to save the config")
+	}
+}
+
+func TestDailyLightSurvivesRestart(t *testing.T) {
+	driver := &FlowerPowerDriver{
+		Config:       &FlowerPowerConfig{},
+		flowerPowers: make(map[string]*FlowerPower),
+		sendEvent: func(event string, payload interface{}) error {
+			return nil
+		},
+	}
+
+	fp := &FlowerPower{driver: driver, gattDevice: &gatt.DiscoveredDevice{Address: "a0:14:3d:08:b4:90"}, light: &dailyLight{}, alerts: newPlantAlerts()}
+	driver.flowerPowers[fp.gattDevice.Address] = fp
+
+	day := time.Date(2014, 10, 1, 0, 0, 0, 0, time.Local)
+	fp.addSunlight(day.Add(8*time.Hour), testPPFD)
+	fp.addSunlight(day.Add(9*time.Hour), testPPFD)
+
+	// the end of the live mode burst, then the driver is killed without stopping
+	fp.saveUnsavedDailyLight()
+
+	data, err := json.Marshal(driver.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := &FlowerPowerDriver{Config: &FlowerPowerConfig{}}
+	if err := json.Unmarshal(data, restarted.Config); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := restarted.deviceConfig(fp.gattDevice.Address).DailyLight
+	if saved == nil {
+		t.Fatal("expected the daily light to be saved after the burst")
+	}
+
+	fp = &FlowerPower{driver: restarted, gattDevice: fp.gattDevice, light: saved.state(), alerts: newPlantAlerts()}
+	fp.addSunlight(day.Add(10*time.Hour), testPPFD)
+
+	completed := fp.light.complete(day.AddDate(0, 0, 1))
+	if expected := testPPFD * 2 * 3600 / 1e6; len(completed) != 1 || math.Abs(completed[0].Value-expected) > 1e-9 {
+		t.Errorf("expected %f mol/m² after restarting, got %#v", expected, completed)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+	"github.com/ninjasphere/go-ninja/model"
+)
+
+// GAP device name and Device Information service characteristics
+const (
+	deviceNameUuid       = "00002a0000001000800000805f9b34fb"
+	manufacturerNameUuid = "00002a2900001000800000805f9b34fb"
+	modelNumberUuid      = "00002a2400001000800000805f9b34fb"
+	serialNumberUuid     = "00002a2500001000800000805f9b34fb"
+	firmwareRevisionUuid = "00002a2600001000800000805f9b34fb"
+)
+
+// DeviceInformation is read from a device the first time we connect, and cached in the configuration.
+type DeviceInformation struct {
+	Name             string `json:"name,omitempty"`
+	Manufacturer     string `json:"manufacturer,omitempty"`
+	Model            string `json:"model,omitempty"`
+	SerialNumber     string `json:"serialNumber,omitempty"`
+	FirmwareRevision string `json:"firmwareRevision,omitempty"`
+}
+
+// readDeviceInformation reads whichever of the GAP device name and Device Information service
+// characteristics the device has. Failed reads are logged and left empty, and nil is returned
+// if even the name couldn't be read, so it isn't cached and is read again on a later connect.
+func readDeviceInformation(ctx context.Context, transport Transport, chars []*bluez.Characteristic) *DeviceInformation {
+	info := &DeviceInformation{}
+
+	fields := map[string]*string{
+		deviceNameUuid:       &info.Name,
+		manufacturerNameUuid: &info.Manufacturer,
+		modelNumberUuid:      &info.Model,
+		serialNumberUuid:     &info.SerialNumber,
+		firmwareRevisionUuid: &info.FirmwareRevision,
+	}
+
+	for _, char := range chars {
+		field, ok := fields[normaliseUuid(char.UUID)]
+		if !ok {
+			continue
+		}
+
+		readCtx, cancel := context.WithTimeout(ctx, gatttoolTimeout)
+		data, err := transport.Read(readCtx, char.CharValueHandle)
+		cancel()
+		if err != nil {
+			log.Warningf("Failed to read characteristic %s: %s", char.UUID, err)
+			continue
+		}
+
+		*field = strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+	}
+
+	if info.Name == "" {
+		return nil
+	}
+
+	return info
+}
+
+// apply fills in the device's name and signatures with the values which were read.
+func (i *DeviceInformation) apply(device *model.Device) {
+	if i == nil {
+		return
+	}
+
+	if i.Name != "" {
+		name := i.Name
+		device.Name = &name
+	}
+
+	signatures := map[string]string{}
+	if device.Signatures != nil {
+		signatures = *device.Signatures
+	}
+
+	for signature, value := range map[string]string{
+		"ninja:manufacturer":    i.Manufacturer,
+		"ninja:model":           i.Model,
+		"ninja:serialNumber":    i.SerialNumber,
+		"ninja:firmwareVersion": i.FirmwareRevision,
+	} {
+		if value != "" {
+			signatures[signature] = value
+		}
+	}
+
+	device.Signatures = &signatures
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ninjasphere/go-ninja/model"
+)
+
+func TestDeviceInformationApply(t *testing.T) {
+	name := "FlowerPower"
+	device := &model.Device{
+		Name: &name,
+		Signatures: &map[string]string{
+			"ninja:manufacturer": "Parrot",
+			"ninja:thingType":    "plantsensor",
+		},
+	}
+
+	info := &DeviceInformation{
+		Name:             "Flower power B490",
+		Model:            "Flower power",
+		FirmwareRevision: "1.1.0",
+	}
+
+	info.apply(device)
+
+	if *device.Name != "Flower power B490" {
+		t.Errorf("bad name %s", *device.Name)
+	}
+
+	signatures := *device.Signatures
+
+	expected := map[string]string{
+		"ninja:manufacturer":    "Parrot",
+		"ninja:thingType":       "plantsensor",
+		"ninja:model":           "Flower power",
+		"ninja:firmwareVersion": "1.1.0",
+	}
+
+	if len(signatures) != len(expected) {
+		t.Errorf("bad signatures %v", signatures)
+	}
+
+	for signature, value := range expected {
+		if signatures[signature] != value {
+			t.Errorf("expected %s to be %q, got %q", signature, value, signatures[signature])
+		}
+	}
+}
+
+func TestDeviceInformationApplyNothingRead(t *testing.T) {
+	name := "BLE Tag"
+	device := &model.Device{Name: &name}
+
+	var info *DeviceInformation
+	info.apply(device)
+
+	(&DeviceInformation{}).apply(device)
+
+	if *device.Name != "BLE Tag" {
+		t.Errorf("name was overwritten with %s", *device.Name)
+	}
+}
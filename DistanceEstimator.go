@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+	"github.com/ninjasphere/gatt"
+)
+
+const (
+	defaultMeasuredPower    = -59 // dBm at 1m, typical for a phone or tag
+	defaultPathLossExponent = 2.0 // free space, indoors is usually 2 to 4
+	minPathLossExponent     = 1.0
+	maxPathLossExponent     = 6.0
+
+	calibratedRssiDeviation   = 4.0 // dB the rssi wanders by once we know the device's power
+	uncalibratedRssiDeviation = 8.0 // and when we are guessing it
+)
+
+// iBeaconPrefix is the Apple company id, then the iBeacon type and length. The measured power
+// at 1m is the last byte.
+var iBeaconPrefix = []byte{0x4c, 0x00, 0x02, 0x15}
+
+const iBeaconLength = 25
+
+// DistanceCalibration is measured for a device by holding it 1m from a waypoint.
+type DistanceCalibration struct {
+	MeasuredPower int8    `json:"measuredPower"`      // dBm at 1m
+	PathLoss      float64 `json:"pathLoss,omitempty"` // the path loss exponent, zero for the driver's
+}
+
+// Validate checks the calibration before it is used.
+func (c *DistanceCalibration) Validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if c.MeasuredPower >= 0 || c.MeasuredPower < -100 {
+		return fmt.Errorf("Invalid measured power %d, expected -100 to -1 dBm", c.MeasuredPower)
+	}
+
+	return validatePathLoss(c.PathLoss)
+}
+
+func validatePathLoss(exponent float64) error {
+	if exponent != 0 && (exponent < minPathLossExponent || exponent > maxPathLossExponent) {
+		return fmt.Errorf("Invalid path loss exponent %f, expected %.0f to %.0f", exponent, minPathLossExponent, maxPathLossExponent)
+	}
+	return nil
+}
+
+// DistanceEstimator estimates how far a device is from a waypoint with a log-distance path loss
+// model. The device's power at 1m comes from its advertisement when it sends one, otherwise
+// from its calibration, otherwise a typical value is assumed.
+type DistanceEstimator struct {
+	sync.Mutex
+	pathLoss    float64
+	calibration map[string]*DistanceCalibration // by device
+	advertised  map[string]int8                 // measured power from the advertisement, by deviceKey
+}
+
+func NewDistanceEstimator() *DistanceEstimator {
+	return &DistanceEstimator{
+		pathLoss:    defaultPathLossExponent,
+		calibration: make(map[string]*DistanceCalibration),
+		advertised:  make(map[string]int8),
+	}
+}
+
+// SetCalibration replaces the device calibrations and the default path loss exponent, zero for
+// free space.
+func (e *DistanceEstimator) SetCalibration(calibration map[string]*DistanceCalibration, pathLoss float64) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.calibration = make(map[string]*DistanceCalibration)
+	for device, c := range calibration {
+		if c != nil {
+			e.calibration[normaliseAddress(device)] = c
+		}
+	}
+
+	e.pathLoss = pathLoss
+	if e.pathLoss == 0 {
+		e.pathLoss = defaultPathLossExponent
+	}
+}
+
+// handleAdvertisement records the measured power from iBeacon advertisements.
+func (e *DistanceEstimator) handleAdvertisement(device *gatt.DiscoveredDevice) {
+	data := device.Advertisement.ManufacturerData
+	if len(data) != iBeaconLength {
+		return
+	}
+
+	power := int8(data[iBeaconLength-1])
+	if power >= 0 {
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	e.advertised[deviceKey(device.Address, addrType(device.PublicAddress))] = power
+}
+
+// Estimate returns the distance to the device in metres, and how far out it might be. Both are
+// zero if the rssi isn't usable. The calibration applies whatever the address type, the
+// advertised power only to the device which advertised it.
+func (e *DistanceEstimator) Estimate(device, addressType string, rssi int8) (distance float64, accuracy float64) {
+	if rssi >= 0 {
+		return 0, 0
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	power, deviation, pathLoss := int8(defaultMeasuredPower), uncalibratedRssiDeviation, e.pathLoss
+
+	if c, ok := e.calibration[normaliseAddress(device)]; ok {
+		power, deviation = c.MeasuredPower, calibratedRssiDeviation
+		if c.PathLoss != 0 {
+			pathLoss = c.PathLoss
+		}
+	}
+
+	advertised, ok := e.advertised[deviceKey(device, addressType)]
+	if !ok && addressType == "" {
+		// the sphere's own rssi doesn't say, but the advertisement it came with did
+		advertised, ok = e.advertised[deviceKey(device, bluez.AddrTypeRandom)]
+	}
+	if ok {
+		power, deviation = advertised, calibratedRssiDeviation
+	}
+
+	distanceAt := func(rssi float64) float64 {
+		return math.Pow(10, (float64(power)-rssi)/(10*pathLoss))
+	}
+
+	distance = distanceAt(float64(rssi))
+
+	// half the range the distance covers when the rssi is a deviation either side
+	accuracy = (distanceAt(float64(rssi)-deviation) - distanceAt(float64(rssi)+deviation)) / 2
+
+	return roundCentimetres(distance), roundCentimetres(accuracy)
+}
+
+func roundCentimetres(metres float64) float64 {
+	return math.Floor(metres*100+0.5) / 100
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+)
+
+func TestDistanceEstimate(t *testing.T) {
+
+	e := NewDistanceEstimator()
+
+	// the default power at 1m is 1m away
+	if distance, _ := e.Estimate("F65F204CB0DB", "", defaultMeasuredPower); distance != 1 {
+		t.Errorf("expected 1m, got %f", distance)
+	}
+
+	// 20dB quieter is 10 times further in free space
+	distance, guessed := e.Estimate("F65F204CB0DB", "", defaultMeasuredPower-20)
+	if distance != 10 {
+		t.Errorf("expected 10m, got %f", distance)
+	}
+
+	e.SetCalibration(map[string]*DistanceCalibration{
+		"f6:5f:20:4c:b0:db": {MeasuredPower: -65, PathLoss: 3},
+	}, 0)
+
+	distance, calibrated := e.Estimate("F65F204CB0DB", "", -95)
+	if distance != 10 {
+		t.Errorf("expected the calibration to give 10m, got %f", distance)
+	}
+	if calibrated >= guessed {
+		t.Errorf("expected a calibrated device to be more accurate, got %f and %f", calibrated, guessed)
+	}
+
+	if distance, accuracy := e.Estimate("F65F204CB0DB", "", 0); distance != 0 || accuracy != 0 {
+		t.Errorf("expected no estimate for an unusable rssi, got %f %f", distance, accuracy)
+	}
+}
+
+func TestDistanceAdvertisedPower(t *testing.T) {
+
+	e := NewDistanceEstimator()
+	e.SetCalibration(map[string]*DistanceCalibration{
+		"F65F204CB0DB": {MeasuredPower: -65},
+	}, 2)
+
+	beacon := append(append([]byte{}, iBeaconPrefix...), make([]byte, iBeaconLength-len(iBeaconPrefix))...)
+	beacon[iBeaconLength-1] = 0xb5 // -75
+
+	device := newTestDevice("", -80, beacon)
+	registry := NewAdvertisementRegistry()
+	registry.Register("distance", &AdvertisementMatcher{ManufacturerDataPrefix: iBeaconPrefix}, e.handleAdvertisement)
+	if names := registry.Matching(device); len(names) != 1 {
+		t.Fatalf("expected the beacon to match, got %v", names)
+	}
+	registry.Handle(device)
+
+	if distance, _ := e.Estimate("F65F204CB0DB", "", -75); distance != 1 {
+		t.Errorf("expected the advertised power to win over the calibration, got %f", distance)
+	}
+
+	// the beacon's address is random, a public device with the same address was calibrated
+	if distance, _ := e.Estimate("F65F204CB0DB", bluez.AddrTypePublic, -75); math.Abs(distance-math.Sqrt(10)) > 0.01 {
+		t.Errorf("expected the calibration for the public address, got %f", distance)
+	}
+
+	// something that isn't a beacon is ignored
+	e.handleAdvertisement(newTestDevice("", -80, iBeaconPrefix))
+	if distance, _ := e.Estimate("F65F204CB0DB", "", -95); math.Abs(distance-10) > 0.01 {
+		t.Errorf("expected 10m, got %f", distance)
+	}
+}
+
+func TestInvalidDistanceCalibration(t *testing.T) {
+	for _, c := range []*DistanceCalibration{
+		{MeasuredPower: 0},
+		{MeasuredPower: 4},
+		{MeasuredPower: -59, PathLoss: 0.5},
+		{MeasuredPower: -59, PathLoss: 7},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected %#v to be invalid", c)
+		}
+	}
+
+	if err := (&DistanceCalibration{MeasuredPower: -59, PathLoss: 2.5}).Validate(); err != nil {
+		t.Errorf("expected a calibration to be valid: %s", err)
+	}
+}
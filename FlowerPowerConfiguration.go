@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+func (d *FlowerPowerDriver) Configure(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	fplog.Infof("Incoming configuration request. Action:%s Data:%s", request.Action, string(request.Data))
+
+	switch request.Action {
+	case "list", "":
+		return d.listScreen(), nil
+
+	case "edit":
+		var values map[string]string
+		if err := json.Unmarshal(request.Data, &values); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal edit request %s: %s", request.Data, err)
+		}
+		return d.editScreen(d.deviceConfig(values["flowerpower"])), nil
+
+	case "save":
+		var values map[string]string
+		if err := json.Unmarshal(request.Data, &values); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal save request %s: %s", request.Data, err)
+		}
+
+		deviceConfig, err := d.deviceConfigFromValues(values)
+		if err == nil {
+			err = d.saveDeviceConfig(deviceConfig)
+		}
+		if err != nil {
+			return d.errorScreen(err), nil
+		}
+
+		return d.listScreen(), nil
+
+	default:
+		return nil, fmt.Errorf("Unknown action: %s", request.Action)
+	}
+}
+
+func (d *FlowerPowerDriver) listScreen() *suit.ConfigurationScreen {
+
+	options := []suit.ActionListOption{}
+
+	d.lkConfig.Lock()
+	for address := range d.flowerPowers {
+		options = append(options, suit.ActionListOption{
+			Title: address,
+			Value: address,
+		})
+	}
+	d.lkConfig.Unlock()
+
+	return &suit.ConfigurationScreen{
+		Title: "Flower Power",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.ActionList{
+						Name:    "flowerpower",
+						Options: options,
+						PrimaryAction: &suit.ReplyAction{
+							Name:        "edit",
+							DisplayIcon: "pencil",
+						},
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.CloseAction{
+				Label: "Close",
+			},
+		},
+	}
+}
+
+func (d *FlowerPowerDriver) editScreen(deviceConfig *FlowerPowerDeviceConfig) *suit.ConfigurationScreen {
+
+	quietStart, quietEnd := "", ""
+	if deviceConfig.QuietHours != nil {
+		quietStart, quietEnd = deviceConfig.QuietHours.Start, deviceConfig.QuietHours.End
+	}
+
+	profile := deviceConfig.Profile
+	if profile == nil {
+		profile = &PlantProfile{}
+	}
+
+	return &suit.ConfigurationScreen{
+		Title: "Flower Power " + deviceConfig.Address,
+		Sections: []suit.Section{
+			suit.Section{
+				Title: "Sampling",
+				Contents: []suit.Typed{
+					suit.InputHidden{
+						Name:  "address",
+						Value: deviceConfig.Address,
+					},
+					suit.InputText{
+						Name:      "sampleInterval",
+						Before:    "Sample every",
+						After:     "minutes",
+						InputType: "number",
+						Value:     deviceConfig.SampleInterval,
+					},
+					suit.InputText{
+						Name:      "liveModeDuration",
+						Before:    "Sample for",
+						After:     "seconds",
+						InputType: "number",
+						Value:     deviceConfig.LiveModeDuration,
+					},
+				},
+			},
+			suit.Section{
+				Title:    "Quiet hours",
+				Subtitle: "The plant won't be sampled between these times, leave them empty to always sample",
+				Contents: []suit.Typed{
+					suit.InputText{
+						Name:        "quietStart",
+						Before:      "From",
+						Placeholder: "22:00",
+						Value:       quietStart,
+					},
+					suit.InputText{
+						Name:        "quietEnd",
+						Before:      "Until",
+						Placeholder: "06:00",
+						Value:       quietEnd,
+					},
+				},
+			},
+			suit.Section{
+				Title:    "Plant profile",
+				Subtitle: "You will be alerted when the plant is outside these limits, leave a limit empty to ignore it",
+				Contents: []suit.Typed{
+					limitInput("minMoisture", "Minimum moisture", "%", profile.MinMoisture),
+					limitInput("maxMoisture", "Maximum moisture", "%", profile.MaxMoisture),
+					limitInput("minTemperature", "Minimum temperature", "°C", profile.MinTemperature),
+					limitInput("maxTemperature", "Maximum temperature", "°C", profile.MaxTemperature),
+					limitInput("minDailyLight", "Minimum daily light", "mol/m²/day", profile.MinDailyLight),
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.CloseAction{
+				Label: "Cancel",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "save",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+}
+
+func (d *FlowerPowerDriver) errorScreen(err error) *suit.ConfigurationScreen {
+	return &suit.ConfigurationScreen{
+		Title: "Error",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "An error occurred",
+						Value: err.Error(),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Back",
+				Name:  "list",
+			},
+		},
+	}
+}
+
+// deviceConfigFromValues builds a device configuration from the edit screen's values, starting
+// from the existing configuration so fields not on the screen are kept.
+func (d *FlowerPowerDriver) deviceConfigFromValues(values map[string]string) (*FlowerPowerDeviceConfig, error) {
+	address := values["address"]
+	if address == "" {
+		return nil, fmt.Errorf("Missing flower power address")
+	}
+
+	deviceConfig := d.deviceConfig(address)
+
+	sampleInterval, err := strconv.Atoi(values["sampleInterval"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid sample interval %q", values["sampleInterval"])
+	}
+	deviceConfig.SampleInterval = sampleInterval
+
+	liveModeDuration, err := strconv.Atoi(values["liveModeDuration"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid sample duration %q", values["liveModeDuration"])
+	}
+	deviceConfig.LiveModeDuration = liveModeDuration
+
+	deviceConfig.QuietHours = nil
+	if values["quietStart"] != "" || values["quietEnd"] != "" {
+		deviceConfig.QuietHours = &QuietHours{
+			Start: values["quietStart"],
+			End:   values["quietEnd"],
+		}
+	}
+
+	profile := &PlantProfile{}
+	limits := map[string]**float64{
+		"minMoisture":    &profile.MinMoisture,
+		"maxMoisture":    &profile.MaxMoisture,
+		"minTemperature": &profile.MinTemperature,
+		"maxTemperature": &profile.MaxTemperature,
+		"minDailyLight":  &profile.MinDailyLight,
+	}
+	for name, limit := range limits {
+		value := strings.TrimSpace(values[name])
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value %q for %s", value, name)
+		}
+		*limit = &parsed
+	}
+	deviceConfig.Profile = profile
+
+	return deviceConfig, nil
+}
+
+func limitInput(name, label, units string, limit *float64) suit.InputText {
+	value := ""
+	if limit != nil {
+		value = strconv.FormatFloat(*limit, 'f', -1, 64)
+	}
+	return suit.InputText{
+		Name:      name,
+		Before:    label,
+		After:     units,
+		InputType: "number",
+		Value:     value,
+	}
+}
@@ -2,14 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
-	"io/ioutil"
-	"math"
-	"strconv"
+	"fmt"
+	"sync"
 	"time"
 
-	"github.com/bitly/go-simplejson"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
 	"github.com/ninjasphere/gatt"
 	"github.com/ninjasphere/go-ninja/api"
 	"github.com/ninjasphere/go-ninja/channels"
@@ -24,7 +24,34 @@ type FlowerPower struct {
 	temperatureChannel *channels.TemperatureChannel
 	moistureChannel    *channels.MoistureChannel
 	illuminanceChannel *channels.IlluminanceChannel
+	batteryChannel     *channels.BatteryChannel
 	connected          bool
+	batteryLow         bool
+	wake               chan struct{}
+	alerts             *plantAlerts
+	light              *dailyLight
+
+	transport  Transport
+	deviceInfo *DeviceInformation
+
+	lkLink sync.Mutex
+	link   *ScheduledConnection // held from connecting until we are disconnected
+
+	lkHandles    sync.Mutex
+	handles      gattHandles // guarded by lkHandles, as the notifications read them
+	staleHandles bool        // rediscover the handles once we're disconnected
+
+	lkHistory      sync.Mutex
+	history        *historyTransfer
+	historySynced  bool
+	lastHistoryIdx uint32
+	lastPublished  time.Time // guarded by lkHistory, as the notifications set it
+}
+
+// lowBatteryEvent is sent when the battery level drops to or below the configured threshold.
+type lowBatteryEvent struct {
+	Level     float64 `json:"level"`
+	Threshold float64 `json:"threshold"`
 }
 
 func NewFlowerPower(driver *FlowerPowerDriver, gattDevice *gatt.DiscoveredDevice) error {
@@ -35,10 +62,13 @@ func NewFlowerPower(driver *FlowerPowerDriver, gattDevice *gatt.DiscoveredDevice
 		driver:     driver,
 		gattDevice: gattDevice,
 		connected:  false,
+		wake:       make(chan struct{}, 1),
+		alerts:     newPlantAlerts(),
+		light:      &dailyLight{},
 		info: &model.Device{
 			NaturalID:     gattDevice.Address,
 			NaturalIDType: "FlowerPower",
-			Name:          &name, //TODO Fill me in with retrieved value
+			Name:          &name,
 			Signatures: &map[string]string{
 				"ninja:manufacturer": "Parrot",
 				"ninja:productName":  "FlowerPower",
@@ -48,7 +78,51 @@ func NewFlowerPower(driver *FlowerPowerDriver, gattDevice *gatt.DiscoveredDevice
 		},
 	}
 
-	conn := driver.conn
+	transport, err := newTransport(driver.transportKind(), driver.gattClient, gattDevice.Address, gattDevice.PublicAddress, driver.gattOptions(gattDevice.Address), transportEvents{
+		Connected:    fp.deviceConnected,
+		Disconnected: fp.deviceDisconnected,
+		Notification: fp.handleFPNotification,
+	})
+	if err != nil {
+		return err
+	}
+	fp.transport = transport
+
+	if t, ok := transport.(*gattTransport); ok {
+		t.attach(gattDevice)
+	}
+
+	deviceConfig := driver.deviceConfig(gattDevice.Address)
+
+	// anything which isn't cached is discovered by the loop, as we are called from the advertisement,
+	// and the device is exported once it has been so it's announced with its real name
+	fp.deviceInfo = deviceConfig.Info
+	fp.handles = deviceConfig.Handles
+	fp.deviceInfo.apply(fp.info)
+
+	if deviceConfig.DailyLight != nil {
+		fp.light = deviceConfig.DailyLight.state()
+	}
+
+	if deviceConfig.History != nil {
+		fp.lastHistoryIdx = deviceConfig.History.LastIndex
+		fp.lastPublished = deviceConfig.History.LastPublished
+	}
+
+	fp.startFPLoop(gattDevice)
+	fp.startDailyLightLoop()
+
+	fp.driver.lkConfig.Lock()
+	fp.driver.flowerPowers[gattDevice.Address] = fp
+	fp.driver.lkConfig.Unlock()
+
+	fp.driver.announcedFlowerPowers[gattDevice.Address] = true
+	return nil
+}
+
+// export announces the device and its channels.
+func (fp *FlowerPower) export() {
+	conn := fp.driver.conn
 
 	err := conn.ExportDevice(fp)
 	if err != nil {
@@ -76,42 +150,82 @@ func NewFlowerPower(driver *FlowerPowerDriver, gattDevice *gatt.DiscoveredDevice
 		spew.Dump(fp)
 	}
 
-	gattDevice.Connected = fp.deviceConnected
-	gattDevice.Disconnected = fp.deviceDisconnected
-	gattDevice.Notification = fp.handleFPNotification
-
-	fp.startFPLoop(gattDevice)
-
-	fp.driver.announcedFlowerPowers[gattDevice.Address] = true
-	return nil
+	fp.batteryChannel = channels.NewBatteryChannel(fp)
+	err = conn.ExportChannel(fp, fp.batteryChannel, "battery")
+	if err != nil {
+		fplog.Fatalf("Failed to export flowerpower battery channel %s, dumping device info", err)
+		spew.Dump(fp)
+	}
 }
 
 func (fp *FlowerPower) startFPLoop(gattDevice *gatt.DiscoveredDevice) {
 	go func() {
+		if fp.deviceInfo == nil {
+			fplog.Infof("Discovering Flower Power %s before announcing it", gattDevice.Address)
+			if err := fp.discoverHandles(); err != nil {
+				fplog.Errorf("Flowerpower discovery error:%s", err)
+			}
+		}
+		fp.export()
+
 		for {
 			time.Sleep(time.Second * 1)
 
 			if fp.driver.running == true {
 
+				schedule := fp.driver.deviceConfig(gattDevice.Address)
+
+				if quiet := schedule.QuietHours.remaining(time.Now()); quiet > 0 {
+					fplog.Infof("Flower power %s is in quiet hours for %s", gattDevice.Address, quiet)
+					fp.sleep(quiet)
+					continue
+				}
+
+				if fp.connected == false && (fp.currentHandles() == nil || fp.deviceInfo == nil) {
+					fplog.Infof("Discovering Flower Power %s characteristics", gattDevice.Address)
+					if err := fp.discoverHandles(); err != nil {
+						fplog.Errorf("Flowerpower discovery error:%s", err)
+					}
+				}
+
 				if fp.connected == false {
 					fplog.Infof("Connecting to Flower Power %s", gattDevice.Address)
-					err := fp.driver.gattClient.Connect(gattDevice.Address, gattDevice.PublicAddress)
+					ctx, cancel := context.WithTimeout(context.Background(), connectionQueueTimeout)
+					link, err := connections.Connect(ctx, PriorityFlowerPower, gattDevice.Address, fp.transport)
+					cancel()
 					if err != nil {
 						fplog.Errorf("Flowerpower connect error:%s", err)
+					} else {
+						fp.holdLink(link)
 					}
-					time.Sleep(time.Second * 5) //sorry :(
 				}
 
 				if fp.connected == true {
 					fplog.Infof("Connected to flower power: %s", fp.gattDevice.Address)
 					fplog.Infof("Setting up notifications")
 					fp.notifyAll()
+					fplog.Infof("Reading battery level")
+					fp.checkBattery()
+					if !fp.historySynced {
+						fplog.Infof("Downloading history")
+						if err := fp.downloadHistory(); err != nil {
+							fplog.Errorf("Flowerpower history error:%s", err)
+						} else {
+							fp.historySynced = true
+						}
+					}
 					fplog.Infof("Enabling live mode")
-					fp.EnableLiveMode()
-					time.Sleep(dataInterval)
-					fplog.Infof("Disabling live mode")
-					fp.DisableLiveMode()
-					time.Sleep(sleepInterval)
+					if err := fp.EnableLiveMode(); err != nil {
+						fplog.Errorf("Failed to enable live mode: %s", err)
+					} else {
+						time.Sleep(schedule.liveModeDuration())
+						fplog.Infof("Disabling live mode")
+						if err := fp.DisableLiveMode(); err != nil {
+							fplog.Errorf("Failed to disable live mode: %s", err)
+						}
+					}
+					fp.saveUnsavedDailyLight()
+					fp.sleep(schedule.sampleInterval())
 				}
 			}
 		}
@@ -119,31 +233,111 @@ func (fp *FlowerPower) startFPLoop(gattDevice *gatt.DiscoveredDevice) {
 }
 
 func (fp *FlowerPower) handleFPNotification(notification *gatt.Notification) {
-	if notification.Handle == sunlightHandle {
-		sunlight := parseSunlight(notification.Data)
+	fp.lkHistory.Lock()
+	history := fp.history
+	fp.lkHistory.Unlock()
+
+	if history != nil && history.handleNotification(notification) {
+		return
+	}
+
+	calibration := fp.driver.calibration
+
+	char, ok := fp.currentHandles().byValueHandle(notification.Handle)
+	if !ok {
+		fplog.Infof("Unknown notification handle")
+		spew.Dump(notification)
+		return
+	}
+
+	switch char.UUID {
+	case sunlightUuid:
+		sunlight, err := calibration.parseSunlight(notification.Data)
+		if err != nil {
+			fplog.Errorf("Failed to parse sunlight: %s", err)
+			return
+		}
 		fplog.Infof("Got sunlight: %f", sunlight)
 		fp.illuminanceChannel.SendState(sunlight)
-
-	} else if notification.Handle == moistureHandle {
-		moisture := parseMoisture(notification.Data)
+		now := time.Now()
+		fp.setPublished(now)
+		fp.addSunlight(now, sunlight)
+
+	case moistureUuid:
+		moisture, err := calibration.parseMoisture(notification.Data)
+		if err != nil {
+			fplog.Errorf("Failed to parse moisture: %s", err)
+			return
+		}
 		fplog.Infof("Got moisture: %f", moisture)
 		fp.moistureChannel.SendState(moisture)
-
-	} else if notification.Handle == temperatureHandle {
-		temperature := parseTemperature(notification.Data)
+		fp.setPublished(time.Now())
+		fp.checkPlant(func(profile *PlantProfile, send alertSender) {
+			fp.alerts.moisture(profile, moisture, send)
+		})
+
+	case temperatureUuid:
+		temperature, err := calibration.parseTemperature(notification.Data)
+		if err != nil {
+			fplog.Errorf("Failed to parse temperature: %s", err)
+			return
+		}
 		fplog.Infof("Got temperature: %f", temperature)
 		fp.temperatureChannel.SendState(temperature)
+		fp.setPublished(time.Now())
+		fp.checkPlant(func(profile *PlantProfile, send alertSender) {
+			fp.alerts.temperature(profile, temperature, send)
+		})
 
-	} else {
-		fplog.Infof("Unknown notification handle")
-		spew.Dump(notification)
+	default:
+		fplog.Infof("Unhandled notification from %s", char.UUID)
+	}
+}
+
+// checkBattery samples the battery level, publishes it and sends a low-battery
+// event the first time the level crosses the configured threshold.
+func (fp *FlowerPower) checkBattery() {
+	level, err := fp.GetBatteryLevel()
+	if err != nil {
+		fplog.Errorf("Failed to read flowerpower battery level: %s", err)
+		return
+	}
+
+	fplog.Infof("Got battery level: %f", level)
+	fp.batteryChannel.SendState(level)
+
+	threshold := fp.driver.lowBatteryThreshold()
+
+	wasLow := fp.batteryLow
+	fp.batteryLow = lowBattery(level, threshold, wasLow)
+
+	if !fp.batteryLow || wasLow {
+		return
+	}
+
+	fplog.Infof("Flower power %s battery is low: %f", fp.gattDevice.Address, level)
+
+	if fp.sendEvent != nil {
+		err = fp.sendEvent("low-battery", &lowBatteryEvent{
+			Level:     level,
+			Threshold: threshold,
+		})
+		if err != nil {
+			fplog.Errorf("Failed to send low-battery event: %s", err)
+		}
 	}
 }
 
 func (fp *FlowerPower) notifyAll() {
-	fp.notifyByHandle(sunlightStartHandle, sunlightEndHandle)
-	fp.notifyByHandle(moistureStartHandle, moistureEndHandle)
-	fp.notifyByHandle(temperatureStartHandle, temperatureEndHandle)
+	for _, uuid := range []string{sunlightUuid, moistureUuid, temperatureUuid} {
+		char, err := fp.characteristic(uuid)
+		if err == nil {
+			err = fp.subscribe(char, true)
+		}
+		if err != nil {
+			fplog.Errorf("Failed to enable notifications: %s", err)
+		}
+	}
 }
 
 func (fp *FlowerPower) deviceConnected() {
@@ -152,97 +346,161 @@ func (fp *FlowerPower) deviceConnected() {
 
 func (fp *FlowerPower) deviceDisconnected() {
 	fp.connected = false
+	fp.historySynced = false
+	fp.forgetStaleHandles()
+	fp.holdLink(nil)
 }
 
-func (fp *FlowerPower) GetDeviceInfo() *model.Device {
-	return fp.info
-}
+// holdLink keeps the link the device connected with until it disconnects, releasing the last one.
+// A link which arrives after the device has already disconnected is released straight away.
+func (fp *FlowerPower) holdLink(link *ScheduledConnection) {
+	fp.lkLink.Lock()
+	defer fp.lkLink.Unlock()
 
-func (fp *FlowerPower) GetDriver() ninja.Driver {
-	return fp.driver
-}
+	fp.link.Release()
+	fp.link = nil
 
-func (fp *FlowerPower) SetEventHandler(sendEvent func(event string, payload interface{}) error) {
-	fp.sendEvent = sendEvent
+	if link != nil && !fp.connected {
+		link.Release()
+		return
+	}
+	fp.link = link
 }
 
-//TOOD: this needs to send via a proper handle and value, rather than sending a raw packet
-func (fp *FlowerPower) EnableLiveMode() {
-	cmds := make([]string, 1)
-	cmds[0] = "12390001"
-	fp.driver.gattClient.SendRawCommands(fp.gattDevice.Address, cmds)
+// discoverHandles reads the device's characteristics, this must happen while the gatt client
+// isn't connected as the device only accepts a single connection.
+func (fp *FlowerPower) discoverHandles() error {
+	var chars []*bluez.Characteristic
 
-}
+	ctx, cancel := context.WithTimeout(context.Background(), gatttoolTimeout)
+	defer cancel()
 
-//TOOD: this needs to send via a proper handle and value, rather than sending a raw packet
-func (fp *FlowerPower) DisableLiveMode() {
-	cmds := make([]string, 1)
-	cmds[0] = "12390000"
-	fp.driver.gattClient.SendRawCommands(fp.gattDevice.Address, cmds)
-}
+	err := connections.Run(ctx, PriorityDiscovery, fp.gattDevice.Address, func() error {
+		discoverCtx, cancel := context.WithTimeout(context.Background(), gatttoolTimeout)
+		defer cancel()
 
-func (fp *FlowerPower) notifyByHandle(startHandle, endHandle uint16) {
-	fp.driver.gattClient.Notify(fp.gattDevice.Address, true, startHandle, endHandle, true, false)
-}
+		var err error
+		if chars, err = fp.transport.Discover(discoverCtx); err != nil {
+			return err
+		}
+
+		if fp.deviceInfo == nil {
+			fp.readDeviceInformation(discoverCtx, chars)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-func parseSunlight(data []byte) float64 {
-	sensorVal := bytesToUint(data)
-	if sensorVal < 0 {
-		sensorVal = 0
-	} else if sensorVal > 65530 {
-		sensorVal = 65530
+	// we were only reading the device information
+	if fp.currentHandles() != nil {
+		return nil
 	}
-	rounded := math.Floor(float64(sensorVal)/10) * 10 //Only 10% of data in mapping
 
-	return getValFromMap("sunlight.json", rounded)
-}
+	handles := newGattHandles(chars)
 
-func parseMoisture(data []byte) float64 {
-	sensorVal := bytesToUint(data)
-	if sensorVal < 210 {
-		sensorVal = 210
-	} else if sensorVal > 700 {
-		sensorVal = 700
+	if err := handles.require(sunlightUuid, temperatureUuid, moistureUuid, liveModeUuid, batteryLevelUuid); err != nil {
+		return err
 	}
-	return getValFromMap("soil-moisture.json", float64(sensorVal))
+
+	fp.lkHandles.Lock()
+	fp.handles = handles
+	fp.lkHandles.Unlock()
+
+	if err := fp.driver.saveHandles(fp.gattDevice.Address, handles); err != nil {
+		fplog.Errorf("Failed to save handles: %s", err)
+	}
+
+	return nil
 }
 
-func parseTemperature(data []byte) float64 {
-	sensorVal := bytesToUint(data)
-	if sensorVal < 210 {
-		sensorVal = 210
-	} else if sensorVal > 1372 {
-		sensorVal = 1372
+// readDeviceInformation reads and caches the device information, which is tried again on the
+// next discovery if the device didn't answer.
+func (fp *FlowerPower) readDeviceInformation(ctx context.Context, chars []*bluez.Characteristic) {
+	info := readDeviceInformation(ctx, fp.transport, chars)
+	if info == nil {
+		fplog.Warningf("Failed to read Flower Power %s device information", fp.gattDevice.Address)
+		return
+	}
+
+	fp.deviceInfo = info
+	fp.deviceInfo.apply(fp.info)
+
+	if err := fp.driver.saveDeviceInformation(fp.gattDevice.Address, info); err != nil {
+		fplog.Errorf("Failed to save device information: %s", err)
 	}
-	return getValFromMap("temperature.json", float64(sensorVal))
 }
 
-func (fp *FlowerPower) getValFromHandle(handle int) []byte {
-	// log.Infof("--Readbyhandle-- address: %s handle: %d", fp.gattDevice.Address, handle)
-	data := <-fp.driver.gattClient.ReadByHandle(fp.gattDevice.Address, uint16(handle))
-	return data
+func (fp *FlowerPower) currentHandles() gattHandles {
+	fp.lkHandles.Lock()
+	defer fp.lkHandles.Unlock()
+	return fp.handles
 }
 
-func getValFromMap(filename string, sensorVal float64) float64 {
-	mapFile, err := ioutil.ReadFile("data/" + filename)
+// characteristic returns the handles of the characteristic with the given uuid.
+func (fp *FlowerPower) characteristic(uuid string) (*gattCharacteristic, error) {
+	char, err := fp.currentHandles().get(uuid)
 	if err != nil {
-		fplog.Fatalf("Error reading %s json map file: %s", filename, err)
+		fp.checkHandles(err)
 	}
+	return char, err
+}
 
-	mapJson, err := simplejson.NewFromReader(bytes.NewBuffer(mapFile))
-	if err != nil {
-		fplog.Fatalf("Error creating reader: %s", err)
+// checkHandles marks the cached handles as out of date if the error shows the device doesn't
+// have them, eg. after a firmware update. They are discovered again once we're disconnected,
+// and the new handles replace them in the configuration.
+func (fp *FlowerPower) checkHandles(err error) {
+	if !isStaleHandle(err) {
+		return
 	}
 
-	sensorValStr := strconv.Itoa(int(sensorVal))
+	fp.lkHandles.Lock()
+	defer fp.lkHandles.Unlock()
 
-	ret, err := mapJson.Get(sensorValStr).Float64()
+	if fp.handles != nil && !fp.staleHandles {
+		fplog.Infof("Flower Power %s handles are out of date: %s", fp.gattDevice.Address, err)
+		fp.staleHandles = true
+	}
+}
 
-	if err != nil {
-		fplog.Infof("Error parsing sensor value %f with stringified value %s to mapped value: %s", sensorVal, sensorValStr, err)
+func (fp *FlowerPower) forgetStaleHandles() {
+	fp.lkHandles.Lock()
+	defer fp.lkHandles.Unlock()
+
+	if fp.staleHandles {
+		fplog.Infof("Forgetting Flower Power %s handles", fp.gattDevice.Address)
+		fp.handles, fp.staleHandles = nil, false
 	}
+}
 
-	return ret
+func (fp *FlowerPower) GetDeviceInfo() *model.Device {
+	return fp.info
+}
+
+func (fp *FlowerPower) GetDriver() ninja.Driver {
+	return fp.driver
+}
+
+func (fp *FlowerPower) SetEventHandler(sendEvent func(event string, payload interface{}) error) {
+	fp.sendEvent = sendEvent
+}
+
+// EnableLiveMode starts the device notifying its sensor readings every second.
+func (fp *FlowerPower) EnableLiveMode() error {
+	return fp.writeValue(liveModeUuid, []byte{0x01})
+}
+
+// DisableLiveMode stops the sensor notifications.
+func (fp *FlowerPower) DisableLiveMode() error {
+	return fp.writeValue(liveModeUuid, []byte{0x00})
+}
+
+// subscribe enables or disables notifications from the characteristic.
+func (fp *FlowerPower) subscribe(char *gattCharacteristic, enable bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+	defer cancel()
+	return fp.transport.Subscribe(ctx, char.Handle, char.EndHandle, enable)
 }
 
 func bytesToUint(in []byte) uint16 {
@@ -256,22 +514,57 @@ func bytesToUint(in []byte) uint16 {
 	return ret
 }
 
-func (fp *FlowerPower) GetSunlight() float64 {
-	sensorVal := fp.getValFromHandle(sunlightHandle)
-	return parseSunlight(sensorVal)
+func (fp *FlowerPower) GetSunlight() (float64, error) {
+	sensorVal, err := fp.readValue(sunlightUuid)
+	if err != nil {
+		return 0, err
+	}
+	return fp.driver.calibration.parseSunlight(sensorVal)
+}
+
+func (fp *FlowerPower) GetTemperature() (float64, error) {
+	sensorVal, err := fp.readValue(temperatureUuid)
+	if err != nil {
+		return 0, err
+	}
+	return fp.driver.calibration.parseTemperature(sensorVal)
+}
+
+func (fp *FlowerPower) GetMoisture() (float64, error) {
+	sensorVal, err := fp.readValue(moistureUuid)
+	if err != nil {
+		return 0, err
+	}
+	return fp.driver.calibration.parseMoisture(sensorVal)
 }
 
-func (fp *FlowerPower) GetTemperature() float64 {
-	sensorVal := fp.getValFromHandle(temperatureHandle)
-	return parseTemperature(sensorVal)
+// GetBatteryLevel returns the battery level as a percentage.
+func (fp *FlowerPower) GetBatteryLevel() (float64, error) {
+	data, err := fp.readValue(batteryLevelUuid)
+	if err != nil {
+		return 0, err
+	}
+	return parseBattery(data)
 }
 
-func (fp *FlowerPower) GetMoisture() float64 {
-	sensorVal := fp.getValFromHandle(moistureHandle)
-	return parseMoisture(sensorVal)
+// lowBattery returns whether the battery is low, given whether it was at the last reading. Once
+// low it stays low until the level is the re-arm margin above the threshold, so a reading that
+// wanders around the threshold doesn't send an event every cycle.
+func lowBattery(level, threshold float64, wasLow bool) bool {
+	if wasLow {
+		return level < threshold+lowBatteryRearmMargin
+	}
+	return level <= threshold
 }
 
-func (fp *FlowerPower) GetBatteryLevel() float64 {
-	value := bytesToUint(fp.getValFromHandle(batteryHandle))
-	return float64(value)
+// parseBattery decodes the standard battery level characteristic, a single byte percentage.
+func parseBattery(data []byte) (float64, error) {
+	if len(data) < 1 {
+		return 0, fmt.Errorf("Empty battery level")
+	}
+	level := float64(data[0])
+	if level > 100 {
+		return 0, fmt.Errorf("Invalid battery level %d", data[0])
+	}
+	return level, nil
 }
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestParseBattery(t *testing.T) {
+	for _, test := range []struct {
+		data  []byte
+		level float64
+		ok    bool
+	}{
+		{[]byte{0x00}, 0, true},
+		{[]byte{0x37}, 55, true},
+		{[]byte{0x64}, 100, true},
+		{[]byte{0x65}, 0, false},
+		{[]byte{}, 0, false},
+		{nil, 0, false},
+	} {
+		level, err := parseBattery(test.data)
+		if (err == nil) != test.ok || level != test.level {
+			t.Errorf("% X: expected %f ok %t, got %f %v", test.data, test.level, test.ok, level, err)
+		}
+	}
+}
+
+func TestLowBattery(t *testing.T) {
+
+	threshold := 10.0
+
+	low, sent := false, 0
+
+	// a battery which wobbles around the threshold as it runs down, then is replaced
+	for _, level := range []float64{30, 12, 10, 11, 10, 9, 11, 14, 12, 9, 100, 10} {
+		wasLow := low
+		low = lowBattery(level, threshold, wasLow)
+		if low && !wasLow {
+			sent++
+		}
+	}
+
+	// once at the first 10, then again after the new battery
+	if sent != 2 {
+		t.Errorf("expected 2 low-battery events, got %d", sent)
+	}
+
+	if !lowBattery(threshold+lowBatteryRearmMargin-1, threshold, true) {
+		t.Errorf("expected the alert to stay armed below the margin")
+	}
+	if lowBattery(threshold+lowBatteryRearmMargin, threshold, true) {
+		t.Errorf("expected the alert to re-arm at the margin")
+	}
+	if lowBattery(threshold+1, threshold, false) {
+		t.Errorf("expected a level above the threshold not to be low")
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"sync"
+
 	// "github.com/davecgh/go-spew/spew"
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
 	"github.com/ninjasphere/gatt"
 	"github.com/ninjasphere/go-ninja/api"
 	"github.com/ninjasphere/go-ninja/logger"
@@ -17,6 +20,11 @@ type FlowerPowerDriver struct {
 	gattClient            *gatt.Client
 	running               bool
 	announcedFlowerPowers map[string]bool
+	flowerPowers          map[string]*FlowerPower
+	calibration           *calibrationTables
+	lkConfig              sync.Mutex
+	lkSave                sync.Mutex
+	Config                *FlowerPowerConfig
 }
 
 func NewFlowerPowerDriver(client *gatt.Client) (*FlowerPowerDriver, error) {
@@ -29,11 +37,22 @@ func NewFlowerPowerDriver(client *gatt.Client) (*FlowerPowerDriver, error) {
 		return nil, err
 	}
 
+	// we carry on without the calibration tables, the devices just won't publish any readings
+	calibration, err := loadCalibrationTables(calibrationDataDir)
+	if err != nil {
+		fplog.Errorf("Failed to load calibration tables: %s", err)
+	}
+
 	driver := &FlowerPowerDriver{
 		conn:                  conn,
 		gattClient:            client,
 		running:               true,
 		announcedFlowerPowers: announcedFlowerPowers,
+		flowerPowers:          make(map[string]*FlowerPower),
+		calibration:           calibration,
+		Config: &FlowerPowerConfig{
+			LowBatteryThreshold: defaultLowBatteryThreshold,
+		},
 	}
 
 	err = conn.ExportDriver(driver)
@@ -43,9 +62,24 @@ func NewFlowerPowerDriver(client *gatt.Client) (*FlowerPowerDriver, error) {
 		return nil, err
 	}
 
+	advertisements.Register("flowerpower", &AdvertisementMatcher{
+		ServiceUuid: flowerPowerServiceUuid,
+	}, driver.handleAdvertisement)
+
 	return driver, nil
 }
 
+func (d *FlowerPowerDriver) handleAdvertisement(device *gatt.DiscoveredDevice) {
+	if d.announcedFlowerPowers[device.Address] {
+		return
+	}
+	fplog.Infof("Found Flower Power %s", device.Address)
+	err := NewFlowerPower(d, device)
+	if err != nil {
+		fplog.Errorf("Error creating FlowerPower device %s", err)
+	}
+}
+
 func (d *FlowerPowerDriver) GetModuleInfo() *model.Module {
 	return info
 }
@@ -54,13 +88,100 @@ func (d *FlowerPowerDriver) SetEventHandler(sendEvent func(event string, payload
 	d.sendEvent = sendEvent
 }
 
-func (fp *FlowerPowerDriver) Start() error {
+func (fp *FlowerPowerDriver) Start(config *FlowerPowerConfig) error {
 	fplog.Infof("Starting FlowerPower driver")
+
+	fp.lkConfig.Lock()
+	if config != nil {
+		fp.Config = config
+	}
+	if fp.Config.LowBatteryThreshold <= 0 {
+		fp.Config.LowBatteryThreshold = defaultLowBatteryThreshold
+	}
+	if err := fp.Config.Gatttool.Validate(); err != nil {
+		fplog.Errorf("Ignoring gatttool options: %s", err)
+		fp.Config.Gatttool = nil
+	}
+	if err := validateTransport(fp.Config.Transport); err != nil {
+		fplog.Errorf("Ignoring transport: %s", err)
+		fp.Config.Transport = ""
+	}
+
+	// these haven't been through Configure, eg. they were edited in HomeCloud
+	flowerPowers := []*FlowerPowerDeviceConfig{}
+	for _, deviceConfig := range fp.Config.FlowerPowers {
+		if deviceConfig == nil || deviceConfig.Address == "" {
+			fplog.Errorf("Ignoring flower power config without an address")
+			continue
+		}
+		for _, err := range deviceConfig.repair() {
+			fplog.Errorf("Ignoring flower power %s setting: %s", deviceConfig.Address, err)
+		}
+		flowerPowers = append(flowerPowers, deviceConfig)
+	}
+	fp.Config.FlowerPowers = flowerPowers
+	fp.lkConfig.Unlock()
+
 	fp.running = true
 	return nil
 }
 
 func (fp *FlowerPowerDriver) Stop() error {
 	fp.running = false
+
+	// save the readings since the last live mode burst
+	fp.lkConfig.Lock()
+	devices := []*FlowerPower{}
+	for _, device := range fp.flowerPowers {
+		devices = append(devices, device)
+	}
+	fp.lkConfig.Unlock()
+
+	for _, device := range devices {
+		device.saveUnsavedDailyLight()
+	}
+
 	return nil
 }
+
+func (fp *FlowerPowerDriver) lowBatteryThreshold() float64 {
+	fp.lkConfig.Lock()
+	defer fp.lkConfig.Unlock()
+	return fp.Config.LowBatteryThreshold
+}
+
+// gattOptions returns the driver's gatttool options, with the device's overrides.
+func (fp *FlowerPowerDriver) gattOptions(address string) *bluez.Options {
+	fp.lkConfig.Lock()
+	defer fp.lkConfig.Unlock()
+
+	for _, deviceConfig := range fp.Config.FlowerPowers {
+		if deviceConfig.Address == address {
+			return fp.Config.Gatttool.Override(deviceConfig.Gatttool)
+		}
+	}
+	return fp.Config.Gatttool
+}
+
+func (fp *FlowerPowerDriver) transportKind() string {
+	fp.lkConfig.Lock()
+	defer fp.lkConfig.Unlock()
+	if fp.Config.Transport == "" {
+		return transportGatt
+	}
+	return fp.Config.Transport
+}
+
+// FlowerPowerConfig is persisted by HomeCloud, and provided when the app starts.
+type FlowerPowerConfig struct {
+	// LowBatteryThreshold is the battery percentage at or below which a low-battery event is sent.
+	LowBatteryThreshold float64 `json:"lowBatteryThreshold"`
+
+	FlowerPowers []*FlowerPowerDeviceConfig `json:"flowerPowers"`
+
+	// Gatttool selects the adapter and security level used to discover the handles, nil for the defaults.
+	Gatttool *bluez.Options `json:"gatttool,omitempty"`
+
+	// Transport is how we talk to the devices once they are discovered, gatt (the default) or bluez.
+	Transport string `json:"transport,omitempty"`
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// readHandle reads the handle, giving up if the device goes away mid read.
+func (fp *FlowerPower) readHandle(handle uint16) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+	defer cancel()
+
+	data, err := fp.transport.Read(ctx, handle)
+	if err != nil {
+		fp.checkHandles(err)
+	}
+	return data, err
+}
+
+// readValue reads the characteristic with the given uuid.
+func (fp *FlowerPower) readValue(uuid string) ([]byte, error) {
+	char, err := fp.characteristic(uuid)
+	if err != nil {
+		return nil, err
+	}
+	return fp.readHandle(char.ValueHandle)
+}
+
+// readUint reads a little endian unsigned value of size bytes from the characteristic.
+func (fp *FlowerPower) readUint(uuid string, size int) (uint64, error) {
+	data, err := fp.readValue(uuid)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(data) < size {
+		return 0, fmt.Errorf("Expected %d bytes from %s, got % X", size, uuid, data)
+	}
+
+	var value uint64
+	for i := size - 1; i >= 0; i-- {
+		value = value<<8 | uint64(data[i])
+	}
+	return value, nil
+}
+
+// writeUint writes a little endian unsigned value of size bytes to the characteristic.
+func (fp *FlowerPower) writeUint(uuid string, value uint64, size int) error {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(value >> uint(8*i))
+	}
+	return fp.writeValue(uuid, data)
+}
+
+// writeValue writes the characteristic with the given uuid, returning the device's response.
+func (fp *FlowerPower) writeValue(uuid string, value []byte) error {
+	char, err := fp.characteristic(uuid)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+	defer cancel()
+
+	if err := fp.transport.Write(ctx, char.characteristic(), value); err != nil {
+		fp.checkHandles(err)
+		return err
+	}
+	return nil
+}
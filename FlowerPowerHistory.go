@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/ninjasphere/gatt"
+)
+
+// The FlowerPower keeps a log of samples taken while nothing is connected. The history service
+// describes the log, and the upload service transfers it as a file in 20 byte notifications.
+// The log has no timestamps. A session is taken to start each time the device starts, with its
+// entries logged every period after that, so they are dated with the device's clock, the seconds
+// since it started.
+const (
+	historyNbEntriesUuid        = "39e1fc0184a811e2afba0002a5d5c51b"
+	historyLastEntryIdxUuid     = "39e1fc0284a811e2afba0002a5d5c51b"
+	historyTransferStartIdxUuid = "39e1fc0384a811e2afba0002a5d5c51b"
+	historySessionStartIdxUuid  = "39e1fc0584a811e2afba0002a5d5c51b"
+	historySessionPeriodUuid    = "39e1fc0684a811e2afba0002a5d5c51b"
+	clockCurrentTimeUuid        = "39e1fd0184a811e2afba0002a5d5c51b"
+	uploadTxBufferUuid          = "39e1fb0184a811e2afba0002a5d5c51b"
+	uploadTxStatusUuid          = "39e1fb0284a811e2afba0002a5d5c51b"
+	uploadRxStatusUuid          = "39e1fb0384a811e2afba0002a5d5c51b"
+
+	rxStatusStandby   = 0
+	rxStatusReceiving = 1
+	rxStatusAck       = 2
+
+	txStatusIdle = 0
+
+	historyAckWindow     = 128 // packets received before we acknowledge
+	historyPacketTimeout = time.Second * 10
+	historyRecordSize    = 6
+	maxHistoryBackfill   = 48 * 2 // entries downloaded the first time we see a device
+)
+
+// historyEntry is a single sample from the device log, still in raw sensor units.
+type historyEntry struct {
+	Index       uint32
+	Time        time.Time
+	Sunlight    []byte
+	Temperature []byte
+	Moisture    []byte
+}
+
+// historySession dates the entries logged since the device last started.
+type historySession struct {
+	StartIdx uint32        // the first entry of the session
+	Started  time.Time     // when the device started, from its clock
+	Period   time.Duration // between entries
+}
+
+// entryTime returns when an entry of the session was logged, at the end of its period.
+func (s *historySession) entryTime(index uint32) time.Time {
+	return s.Started.Add(time.Duration(index-s.StartIdx+1) * s.Period)
+}
+
+// historicalState is sent on a channel's history event to backfill a missed reading.
+type historicalState struct {
+	Timestamp int64   `json:"timestamp"` // ms since the epoch
+	Value     float64 `json:"value"`
+}
+
+// historyState is how far the device log has been published, persisted so a restart doesn't
+// backfill the same entries again.
+type historyState struct {
+	LastIndex     uint32    `json:"lastIndex"`     // the last entry downloaded
+	LastPublished time.Time `json:"lastPublished"` // the time of the last reading published
+}
+
+// historyTransfer collects the upload service notifications while a download is in progress.
+type historyTransfer struct {
+	txBufferHandle uint16
+	txStatusHandle uint16
+	packets        chan []byte
+	status         chan byte
+}
+
+// handleNotification passes upload service notifications to the transfer, returning false for
+// notifications that belong to someone else.
+func (t *historyTransfer) handleNotification(notification *gatt.Notification) bool {
+	switch notification.Handle {
+	case t.txBufferHandle:
+		// we are called from the gatt client, which mustn't block on a packet arriving after
+		// the transfer has given up
+		select {
+		case t.packets <- notification.Data:
+		default:
+			fplog.Infof("Dropped history packet, the transfer isn't reading")
+		}
+	case t.txStatusHandle:
+		if len(notification.Data) > 0 {
+			select {
+			case t.status <- notification.Data[0]:
+			default:
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// downloadHistory fetches the entries logged since the last download and backfills the channels
+// with any that are newer than what we have already published.
+func (fp *FlowerPower) downloadHistory() error {
+
+	if fp.currentHandles() == nil {
+		return fmt.Errorf("Handles have not been discovered")
+	}
+
+	nbEntries, err := fp.readUint(historyNbEntriesUuid, 2)
+	if err != nil {
+		return err
+	}
+
+	lastIdx, err := fp.readUint(historyLastEntryIdxUuid, 4)
+	if err != nil {
+		return err
+	}
+
+	session, err := fp.readHistorySession()
+	if err != nil {
+		return err
+	}
+
+	startIdx, ok := historyStartIndex(uint32(nbEntries), uint32(lastIdx), fp.lastHistoryIdx)
+	if ok && startIdx < session.StartIdx {
+		// the entries of earlier sessions can't be dated
+		fplog.Infof("Skipping history entries %d to %d from before flower power %s started", startIdx, session.StartIdx-1, fp.gattDevice.Address)
+		startIdx = session.StartIdx
+		ok = startIdx <= uint32(lastIdx)
+	}
+	if !ok {
+		fplog.Infof("No new history entries on flower power %s", fp.gattDevice.Address)
+		return nil
+	}
+
+	fplog.Infof("Downloading history entries %d to %d from flower power %s", startIdx, lastIdx, fp.gattDevice.Address)
+
+	data, err := fp.transferHistory(startIdx)
+	if err != nil {
+		return err
+	}
+
+	entries, err := decodeHistory(data, startIdx, uint32(lastIdx), session)
+	if err != nil {
+		return err
+	}
+
+	fp.backfill(entries)
+	fp.lastHistoryIdx = uint32(lastIdx)
+
+	state := &historyState{LastIndex: fp.lastHistoryIdx, LastPublished: fp.published()}
+	if err := fp.driver.saveHistory(fp.gattDevice.Address, state); err != nil {
+		fplog.Errorf("Failed to save history state: %s", err)
+	}
+
+	return nil
+}
+
+// readHistorySession reads the current session, dating it by the device's clock.
+func (fp *FlowerPower) readHistorySession() (*historySession, error) {
+
+	startIdx, err := fp.readUint(historySessionStartIdxUuid, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	period, err := fp.readUint(historySessionPeriodUuid, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	uptime, err := fp.readUint(clockCurrentTimeUuid, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	return &historySession{
+		StartIdx: uint32(startIdx),
+		Started:  time.Now().Add(-time.Duration(uptime) * time.Second),
+		Period:   time.Duration(period) * time.Second,
+	}, nil
+}
+
+// historyStartIndex works out the first entry to download, given the entries held by the device
+// and the last entry we downloaded (zero if we never have).
+func historyStartIndex(nbEntries, lastIdx, downloadedIdx uint32) (uint32, bool) {
+	if nbEntries == 0 || lastIdx <= downloadedIdx {
+		return 0, false
+	}
+
+	first := uint32(0)
+	if lastIdx+1 > nbEntries {
+		first = lastIdx + 1 - nbEntries
+	}
+
+	if downloadedIdx == 0 {
+		if lastIdx+1 > maxHistoryBackfill && lastIdx+1-maxHistoryBackfill > first {
+			first = lastIdx + 1 - maxHistoryBackfill
+		}
+		return first, true
+	}
+
+	if downloadedIdx+1 > first {
+		first = downloadedIdx + 1
+	}
+	return first, true
+}
+
+// transferHistory runs the upload service file transfer, starting at the given entry.
+func (fp *FlowerPower) transferHistory(startIdx uint32) ([]byte, error) {
+
+	txBuffer, err := fp.characteristic(uploadTxBufferUuid)
+	if err != nil {
+		return nil, err
+	}
+	txStatus, err := fp.characteristic(uploadTxStatusUuid)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer := &historyTransfer{
+		txBufferHandle: txBuffer.ValueHandle,
+		txStatusHandle: txStatus.ValueHandle,
+		packets:        make(chan []byte, historyAckWindow),
+		status:         make(chan byte, 1),
+	}
+
+	fp.lkHistory.Lock()
+	fp.history = transfer
+	fp.lkHistory.Unlock()
+
+	defer func() {
+		fp.lkHistory.Lock()
+		fp.history = nil
+		fp.lkHistory.Unlock()
+
+		fp.subscribe(txBuffer, false)
+		fp.subscribe(txStatus, false)
+		fp.writeUint(uploadRxStatusUuid, rxStatusStandby, 1)
+	}()
+
+	start := make([]byte, 4)
+	binary.LittleEndian.PutUint32(start, startIdx)
+	if err := fp.writeValue(historyTransferStartIdxUuid, start); err != nil {
+		return nil, err
+	}
+
+	if err := fp.subscribe(txBuffer, true); err != nil {
+		return nil, err
+	}
+	if err := fp.subscribe(txStatus, true); err != nil {
+		return nil, err
+	}
+
+	if err := fp.writeUint(uploadRxStatusUuid, rxStatusReceiving, 1); err != nil {
+		return nil, err
+	}
+
+	file := &historyFile{}
+
+	for !file.complete() {
+		select {
+		case packet := <-transfer.packets:
+			if err := file.add(packet); err != nil {
+				return nil, err
+			}
+			if file.received%historyAckWindow == 0 {
+				fp.writeUint(uploadRxStatusUuid, rxStatusAck, 1)
+			}
+		case status := <-transfer.status:
+			if status == txStatusIdle && !file.complete() {
+				return nil, fmt.Errorf("History transfer stopped after %d of %d bytes", len(file.data), file.length)
+			}
+		case <-time.After(historyPacketTimeout):
+			return nil, fmt.Errorf("Timed out waiting for history packet %d", file.received)
+		}
+	}
+
+	fp.writeUint(uploadRxStatusUuid, rxStatusAck, 1)
+
+	return file.data, nil
+}
+
+// historyFile reassembles the upload packets. Each packet starts with its little endian
+// uint16 index, the payload of the first packet is the uint32 length of the file.
+type historyFile struct {
+	received int
+	length   int
+	data     []byte
+}
+
+func (f *historyFile) add(packet []byte) error {
+	if len(packet) < 2 {
+		return fmt.Errorf("Short history packet % X", packet)
+	}
+
+	index := int(binary.LittleEndian.Uint16(packet))
+	if index != f.received {
+		return fmt.Errorf("Expected history packet %d, got %d", f.received, index)
+	}
+	f.received++
+
+	payload := packet[2:]
+
+	if index == 0 {
+		if len(payload) < 4 {
+			return fmt.Errorf("Short history header % X", packet)
+		}
+		f.length = int(binary.LittleEndian.Uint32(payload))
+		f.data = make([]byte, 0, f.length)
+		return nil
+	}
+
+	if remaining := f.length - len(f.data); len(payload) > remaining {
+		payload = payload[:remaining]
+	}
+	f.data = append(f.data, payload...)
+
+	return nil
+}
+
+func (f *historyFile) complete() bool {
+	return f.received > 0 && len(f.data) == f.length
+}
+
+// decodeHistory splits the file into entries, dating them by the session they were logged in,
+// which must include startIdx.
+//
+// Parrot don't publish the format of the file. Each 6 byte record is taken to hold the raw
+// sunlight, air temperature and soil moisture readings, in that order, each a little endian
+// uint16 as the live characteristics (39e1fa01, 39e1fa04 and 39e1fa05) give them, so the same
+// calibration applies. This hasn't been checked against a captured upload.
+func decodeHistory(data []byte, startIdx, lastIdx uint32, session *historySession) ([]*historyEntry, error) {
+	if len(data)%historyRecordSize != 0 {
+		return nil, fmt.Errorf("History length %d is not a multiple of %d", len(data), historyRecordSize)
+	}
+
+	entries := []*historyEntry{}
+
+	for offset := 0; offset < len(data); offset += historyRecordSize {
+		index := startIdx + uint32(offset/historyRecordSize)
+		if index > lastIdx {
+			break
+		}
+
+		record := data[offset : offset+historyRecordSize]
+
+		entries = append(entries, &historyEntry{
+			Index:       index,
+			Time:        session.entryTime(index),
+			Sunlight:    record[0:2],
+			Temperature: record[2:4],
+			Moisture:    record[4:6],
+		})
+	}
+
+	return entries, nil
+}
+
+// backfill publishes the entries newer than the last reading we published.
+func (fp *FlowerPower) backfill(entries []*historyEntry) {
+	calibration := fp.driver.calibration
+
+	sent := 0
+
+	for _, entry := range entries {
+		if !entry.Time.After(fp.published()) {
+			continue
+		}
+
+		timestamp := entry.Time.UnixNano() / int64(time.Millisecond)
+
+		if sunlight, err := calibration.parseSunlight(entry.Sunlight); err == nil {
+			fp.illuminanceChannel.SendEvent("history", &historicalState{timestamp, sunlight})
+		}
+		if temperature, err := calibration.parseTemperature(entry.Temperature); err == nil {
+			fp.temperatureChannel.SendEvent("history", &historicalState{timestamp, temperature})
+		}
+		if moisture, err := calibration.parseMoisture(entry.Moisture); err == nil {
+			fp.moistureChannel.SendEvent("history", &historicalState{timestamp, moisture})
+		}
+
+		fp.setPublished(entry.Time)
+		sent++
+	}
+
+	fplog.Infof("Backfilled %d of %d history entries from flower power %s", sent, len(entries), fp.gattDevice.Address)
+}
+
+// published returns the time of the last reading published, live or from the history.
+func (fp *FlowerPower) published() time.Time {
+	fp.lkHistory.Lock()
+	defer fp.lkHistory.Unlock()
+	return fp.lastPublished
+}
+
+func (fp *FlowerPower) setPublished(at time.Time) {
+	fp.lkHistory.Lock()
+	defer fp.lkHistory.Unlock()
+	fp.lastPublished = at
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/gatt"
+)
+
+func TestHistoryStartIndex(t *testing.T) {
+	tests := []struct {
+		nbEntries, lastIdx, downloadedIdx uint32
+		start                             uint32
+		ok                                bool
+	}{
+		{0, 0, 0, 0, false},
+		{10, 9, 0, 0, true},
+		{500, 999, 0, 999 + 1 - maxHistoryBackfill, true},
+		{500, 999, 990, 991, true},
+		{500, 999, 100, 500, true},
+		{500, 999, 999, 0, false},
+	}
+
+	for _, test := range tests {
+		start, ok := historyStartIndex(test.nbEntries, test.lastIdx, test.downloadedIdx)
+		if ok != test.ok || (ok && start != test.start) {
+			t.Errorf("historyStartIndex(%d, %d, %d) expected %d %t, got %d %t",
+				test.nbEntries, test.lastIdx, test.downloadedIdx, test.start, test.ok, start, ok)
+		}
+	}
+}
+
+func TestHistoryFileReassembly(t *testing.T) {
+	file := &historyFile{}
+
+	packets := [][]byte{
+		{0x00, 0x00, 0x0c, 0x00, 0x00, 0x00},
+		{0x01, 0x00, 1, 2, 3, 4, 5, 6, 7, 8},
+		{0x02, 0x00, 9, 10, 11, 12, 0, 0},
+	}
+
+	for _, packet := range packets {
+		if file.complete() {
+			t.Fatalf("file complete too early")
+		}
+		if err := file.add(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !file.complete() {
+		t.Fatalf("file not complete")
+	}
+
+	if !bytes.Equal(file.data, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}) {
+		t.Errorf("bad file data % X", file.data)
+	}
+}
+
+func TestHistoryFileOutOfOrder(t *testing.T) {
+	file := &historyFile{}
+
+	if err := file.add([]byte{0x01, 0x00, 1, 2}); err == nil {
+		t.Errorf("expected an error for a missing header packet")
+	}
+}
+
+func TestDecodeHistory(t *testing.T) {
+	started := time.Date(2014, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	// the device started logging its session at entry 40
+	session := &historySession{StartIdx: 40, Started: started, Period: 15 * time.Minute}
+
+	data := []byte{
+		0x96, 0x00, 0xd2, 0x00, 0xbc, 0x02,
+		0x97, 0x00, 0xd3, 0x00, 0xbb, 0x02,
+	}
+
+	entries, err := decodeHistory(data, 41, 42, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	if entries[0].Index != 41 || !entries[0].Time.Equal(started.Add(30*time.Minute)) {
+		t.Errorf("bad first entry %d %s", entries[0].Index, entries[0].Time)
+	}
+
+	if entries[1].Index != 42 || !entries[1].Time.Equal(started.Add(45*time.Minute)) {
+		t.Errorf("bad last entry %d %s", entries[1].Index, entries[1].Time)
+	}
+
+	if bytesToUint(entries[0].Moisture) != 700 {
+		t.Errorf("bad moisture % X", entries[0].Moisture)
+	}
+
+	if _, err := decodeHistory(data[:7], 41, 42, session); err == nil {
+		t.Errorf("expected an error for a partial record")
+	}
+}
+
+func TestHistoryNotificationDoesNotBlock(t *testing.T) {
+	transfer := &historyTransfer{
+		txBufferHandle: 0x0064,
+		packets:        make(chan []byte, 1),
+		status:         make(chan byte, 1),
+	}
+
+	done := make(chan bool)
+	go func() {
+		// the second packet arrives after the transfer has stopped reading
+		transfer.handleNotification(&gatt.Notification{Handle: 0x0064, Data: []byte{0x00, 0x00}})
+		transfer.handleNotification(&gatt.Notification{Handle: 0x0064, Data: []byte{0x01, 0x00}})
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the notification blocked the gatt client")
+	}
+}
+
+func TestHistoryStatePersisted(t *testing.T) {
+	saved := []string{}
+	driver := &FlowerPowerDriver{
+		Config: &FlowerPowerConfig{},
+		sendEvent: func(event string, payload interface{}) error {
+			saved = append(saved, event)
+			return nil
+		},
+	}
+
+	published := time.Date(2014, 10, 1, 12, 0, 0, 0, time.UTC)
+	if err := driver.saveHistory("a0:14:3d:08:b4:90", &historyState{LastIndex: 999, LastPublished: published}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(saved) != 1 || saved[0] != "config" {
+		t.Errorf("expected the config to be saved, got %v", saved)
+	}
+
+	// as the driver restarts
+	state := driver.deviceConfig("a0:14:3d:08:b4:90").History
+	if state == nil || state.LastIndex != 999 || !state.LastPublished.Equal(published) {
+		t.Fatalf("expected the history state to be restored, got %+v", state)
+	}
+
+	if _, ok := historyStartIndex(500, 999, state.LastIndex); ok {
+		t.Errorf("expected nothing to be downloaded again")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+)
+
+// FlowerPowerDeviceConfig is persisted by HomeCloud, and provided when the app starts.
+type FlowerPowerDeviceConfig struct {
+	Address          string             `json:"address"`
+	SampleInterval   int                `json:"sampleInterval"`   // minutes between samples
+	LiveModeDuration int                `json:"liveModeDuration"` // seconds live mode is enabled for each sample
+	QuietHours       *QuietHours        `json:"quietHours,omitempty"`
+	Profile          *PlantProfile      `json:"profile,omitempty"`
+	DailyLight       *dailyLight        `json:"dailyLight,omitempty"` // the running total for today
+	Info             *DeviceInformation `json:"info,omitempty"`
+	Handles          gattHandles        `json:"handles,omitempty"`  // discovered on first connect
+	History          *historyState      `json:"history,omitempty"`  // how far the device log has been published
+	Gatttool         *bluez.Options     `json:"gatttool,omitempty"` // overrides the driver's options for this device
+}
+
+// QuietHours is a daily window, in local time, during which the device isn't sampled.
+// The window may wrap past midnight, eg. 22:00 to 06:30.
+type QuietHours struct {
+	Start string `json:"start"` // HH:MM
+	End   string `json:"end"`   // HH:MM
+}
+
+func newFlowerPowerDeviceConfig(address string) *FlowerPowerDeviceConfig {
+	return &FlowerPowerDeviceConfig{
+		Address:          address,
+		SampleInterval:   int(sleepInterval / time.Minute),
+		LiveModeDuration: int(dataInterval / time.Second),
+	}
+}
+
+func (c *FlowerPowerDeviceConfig) validate() error {
+	if err := c.validateSchedule(); err != nil {
+		return err
+	}
+	if err := c.QuietHours.validate(); err != nil {
+		return err
+	}
+	if c.Profile != nil {
+		if err := c.Profile.validate(); err != nil {
+			return err
+		}
+	}
+	return c.Gatttool.Validate()
+}
+
+func (c *FlowerPowerDeviceConfig) validateSchedule() error {
+	if c.SampleInterval < 1 {
+		return fmt.Errorf("Sample interval must be at least a minute")
+	}
+	if c.LiveModeDuration < 1 || time.Duration(c.LiveModeDuration)*time.Second >= c.sampleInterval() {
+		return fmt.Errorf("Live mode duration must be at least a second, and less than the sample interval")
+	}
+	return nil
+}
+
+// repair puts the defaults back in place of any settings which aren't valid, eg. in a config
+// from HomeCloud which never went through Configure, returning what it replaced.
+func (c *FlowerPowerDeviceConfig) repair() []error {
+	problems := []error{}
+
+	if err := c.validateSchedule(); err != nil {
+		defaults := newFlowerPowerDeviceConfig(c.Address)
+		c.SampleInterval, c.LiveModeDuration = defaults.SampleInterval, defaults.LiveModeDuration
+		problems = append(problems, err)
+	}
+
+	if err := c.QuietHours.validate(); err != nil {
+		c.QuietHours = nil
+		problems = append(problems, err)
+	}
+
+	if c.Profile != nil {
+		if err := c.Profile.validate(); err != nil {
+			c.Profile = nil
+			problems = append(problems, err)
+		}
+	}
+
+	if err := c.Gatttool.Validate(); err != nil {
+		c.Gatttool = nil
+		problems = append(problems, err)
+	}
+
+	return problems
+}
+
+func (c *FlowerPowerDeviceConfig) sampleInterval() time.Duration {
+	return time.Duration(c.SampleInterval) * time.Minute
+}
+
+func (c *FlowerPowerDeviceConfig) liveModeDuration() time.Duration {
+	return time.Duration(c.LiveModeDuration) * time.Second
+}
+
+func (q *QuietHours) validate() error {
+	if q == nil {
+		return nil
+	}
+	if _, err := parseClock(q.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(q.End); err != nil {
+		return err
+	}
+	return nil
+}
+
+// remaining returns how much longer the quiet hours last, or zero if now is outside them.
+func (q *QuietHours) remaining(now time.Time) time.Duration {
+	if q == nil {
+		return 0
+	}
+
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return 0
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		return 0
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	sinceMidnight := now.Sub(midnight)
+
+	switch {
+	case start == end:
+		return 0
+	case start < end && sinceMidnight >= start && sinceMidnight < end:
+		return end - sinceMidnight
+	case start > end && sinceMidnight >= start:
+		return 24*time.Hour - sinceMidnight + end
+	case start > end && sinceMidnight < end:
+		return end - sinceMidnight
+	}
+
+	return 0
+}
+
+// parseClock parses a HH:MM time of day into the duration since midnight.
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %q, expected HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// deviceConfig returns a copy of the configuration for a device, or the defaults if it has none.
+func (d *FlowerPowerDriver) deviceConfig(address string) *FlowerPowerDeviceConfig {
+	d.lkConfig.Lock()
+	defer d.lkConfig.Unlock()
+
+	for _, deviceConfig := range d.Config.FlowerPowers {
+		if deviceConfig.Address == address {
+			copied := *deviceConfig
+			return &copied
+		}
+	}
+
+	return newFlowerPowerDeviceConfig(address)
+}
+
+// saveDeviceConfig persists the schedule and plant profile edited for a device, and applies them
+// to the running device. The rest of the device's config is kept as it is now, as the device
+// may have updated it since the config being saved was read.
+func (d *FlowerPowerDriver) saveDeviceConfig(deviceConfig *FlowerPowerDeviceConfig) error {
+	if err := deviceConfig.validate(); err != nil {
+		return err
+	}
+
+	err := d.updateDeviceConfig(deviceConfig.Address, func(existing *FlowerPowerDeviceConfig) {
+		existing.SampleInterval = deviceConfig.SampleInterval
+		existing.LiveModeDuration = deviceConfig.LiveModeDuration
+		existing.QuietHours = deviceConfig.QuietHours
+		existing.Profile = deviceConfig.Profile
+	})
+
+	if err != nil {
+		return fmt.Errorf("Error saving configuration: %s", err)
+	}
+
+	d.lkConfig.Lock()
+	fp := d.flowerPowers[deviceConfig.Address]
+	d.lkConfig.Unlock()
+
+	if fp != nil {
+		fp.reschedule()
+	}
+
+	return nil
+}
+
+// saveDailyLight persists the running daily light total for a device.
+func (d *FlowerPowerDriver) saveDailyLight(address string, light *dailyLight) error {
+	return d.updateDeviceConfig(address, func(deviceConfig *FlowerPowerDeviceConfig) {
+		deviceConfig.DailyLight = light
+	})
+}
+
+// saveHistory persists how far a device's log has been published.
+func (d *FlowerPowerDriver) saveHistory(address string, state *historyState) error {
+	return d.updateDeviceConfig(address, func(deviceConfig *FlowerPowerDeviceConfig) {
+		deviceConfig.History = state
+	})
+}
+
+// saveDeviceInformation caches the information read from a device.
+func (d *FlowerPowerDriver) saveDeviceInformation(address string, info *DeviceInformation) error {
+	return d.updateDeviceConfig(address, func(deviceConfig *FlowerPowerDeviceConfig) {
+		deviceConfig.Info = info
+	})
+}
+
+// saveHandles caches the handles discovered on a device, so they needn't be discovered again.
+func (d *FlowerPowerDriver) saveHandles(address string, handles gattHandles) error {
+	return d.updateDeviceConfig(address, func(deviceConfig *FlowerPowerDeviceConfig) {
+		deviceConfig.Handles = handles
+	})
+}
+
+// updateDeviceConfig persists a change to a device's configuration which the sample loop
+// doesn't need to know about.
+func (d *FlowerPowerDriver) updateDeviceConfig(address string, update func(deviceConfig *FlowerPowerDeviceConfig)) error {
+	return d.saveConfig(func() {
+		// the device configs are replaced rather than changed, as a config being sent may share them
+		for i, existing := range d.Config.FlowerPowers {
+			if existing.Address == address {
+				updated := *existing
+				update(&updated)
+				d.Config.FlowerPowers[i] = &updated
+				return
+			}
+		}
+
+		deviceConfig := newFlowerPowerDeviceConfig(address)
+		update(deviceConfig)
+		d.Config.FlowerPowers = append(d.Config.FlowerPowers, deviceConfig)
+	})
+}
+
+// saveConfig applies the change to the config with lkConfig held, then sends a copy of the
+// config once the lock is released. lkSave keeps the copies going out in the order they were made.
+func (d *FlowerPowerDriver) saveConfig(change func()) error {
+	d.lkSave.Lock()
+	defer d.lkSave.Unlock()
+
+	d.lkConfig.Lock()
+	change()
+	config := *d.Config
+	config.FlowerPowers = append([]*FlowerPowerDeviceConfig{}, d.Config.FlowerPowers...)
+	d.lkConfig.Unlock()
+
+	fplog.Infof("saving configuration %#v", &config)
+	return d.sendEvent("config", &config)
+}
+
+// sleep waits for the duration, or until the device's schedule changes.
+func (fp *FlowerPower) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-fp.wake:
+	}
+}
+
+// reschedule wakes the sample loop so a new schedule takes effect immediately.
+func (fp *FlowerPower) reschedule() {
+	select {
+	case fp.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+)
+
+func TestQuietHoursRemaining(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2014, 10, 1, hour, min, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		quiet     *QuietHours
+		now       time.Time
+		remaining time.Duration
+	}{
+		{nil, at(12, 0), 0},
+		{&QuietHours{"09:00", "17:00"}, at(8, 59), 0},
+		{&QuietHours{"09:00", "17:00"}, at(9, 0), 8 * time.Hour},
+		{&QuietHours{"09:00", "17:00"}, at(16, 30), 30 * time.Minute},
+		{&QuietHours{"09:00", "17:00"}, at(17, 0), 0},
+		{&QuietHours{"22:00", "06:30"}, at(23, 0), 7*time.Hour + 30*time.Minute},
+		{&QuietHours{"22:00", "06:30"}, at(6, 0), 30 * time.Minute},
+		{&QuietHours{"22:00", "06:30"}, at(12, 0), 0},
+		{&QuietHours{"22:00", "22:00"}, at(22, 0), 0},
+	}
+
+	for _, test := range tests {
+		if remaining := test.quiet.remaining(test.now); remaining != test.remaining {
+			t.Errorf("%#v at %s: expected %s, got %s", test.quiet, test.now.Format("15:04"), test.remaining, remaining)
+		}
+	}
+}
+
+func TestFlowerPowerDeviceConfigValidate(t *testing.T) {
+	deviceConfig := newFlowerPowerDeviceConfig("a0:14:3d:08:b4:90")
+
+	if err := deviceConfig.validate(); err != nil {
+		t.Errorf("default configuration is invalid: %s", err)
+	}
+
+	deviceConfig.LiveModeDuration = 60 * 60
+	if err := deviceConfig.validate(); err == nil {
+		t.Errorf("expected an error for a live mode duration longer than the sample interval")
+	}
+
+	deviceConfig = newFlowerPowerDeviceConfig("a0:14:3d:08:b4:90")
+	deviceConfig.QuietHours = &QuietHours{"22:00", "6am"}
+	if err := deviceConfig.validate(); err == nil {
+		t.Errorf("expected an error for an invalid quiet hours time")
+	}
+}
+
+func TestFlowerPowerStartRepairsConfig(t *testing.T) {
+	driver := &FlowerPowerDriver{Config: &FlowerPowerConfig{}}
+
+	err := driver.Start(&FlowerPowerConfig{
+		FlowerPowers: []*FlowerPowerDeviceConfig{
+			{Address: "a0:14:3d:08:b4:90", SampleInterval: 0, LiveModeDuration: 5, QuietHours: &QuietHours{"22:00", "6am"}},
+			{Address: "a0:14:3d:08:b4:91", SampleInterval: 60, LiveModeDuration: 10, Profile: &PlantProfile{MinMoisture: limit(20)}, Gatttool: &bluez.Options{SecurityLevel: bluez.SecurityHigh}},
+			{Address: "a0:14:3d:08:b4:92", SampleInterval: 60, LiveModeDuration: 10, Gatttool: &bluez.Options{SecurityLevel: "top"}},
+			nil,
+		},
+		Gatttool: &bluez.Options{Adapter: "hci1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(driver.Config.FlowerPowers) != 3 {
+		t.Fatalf("expected the config without an address to be dropped, got %d", len(driver.Config.FlowerPowers))
+	}
+
+	repaired := driver.deviceConfig("a0:14:3d:08:b4:90")
+	defaults := newFlowerPowerDeviceConfig("a0:14:3d:08:b4:90")
+	if repaired.SampleInterval != defaults.SampleInterval || repaired.LiveModeDuration != defaults.LiveModeDuration || repaired.QuietHours != nil {
+		t.Errorf("expected the defaults in place of the invalid settings, got %+v", repaired)
+	}
+
+	valid := driver.deviceConfig("a0:14:3d:08:b4:91")
+	if valid.SampleInterval != 60 || valid.LiveModeDuration != 10 || valid.Profile == nil {
+		t.Errorf("expected a valid config to be kept, got %+v", valid)
+	}
+
+	// the device's security level over the driver's adapter
+	if options := driver.gattOptions("a0:14:3d:08:b4:91"); *options != (bluez.Options{SecurityLevel: bluez.SecurityHigh, Adapter: "hci1"}) {
+		t.Errorf("bad device options %+v", options)
+	}
+	if options := driver.gattOptions("a0:14:3d:08:b4:92"); *options != (bluez.Options{Adapter: "hci1"}) {
+		t.Errorf("expected the invalid device options to be ignored, got %+v", options)
+	}
+}
+
+func TestFlowerPowerSaveConfigUnlocked(t *testing.T) {
+	driver := &FlowerPowerDriver{
+		Config:       &FlowerPowerConfig{},
+		flowerPowers: make(map[string]*FlowerPower),
+	}
+
+	saved := []*FlowerPowerConfig{}
+	driver.sendEvent = func(event string, payload interface{}) error {
+		// this would deadlock if the config was still locked
+		driver.deviceConfig("a0:14:3d:08:b4:90")
+		saved = append(saved, payload.(*FlowerPowerConfig))
+		return nil
+	}
+
+	deviceConfig := newFlowerPowerDeviceConfig("a0:14:3d:08:b4:90")
+	deviceConfig.SampleInterval = 15
+	if err := driver.saveDeviceConfig(deviceConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := driver.saveHandles("a0:14:3d:08:b4:90", gattHandles{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(saved) != 2 {
+		t.Fatalf("expected 2 saves, got %d", len(saved))
+	}
+
+	// the first copy sent isn't changed by the second save
+	if saved[0].FlowerPowers[0].Handles != nil || saved[1].FlowerPowers[0].Handles == nil {
+		t.Errorf("expected each save to send its own copy of the config")
+	}
+}
+
+func TestFlowerPowerSaveConfigKeepsDeviceState(t *testing.T) {
+	driver := &FlowerPowerDriver{
+		Config:       &FlowerPowerConfig{},
+		flowerPowers: make(map[string]*FlowerPower),
+		sendEvent: func(event string, payload interface{}) error {
+			return nil
+		},
+	}
+
+	// the edit screen reads the config, then the device saves its state before the edit is saved
+	deviceConfig := driver.deviceConfig("a0:14:3d:08:b4:90")
+
+	if err := driver.saveHistory("a0:14:3d:08:b4:90", &historyState{LastIndex: 42}); err != nil {
+		t.Fatal(err)
+	}
+
+	deviceConfig.SampleInterval = 15
+	if err := driver.saveDeviceConfig(deviceConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := driver.deviceConfig("a0:14:3d:08:b4:90")
+	if saved.SampleInterval != 15 {
+		t.Errorf("expected the schedule to be saved, got %d", saved.SampleInterval)
+	}
+	if saved.History == nil || saved.History.LastIndex != 42 {
+		t.Errorf("expected the history index to be kept, got %+v", saved.History)
+	}
+	if len(driver.Config.FlowerPowers) != 1 {
+		t.Errorf("expected a single device config, got %d", len(driver.Config.FlowerPowers))
+	}
+}
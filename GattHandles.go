@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+)
+
+// gattCharacteristic is a discovered characteristic, addressed by handle over the gatt client.
+type gattCharacteristic struct {
+	UUID        string `json:"uuid"`
+	Handle      uint16 `json:"handle"` // the characteristic declaration
+	ValueHandle uint16 `json:"valueHandle"`
+	EndHandle   uint16 `json:"endHandle"` // the last handle of the characteristic, including its descriptors
+
+	Properties bluez.Properties `json:"properties,omitempty"`
+}
+
+// gattHandles maps normalised characteristic uuids to their handles.
+type gattHandles map[string]*gattCharacteristic
+
+// newGattHandles builds the handle map from the characteristics discovered by gatttool.
+func newGattHandles(chars []*bluez.Characteristic) gattHandles {
+
+	discovered := []*gattCharacteristic{}
+
+	for _, char := range chars {
+		discovered = append(discovered, &gattCharacteristic{
+			UUID:        normaliseUuid(char.UUID),
+			Handle:      char.Handle,
+			ValueHandle: char.CharValueHandle,
+			Properties:  char.Properties,
+		})
+	}
+
+	sort.Sort(byHandle(discovered))
+
+	handles := make(gattHandles)
+
+	for i, char := range discovered {
+		char.EndHandle = 0xffff
+		if i+1 < len(discovered) {
+			char.EndHandle = discovered[i+1].Handle - 1
+		}
+		handles[char.UUID] = char
+	}
+
+	return handles
+}
+
+// missingCharacteristicError is returned for a characteristic which wasn't discovered.
+type missingCharacteristicError string
+
+func (e missingCharacteristicError) Error() string {
+	return fmt.Sprintf("Characteristic %s not found", string(e))
+}
+
+// isStaleHandle returns true if the error shows the device's handles have changed since they
+// were discovered.
+func isStaleHandle(err error) bool {
+	_, missing := err.(missingCharacteristicError)
+	return missing || bluez.IsInvalidHandle(err)
+}
+
+// get returns the characteristic with the given uuid, which may be in either the dashed or plain form.
+func (h gattHandles) get(uuid string) (*gattCharacteristic, error) {
+	char, ok := h[normaliseUuid(uuid)]
+	if !ok {
+		return nil, missingCharacteristicError(uuid)
+	}
+	return char, nil
+}
+
+// byValueHandle returns the characteristic whose value has the given handle, eg. for a notification.
+func (h gattHandles) byValueHandle(handle uint16) (*gattCharacteristic, bool) {
+	for _, char := range h {
+		if char.ValueHandle == handle {
+			return char, true
+		}
+	}
+	return nil, false
+}
+
+// require checks every one of the uuids was discovered.
+func (h gattHandles) require(uuids ...string) error {
+	for _, uuid := range uuids {
+		if _, err := h.get(uuid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// characteristic converts back to the form the transports write to.
+func (c *gattCharacteristic) characteristic() *bluez.Characteristic {
+	return &bluez.Characteristic{
+		UUID:            c.UUID,
+		Handle:          c.Handle,
+		CharValueHandle: c.ValueHandle,
+		Properties:      c.Properties,
+	}
+}
+
+type byHandle []*gattCharacteristic
+
+func (b byHandle) Len() int           { return len(b) }
+func (b byHandle) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byHandle) Less(i, j int) bool { return b[i].Handle < b[j].Handle }
+
+func normaliseUuid(uuid string) string {
+	return strings.ToLower(strings.Replace(uuid, "-", "", -1))
+}
+
+// addrType returns the gatttool address type for a device.
+func addrType(publicAddress bool) string {
+	if publicAddress {
+		return bluez.AddrTypePublic
+	}
+	return bluez.AddrTypeRandom
+}
+
+// attWriteRequest encodes an ATT write request, for sending with gatt.Client.SendRawCommands.
+func attWriteRequest(handle uint16, value []byte) string {
+	return fmt.Sprintf("12%02x%02x%x", byte(handle), byte(handle>>8), value)
+}
+
+// attWriteCommand encodes an ATT write command, which the device doesn't respond to, for sending
+// with gatt.Client.SendRawCommands.
+func attWriteCommand(handle uint16, value []byte) string {
+	return fmt.Sprintf("52%02x%02x%x", byte(handle), byte(handle>>8), value)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+)
+
+func TestNewGattHandles(t *testing.T) {
+	handles := newGattHandles([]*bluez.Characteristic{
+		{Handle: 0x0030, CharValueHandle: 0x0031, UUID: "39e1fa04-84a8-11e2-afba-0002a5d5c51b"},
+		{Handle: 0x0024, CharValueHandle: 0x0025, UUID: "39e1fa01-84a8-11e2-afba-0002a5d5c51b"},
+		{Handle: 0x0034, CharValueHandle: 0x0035, UUID: "39E1FA05-84A8-11E2-AFBA-0002A5D5C51B"},
+	})
+
+	sunlight, err := handles.get(sunlightUuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sunlight.Handle != 0x24 || sunlight.ValueHandle != 0x25 || sunlight.EndHandle != 0x2f {
+		t.Errorf("bad sunlight handles %#v", sunlight)
+	}
+
+	moisture, err := handles.get(moistureUuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moisture.EndHandle != 0xffff {
+		t.Errorf("expected the last characteristic to end at 0xffff, got %#v", moisture)
+	}
+
+	if char, ok := handles.byValueHandle(0x31); !ok || char.UUID != temperatureUuid {
+		t.Errorf("expected value handle 0x31 to be the temperature, got %#v", char)
+	}
+
+	if _, ok := handles.byValueHandle(0x30); ok {
+		t.Errorf("expected a declaration handle not to match a value")
+	}
+
+	if err := handles.require(sunlightUuid, liveModeUuid); !isStaleHandle(err) {
+		t.Errorf("expected live mode to be missing, got %v", err)
+	}
+}
+
+func TestAttWrites(t *testing.T) {
+	if request := attWriteRequest(0x0039, []byte{0x01}); request != "12390001" {
+		t.Errorf("bad write request %s", request)
+	}
+	if command := attWriteCommand(0x0125, []byte{0x01, 0x03}); command != "5225010103" {
+		t.Errorf("bad write command %s", command)
+	}
+}
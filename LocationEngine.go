@@ -0,0 +1,245 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+)
+
+const (
+	locationWindow     = time.Second * 10 // samples older than this are forgotten
+	locationMaxSamples = 20               // per device and waypoint
+	locationMinSamples = 3                // before a waypoint is considered
+	locationHysteresis = 5.0              // dB a zone must beat the current one by to take the device
+)
+
+const (
+	zoneEntered = "entered"
+	zoneLeft    = "left"
+)
+
+// ZoneEvent is published when a device moves between zones.
+type ZoneEvent struct {
+	Device      string  `json:"device"`
+	AddressType string  `json:"addressType,omitempty"` // random, or empty for a public address
+	Zone        string  `json:"zone"`
+	Event       string  `json:"event"` // entered or left
+	Rssi        float64 `json:"rssi"`  // the zone's average, zero when leaving because the device is gone
+	Timestamp   int64   `json:"timestamp"`
+}
+
+// locationDevice tells apart a random address from the same public one.
+type locationDevice struct {
+	address     string
+	addressType string // random, or empty for public and unknown
+}
+
+func newLocationDevice(device, addressType string) locationDevice {
+	if addressType != bluez.AddrTypeRandom {
+		addressType = ""
+	}
+	return locationDevice{address: normaliseAddress(device), addressType: addressType}
+}
+
+type rssiSample struct {
+	time time.Time
+	rssi int8
+}
+
+// LocationEngine places each device in the zone of the waypoint that hears it loudest. Each
+// waypoint is its own zone, unless it has been given the name of a room, which any number of
+// waypoints may share.
+type LocationEngine struct {
+	sync.Mutex
+	samples map[locationDevice]map[string][]rssiSample // by device, then waypoint
+	zones   map[locationDevice]string                  // the device's current zone
+	rooms   map[string]string                          // waypoint to room
+}
+
+func NewLocationEngine() *LocationEngine {
+	return &LocationEngine{
+		samples: make(map[locationDevice]map[string][]rssiSample),
+		zones:   make(map[locationDevice]string),
+		rooms:   make(map[string]string),
+	}
+}
+
+// SetRooms names the room each waypoint is in.
+func (e *LocationEngine) SetRooms(rooms map[string]string) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.rooms = make(map[string]string)
+	for waypoint, room := range rooms {
+		e.rooms[normaliseAddress(waypoint)] = room
+	}
+}
+
+// Zone returns the zone the device is in, empty if it isn't in one.
+func (e *LocationEngine) Zone(device, addressType string) string {
+	e.Lock()
+	defer e.Unlock()
+	return e.zones[newLocationDevice(device, addressType)]
+}
+
+// Add records a sample from a waypoint, returning any zone changes it causes.
+func (e *LocationEngine) Add(address, addressType, waypoint string, rssi int8, now time.Time) []*ZoneEvent {
+	e.Lock()
+	defer e.Unlock()
+
+	device, waypoint := newLocationDevice(address, addressType), normaliseAddress(waypoint)
+
+	waypoints, ok := e.samples[device]
+	if !ok {
+		waypoints = make(map[string][]rssiSample)
+		e.samples[device] = waypoints
+	}
+
+	samples := append(waypoints[waypoint], rssiSample{time: now, rssi: rssi})
+	if len(samples) > locationMaxSamples {
+		samples = samples[len(samples)-locationMaxSamples:]
+	}
+	waypoints[waypoint] = samples
+
+	return e.update(device, now)
+}
+
+// Expire forgets old samples, returning the zone changes for the devices no longer heard.
+func (e *LocationEngine) Expire(now time.Time) []*ZoneEvent {
+	e.Lock()
+	defer e.Unlock()
+
+	devices := []locationDevice{}
+	for device := range e.samples {
+		devices = append(devices, device)
+	}
+	sort.Sort(byLocationDevice(devices))
+
+	events := []*ZoneEvent{}
+	for _, device := range devices {
+		events = append(events, e.update(device, now)...)
+	}
+	return events
+}
+
+// update moves the device to the zone with the strongest average, if it beats the current zone
+// by the hysteresis. It must be called with the lock held.
+func (e *LocationEngine) update(device locationDevice, now time.Time) []*ZoneEvent {
+
+	averages, settling := e.zoneAverages(device, now)
+
+	current := e.zones[device]
+	best, bestRssi := "", 0.0
+
+	for zone, rssi := range averages {
+		if best == "" || rssi > bestRssi || (rssi == bestRssi && zone < best) {
+			best, bestRssi = zone, rssi
+		}
+	}
+
+	if best == current {
+		return nil
+	}
+
+	// a device isn't placed while a louder waypoint has only just started hearing it, or the
+	// first waypoint to hear it a few times wins, however faintly
+	if current == "" {
+		for _, rssi := range settling {
+			if rssi > bestRssi {
+				return nil
+			}
+		}
+	}
+
+	currentRssi, heard := averages[current]
+
+	if current != "" && heard && bestRssi < currentRssi+locationHysteresis {
+		return nil
+	}
+
+	events := []*ZoneEvent{}
+
+	if current != "" {
+		events = append(events, &ZoneEvent{Device: device.address, AddressType: device.addressType, Zone: current, Event: zoneLeft, Rssi: currentRssi, Timestamp: timestamp(now)})
+		delete(e.zones, device)
+	}
+
+	if best != "" {
+		events = append(events, &ZoneEvent{Device: device.address, AddressType: device.addressType, Zone: best, Event: zoneEntered, Rssi: bestRssi, Timestamp: timestamp(now)})
+		e.zones[device] = best
+	}
+
+	return events
+}
+
+// zoneAverages drops the device's expired samples, then averages what is left by zone, taking
+// the loudest waypoint in each room. Zones whose waypoints haven't heard the device
+// locationMinSamples times yet are averaged separately, as settling. It must be called with the
+// lock held.
+func (e *LocationEngine) zoneAverages(device locationDevice, now time.Time) (averages, settling map[string]float64) {
+
+	averages, settling = make(map[string]float64), make(map[string]float64)
+
+	for waypoint, samples := range e.samples[device] {
+		for len(samples) > 0 && now.Sub(samples[0].time) > locationWindow {
+			samples = samples[1:]
+		}
+
+		if len(samples) == 0 {
+			delete(e.samples[device], waypoint)
+			continue
+		}
+		e.samples[device][waypoint] = samples
+
+		total := 0.0
+		for _, sample := range samples {
+			total += float64(sample.rssi)
+		}
+		average := total / float64(len(samples))
+
+		zone := waypoint
+		if room, ok := e.rooms[waypoint]; ok {
+			zone = room
+		}
+
+		zones := averages
+		if len(samples) < locationMinSamples {
+			zones = settling
+		}
+
+		if existing, ok := zones[zone]; !ok || average > existing {
+			zones[zone] = average
+		}
+	}
+
+	if len(e.samples[device]) == 0 {
+		delete(e.samples, device)
+	}
+
+	return averages, settling
+}
+
+type byLocationDevice []locationDevice
+
+func (b byLocationDevice) Len() int      { return len(b) }
+func (b byLocationDevice) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byLocationDevice) Less(i, j int) bool {
+	if b[i].address != b[j].address {
+		return b[i].address < b[j].address
+	}
+	return b[i].addressType < b[j].addressType
+}
+
+// normaliseAddress makes the different forms of a device address, eg. f6:5f:20:4c:b0:db and
+// F65F204CB0DB, the same.
+func normaliseAddress(address string) string {
+	return strings.ToUpper(strings.Replace(address, ":", "", -1))
+}
+
+// timestamp is ms since the epoch.
+func timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
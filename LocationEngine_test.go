@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+)
+
+// The location traces in testdata are recorded RSSI samples, followed by the zone events they
+// should cause. See location_walk.txt for the format.
+
+var traceStart = time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func traceTime(t *testing.T, seconds string) time.Time {
+	s, err := strconv.ParseFloat(seconds, 64)
+	if err != nil {
+		t.Fatalf("bad time %q: %s", seconds, err)
+	}
+	return traceStart.Add(time.Duration(s * float64(time.Second)))
+}
+
+func formatZoneEvent(event *ZoneEvent) string {
+	offset := time.Duration(event.Timestamp-timestamp(traceStart)) * time.Millisecond
+	return fmt.Sprintf("%.1f %s %s %s", offset.Seconds(), event.Device, event.Event, event.Zone)
+}
+
+// replayTrace runs the trace through a new engine, returning the events it caused and the
+// events the trace expects.
+func replayTrace(t *testing.T, filename string) ([]string, []string) {
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine := NewLocationEngine()
+	rooms := map[string]string{}
+
+	events, expected := []string{}, []string{}
+
+	for n, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+
+		switch {
+		case len(fields) == 0, strings.HasPrefix(line, "#"):
+
+		case fields[0] == "room" && len(fields) == 3:
+			rooms[fields[1]] = fields[2]
+			engine.SetRooms(rooms)
+
+		case fields[0] == "expire" && len(fields) == 2:
+			for _, event := range engine.Expire(traceTime(t, fields[1])) {
+				events = append(events, formatZoneEvent(event))
+			}
+
+		case fields[0] == "=":
+			expected = append(expected, strings.Join(fields[1:], " "))
+
+		case len(fields) == 4:
+			rssi, err := strconv.ParseInt(fields[3], 10, 8)
+			if err != nil {
+				t.Fatalf("%s:%d: bad rssi: %s", filename, n+1, err)
+			}
+			for _, event := range engine.Add(fields[1], "", fields[2], int8(rssi), traceTime(t, fields[0])) {
+				events = append(events, formatZoneEvent(event))
+			}
+
+		default:
+			t.Fatalf("%s:%d: can't parse %q", filename, n+1, line)
+		}
+	}
+
+	return events, expected
+}
+
+func TestLocationTraces(t *testing.T) {
+
+	traces, err := filepath.Glob(filepath.Join("testdata", "location_*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) == 0 {
+		t.Fatal("no location traces found")
+	}
+
+	for _, trace := range traces {
+		events, expected := replayTrace(t, trace)
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("%s: expected events\n%s\ngot\n%s", trace, strings.Join(expected, "\n"), strings.Join(events, "\n"))
+		}
+	}
+}
+
+func TestLocationEngineHysteresis(t *testing.T) {
+
+	engine := NewLocationEngine()
+
+	add := func(seconds int, waypoint string, rssi int8) []*ZoneEvent {
+		return engine.Add("f6:5f:20:4c:b0:db", "", waypoint, rssi, traceStart.Add(time.Duration(seconds)*time.Second))
+	}
+
+	for i := 0; i < locationMinSamples-1; i++ {
+		if events := add(i, "kitchen", -60); len(events) != 0 {
+			t.Fatalf("expected no zone before %d samples, got %v", locationMinSamples, events)
+		}
+	}
+
+	if events := add(2, "kitchen", -60); len(events) != 1 || events[0].Event != zoneEntered || events[0].Zone != "KITCHEN" {
+		t.Fatalf("expected to enter the kitchen, got %v", events)
+	}
+
+	// louder, but not by enough
+	for i := 0; i < locationMinSamples; i++ {
+		if events := add(3, "lounge", -57); len(events) != 0 {
+			t.Fatalf("expected to stay in the kitchen, got %v", events)
+		}
+	}
+
+	if zone := engine.Zone("F65F204CB0DB", ""); zone != "KITCHEN" {
+		t.Errorf("expected the device in the kitchen, got %q", zone)
+	}
+
+	// until the lounge average beats the kitchen by the hysteresis
+	for i := 0; i < 5; i++ {
+		add(4, "lounge", -50)
+	}
+
+	if zone := engine.Zone("F65F204CB0DB", ""); zone != "LOUNGE" {
+		t.Errorf("expected the device in the lounge, got %q", zone)
+	}
+}
+
+func TestLocationEngineAddressTypes(t *testing.T) {
+
+	engine := NewLocationEngine()
+
+	// a random address which is the same as a public one is a different device
+	var events []*ZoneEvent
+	for i := 0; i < locationMinSamples; i++ {
+		events = append(events, engine.Add("F65F204CB0DB", bluez.AddrTypePublic, "kitchen", -60, traceStart)...)
+		events = append(events, engine.Add("F65F204CB0DB", bluez.AddrTypeRandom, "lounge", -60, traceStart)...)
+	}
+
+	if len(events) != 2 || events[0].AddressType != "" || events[1].AddressType != bluez.AddrTypeRandom {
+		t.Fatalf("expected each device to enter a zone, got %v", events)
+	}
+
+	if zone := engine.Zone("F65F204CB0DB", ""); zone != "KITCHEN" {
+		t.Errorf("expected the public address in the kitchen, got %q", zone)
+	}
+	if zone := engine.Zone("F65F204CB0DB", bluez.AddrTypeRandom); zone != "LOUNGE" {
+		t.Errorf("expected the random address in the lounge, got %q", zone)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import "fmt"
+
+const (
+	// how far back past a limit a reading must come before an alert is cleared
+	moistureHysteresis    = 3   // %
+	temperatureHysteresis = 1   // °C
+	dailyLightHysteresis  = 0.5 // mol/m²/day
+)
+
+// PlantProfile describes the conditions a plant is happy in, limits which are not set aren't checked.
+type PlantProfile struct {
+	MinMoisture    *float64 `json:"minMoisture,omitempty"`    // %
+	MaxMoisture    *float64 `json:"maxMoisture,omitempty"`    // %
+	MinTemperature *float64 `json:"minTemperature,omitempty"` // °C
+	MaxTemperature *float64 `json:"maxTemperature,omitempty"` // °C
+	MinDailyLight  *float64 `json:"minDailyLight,omitempty"`  // mol/m²/day
+}
+
+func (p *PlantProfile) validate() error {
+	if p.MinMoisture != nil && p.MaxMoisture != nil && *p.MinMoisture >= *p.MaxMoisture {
+		return fmt.Errorf("Minimum moisture must be less than the maximum")
+	}
+	if p.MinTemperature != nil && p.MaxTemperature != nil && *p.MinTemperature >= *p.MaxTemperature {
+		return fmt.Errorf("Minimum temperature must be less than the maximum")
+	}
+	if p.MinDailyLight != nil && *p.MinDailyLight <= 0 {
+		return fmt.Errorf("Minimum daily light must be more than zero")
+	}
+	return nil
+}
+
+// plantAlert is the payload of the alert events, they are sent once when the alert is raised
+// and again, with Active false, when it clears.
+type plantAlert struct {
+	Active bool    `json:"active"`
+	Value  float64 `json:"value"`
+	Limit  float64 `json:"limit"`
+}
+
+// thresholdAlert tracks one alert condition, it is raised when a reading goes past the limit
+// and isn't cleared until a reading comes back past the limit by the hysteresis.
+type thresholdAlert struct {
+	event  string
+	below  bool // raise when readings drop below the limit, rather than above it
+	margin float64
+	active bool
+	limit  float64 // the limit it was last checked against
+}
+
+// check updates the alert with a reading, returning the event to send if the state changed.
+func (a *thresholdAlert) check(value float64, limit *float64) *plantAlert {
+	if limit == nil {
+		if a.active {
+			// the limit was removed from the profile, the alert clears against the one it was raised for
+			a.active = false
+			return &plantAlert{Active: false, Value: value, Limit: a.limit}
+		}
+		return nil
+	}
+
+	a.limit = *limit
+
+	raise, clear := value > *limit, value <= *limit-a.margin
+	if a.below {
+		raise, clear = value < *limit, value >= *limit+a.margin
+	}
+
+	switch {
+	case raise && !a.active:
+		a.active = true
+	case clear && a.active:
+		a.active = false
+	default:
+		return nil
+	}
+
+	return &plantAlert{Active: a.active, Value: value, Limit: *limit}
+}
+
+// plantAlerts evaluates readings against a plant profile.
+type plantAlerts struct {
+	needsWater *thresholdAlert
+	tooWet     *thresholdAlert
+	tooCold    *thresholdAlert
+	tooHot     *thresholdAlert
+	tooDark    *thresholdAlert
+}
+
+func newPlantAlerts() *plantAlerts {
+	return &plantAlerts{
+		needsWater: &thresholdAlert{event: "needs-water", below: true, margin: moistureHysteresis},
+		tooWet:     &thresholdAlert{event: "too-wet", margin: moistureHysteresis},
+		tooCold:    &thresholdAlert{event: "too-cold", below: true, margin: temperatureHysteresis},
+		tooHot:     &thresholdAlert{event: "too-hot", margin: temperatureHysteresis},
+		tooDark:    &thresholdAlert{event: "too-dark", below: true, margin: dailyLightHysteresis},
+	}
+}
+
+// send is called with the event name and payload of each alert that changes.
+type alertSender func(event string, alert *plantAlert)
+
+func (p *plantAlerts) moisture(profile *PlantProfile, value float64, send alertSender) {
+	p.check(p.needsWater, value, profile.MinMoisture, send)
+	p.check(p.tooWet, value, profile.MaxMoisture, send)
+}
+
+func (p *plantAlerts) temperature(profile *PlantProfile, value float64, send alertSender) {
+	p.check(p.tooCold, value, profile.MinTemperature, send)
+	p.check(p.tooHot, value, profile.MaxTemperature, send)
+}
+
+// dailyLight checks the light received over a complete day against the daily light target.
+func (p *plantAlerts) dailyLight(profile *PlantProfile, integral float64, send alertSender) {
+	p.check(p.tooDark, integral, profile.MinDailyLight, send)
+}
+
+func (p *plantAlerts) check(alert *thresholdAlert, value float64, limit *float64, send alertSender) {
+	if event := alert.check(value, limit); event != nil {
+		send(alert.event, event)
+	}
+}
+
+// checkPlant evaluates a reading against the device's plant profile, sending any alerts.
+func (fp *FlowerPower) checkPlant(check func(profile *PlantProfile, send alertSender)) {
+	profile := fp.driver.deviceConfig(fp.gattDevice.Address).Profile
+	if profile == nil {
+		profile = &PlantProfile{}
+	}
+
+	check(profile, func(event string, alert *plantAlert) {
+		fplog.Infof("Flower power %s %s active:%t value:%f limit:%f", fp.gattDevice.Address, event, alert.Active, alert.Value, alert.Limit)
+		if fp.sendEvent == nil {
+			return
+		}
+		if err := fp.sendEvent(event, alert); err != nil {
+			fplog.Errorf("Failed to send %s event: %s", event, err)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import "testing"
+
+func limit(value float64) *float64 {
+	return &value
+}
+
+type sentAlert struct {
+	event string
+	alert *plantAlert
+}
+
+func collectAlerts(sent *[]sentAlert) alertSender {
+	return func(event string, alert *plantAlert) {
+		*sent = append(*sent, sentAlert{event, alert})
+	}
+}
+
+func TestPlantAlertsHysteresis(t *testing.T) {
+	alerts := newPlantAlerts()
+	profile := &PlantProfile{MinMoisture: limit(20), MaxMoisture: limit(50)}
+
+	sent := []sentAlert{}
+
+	for _, moisture := range []float64{30, 19, 18, 21, 19, 22, 23, 30} {
+		alerts.moisture(profile, moisture, collectAlerts(&sent))
+	}
+
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 alerts, got %d %#v", len(sent), sent)
+	}
+
+	if sent[0].event != "needs-water" || !sent[0].alert.Active || sent[0].alert.Value != 19 {
+		t.Errorf("bad raised alert %s %#v", sent[0].event, sent[0].alert)
+	}
+
+	if sent[1].event != "needs-water" || sent[1].alert.Active || sent[1].alert.Value != 23 {
+		t.Errorf("bad cleared alert %s %#v", sent[1].event, sent[1].alert)
+	}
+}
+
+func TestPlantAlertsTemperature(t *testing.T) {
+	alerts := newPlantAlerts()
+	profile := &PlantProfile{MinTemperature: limit(0), MaxTemperature: limit(30)}
+
+	sent := []sentAlert{}
+
+	for _, temperature := range []float64{10, -1, 31, 29.5, 28} {
+		alerts.temperature(profile, temperature, collectAlerts(&sent))
+	}
+
+	events := []string{}
+	for _, s := range sent {
+		events = append(events, s.event)
+	}
+
+	expected := []string{"too-cold", "too-cold", "too-hot", "too-hot"}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, events)
+		}
+	}
+}
+
+func TestPlantAlertsNoProfile(t *testing.T) {
+	alerts := newPlantAlerts()
+
+	sent := []sentAlert{}
+	alerts.moisture(&PlantProfile{}, 0, collectAlerts(&sent))
+	alerts.temperature(&PlantProfile{}, -40, collectAlerts(&sent))
+
+	if len(sent) != 0 {
+		t.Errorf("expected no alerts without limits, got %#v", sent)
+	}
+}
+
+func TestPlantAlertsLimitRemoved(t *testing.T) {
+	alerts := newPlantAlerts()
+
+	sent := []sentAlert{}
+	alerts.moisture(&PlantProfile{MinMoisture: limit(20)}, 10, collectAlerts(&sent))
+	alerts.moisture(&PlantProfile{}, 10, collectAlerts(&sent))
+
+	if len(sent) != 2 || sent[1].alert.Active || sent[1].alert.Limit != 20 {
+		t.Fatalf("expected the alert to clear against its old limit, got %#v", sent)
+	}
+}
+
+func TestPlantAlertsTooDark(t *testing.T) {
+	alerts := newPlantAlerts()
+	profile := &PlantProfile{MinDailyLight: limit(10)}
+
+	sent := []sentAlert{}
+
+	for _, integral := range []float64{12, 8, 10.2, 11} {
+		alerts.dailyLight(profile, integral, collectAlerts(&sent))
+	}
+
+	if len(sent) != 2 || sent[0].event != "too-dark" || !sent[0].alert.Active || sent[1].alert.Active || sent[1].alert.Value != 11 {
+		t.Errorf("expected a too-dark alert raised at 8 and cleared at 11, got %#v", sent)
+	}
+}
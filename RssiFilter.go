@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	rssiFilterNone   = "none"
+	rssiFilterMedian = "median"
+	rssiFilterEMA    = "ema"
+	rssiFilterKalman = "kalman"
+
+	defaultMedianWindow           = 5
+	defaultEMAAlpha               = 0.3
+	defaultKalmanProcessNoise     = 0.5
+	defaultKalmanMeasurementNoise = 8.0
+
+	rssiFilterReset = time.Second * 30 // a pair not heard for this long starts again
+	maxRssiOutliers = 3                // outliers in a row are taken as a real change
+)
+
+// RssiFilterConfig chooses how the rssi samples are smoothed before they are published.
+type RssiFilterConfig struct {
+	Type   string  `json:"type,omitempty"`   // none, median (the default), ema or kalman
+	Window int     `json:"window,omitempty"` // samples, for the median
+	Alpha  float64 `json:"alpha,omitempty"`  // for ema, between 0 and 1, higher follows changes faster
+
+	// for kalman, how much the rssi is expected to wander between samples, and how noisy they are
+	ProcessNoise     float64 `json:"processNoise,omitempty"`
+	MeasurementNoise float64 `json:"measurementNoise,omitempty"`
+
+	// OutlierThreshold drops samples this many dB from the filtered value, zero keeps them all.
+	OutlierThreshold float64 `json:"outlierThreshold,omitempty"`
+}
+
+// Validate checks the config before the filters are built with it.
+func (c *RssiFilterConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+
+	switch c.Type {
+	case "", rssiFilterNone, rssiFilterMedian, rssiFilterEMA, rssiFilterKalman:
+	default:
+		return fmt.Errorf("Invalid rssi filter %q, expected none, median, ema or kalman", c.Type)
+	}
+
+	if c.Window < 0 {
+		return fmt.Errorf("Invalid rssi filter window %d", c.Window)
+	}
+
+	if c.Alpha < 0 || c.Alpha > 1 {
+		return fmt.Errorf("Invalid rssi filter alpha %f, expected 0 to 1", c.Alpha)
+	}
+
+	if c.ProcessNoise < 0 || c.MeasurementNoise < 0 || c.OutlierThreshold < 0 {
+		return fmt.Errorf("Invalid rssi filter, noise and thresholds can't be negative")
+	}
+
+	return nil
+}
+
+// rssiStage smooths the samples from one device and waypoint.
+type rssiStage interface {
+	add(rssi float64) float64
+}
+
+// medianStage is the median of the last few samples, which ignores the odd wild one.
+type medianStage struct {
+	window  int
+	samples []float64
+}
+
+func (s *medianStage) add(rssi float64) float64 {
+	s.samples = append(s.samples, rssi)
+	if len(s.samples) > s.window {
+		s.samples = s.samples[len(s.samples)-s.window:]
+	}
+
+	sorted := append([]float64{}, s.samples...)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// emaStage is an exponential moving average.
+type emaStage struct {
+	alpha  float64
+	value  float64
+	primed bool
+}
+
+func (s *emaStage) add(rssi float64) float64 {
+	if !s.primed {
+		s.value, s.primed = rssi, true
+		return s.value
+	}
+	s.value += s.alpha * (rssi - s.value)
+	return s.value
+}
+
+// kalmanStage is a one dimensional Kalman filter, modelling the rssi as constant plus noise.
+type kalmanStage struct {
+	processNoise     float64
+	measurementNoise float64
+	estimate         float64
+	errorCovariance  float64
+	primed           bool
+}
+
+func (s *kalmanStage) add(rssi float64) float64 {
+	if !s.primed {
+		s.estimate, s.errorCovariance, s.primed = rssi, s.measurementNoise, true
+		return s.estimate
+	}
+
+	s.errorCovariance += s.processNoise
+	gain := s.errorCovariance / (s.errorCovariance + s.measurementNoise)
+	s.estimate += gain * (rssi - s.estimate)
+	s.errorCovariance *= 1 - gain
+
+	return s.estimate
+}
+
+// rssiPair is the filter state for one device and waypoint.
+type rssiPair struct {
+	stage    rssiStage
+	last     float64
+	outliers int
+	heard    time.Time
+}
+
+// RssiFilters smooths the rssi samples separately for each device and waypoint.
+type RssiFilters struct {
+	sync.Mutex
+	config *RssiFilterConfig
+	pairs  map[string]*rssiPair
+}
+
+func NewRssiFilters(config *RssiFilterConfig) *RssiFilters {
+	f := &RssiFilters{}
+	f.Configure(config)
+	return f
+}
+
+// Configure replaces the filter config, which starts every pair again. Nil uses the defaults.
+func (f *RssiFilters) Configure(config *RssiFilterConfig) {
+	f.Lock()
+	defer f.Unlock()
+
+	if config == nil {
+		config = &RssiFilterConfig{}
+	}
+	f.config = config
+	f.pairs = make(map[string]*rssiPair)
+}
+
+// Filter returns the smoothed rssi, or false if the sample is an outlier and should be dropped.
+func (f *RssiFilters) Filter(device, waypoint string, rssi int8, now time.Time) (int8, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.config.Type == rssiFilterNone {
+		return rssi, true
+	}
+
+	key := normaliseAddress(device) + "/" + normaliseAddress(waypoint)
+
+	pair, ok := f.pairs[key]
+	if !ok || now.Sub(pair.heard) > rssiFilterReset {
+		pair = &rssiPair{stage: f.newStage()}
+		f.pairs[key] = pair
+		ok = false
+	}
+	pair.heard = now
+
+	sample := float64(rssi)
+
+	if ok && f.config.OutlierThreshold > 0 && math.Abs(sample-pair.last) > f.config.OutlierThreshold {
+		pair.outliers++
+		if pair.outliers < maxRssiOutliers {
+			return 0, false
+		}
+		// it has really moved, start again from here
+		pair.stage = f.newStage()
+	}
+	pair.outliers = 0
+
+	pair.last = pair.stage.add(sample)
+
+	return int8(math.Floor(pair.last + 0.5)), true
+}
+
+// Expire forgets the pairs which haven't been heard recently.
+func (f *RssiFilters) Expire(now time.Time) {
+	f.Lock()
+	defer f.Unlock()
+
+	for key, pair := range f.pairs {
+		if now.Sub(pair.heard) > rssiFilterReset {
+			delete(f.pairs, key)
+		}
+	}
+}
+
+// newStage must be called with the lock held.
+func (f *RssiFilters) newStage() rssiStage {
+	switch f.config.Type {
+	case rssiFilterEMA:
+		alpha := f.config.Alpha
+		if alpha == 0 {
+			alpha = defaultEMAAlpha
+		}
+		return &emaStage{alpha: alpha}
+
+	case rssiFilterKalman:
+		processNoise, measurementNoise := f.config.ProcessNoise, f.config.MeasurementNoise
+		if processNoise == 0 {
+			processNoise = defaultKalmanProcessNoise
+		}
+		if measurementNoise == 0 {
+			measurementNoise = defaultKalmanMeasurementNoise
+		}
+		return &kalmanStage{processNoise: processNoise, measurementNoise: measurementNoise}
+
+	default:
+		window := f.config.Window
+		if window == 0 {
+			window = defaultMedianWindow
+		}
+		return &medianStage{window: window}
+	}
+}
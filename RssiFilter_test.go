@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func addAll(stage rssiStage, samples ...float64) []float64 {
+	filtered := []float64{}
+	for _, sample := range samples {
+		filtered = append(filtered, stage.add(sample))
+	}
+	return filtered
+}
+
+func TestMedianStage(t *testing.T) {
+	filtered := addAll(&medianStage{window: 3}, -60, -62, -90, -61, -59)
+
+	expected := []float64{-60, -61, -62, -62, -61}
+	for i := range expected {
+		if filtered[i] != expected[i] {
+			t.Errorf("sample %d: expected %f, got %f", i, expected[i], filtered[i])
+		}
+	}
+}
+
+func TestEMAStage(t *testing.T) {
+	filtered := addAll(&emaStage{alpha: 0.5}, -60, -70, -70)
+
+	expected := []float64{-60, -65, -67.5}
+	for i := range expected {
+		if filtered[i] != expected[i] {
+			t.Errorf("sample %d: expected %f, got %f", i, expected[i], filtered[i])
+		}
+	}
+}
+
+func TestKalmanStage(t *testing.T) {
+	stage := &kalmanStage{processNoise: 0.5, measurementNoise: 8}
+
+	if first := stage.add(-60); first != -60 {
+		t.Errorf("expected the first sample through unchanged, got %f", first)
+	}
+
+	// p = 8.5, gain = 8.5 / 16.5
+	if second := stage.add(-70); math.Abs(second-(-60-10*8.5/16.5)) > 1e-9 {
+		t.Errorf("unexpected second estimate %f", second)
+	}
+
+	// noise around -65 settles near it
+	estimate := 0.0
+	for i := 0; i < 200; i++ {
+		estimate = stage.add(-65 + float64(i%5-2)*3)
+	}
+	if math.Abs(estimate-(-65)) > 3 {
+		t.Errorf("expected the estimate to settle near -65, got %f", estimate)
+	}
+}
+
+func TestRssiFiltersOutliers(t *testing.T) {
+
+	filters := NewRssiFilters(&RssiFilterConfig{Type: rssiFilterEMA, Alpha: 0.5, OutlierThreshold: 15})
+	now := time.Now()
+
+	filter := func(rssi int8) (int8, bool) {
+		now = now.Add(time.Second)
+		return filters.Filter("f6:5f:20:4c:b0:db", "112233445566", rssi, now)
+	}
+
+	if rssi, ok := filter(-60); !ok || rssi != -60 {
+		t.Fatalf("expected the first sample through, got %d %t", rssi, ok)
+	}
+
+	if _, ok := filter(-90); ok {
+		t.Errorf("expected a single outlier to be dropped")
+	}
+
+	if rssi, ok := filter(-64); !ok || rssi != -62 {
+		t.Errorf("expected -62, got %d %t", rssi, ok)
+	}
+
+	// the device has moved, after a few outliers in a row it starts again
+	filter(-90)
+	filter(-91)
+	if rssi, ok := filter(-92); !ok || rssi != -92 {
+		t.Errorf("expected to follow the move, got %d %t", rssi, ok)
+	}
+
+	// other waypoints are filtered separately
+	if rssi, ok := filters.Filter("F65F204CB0DB", "665544332211", -50, now); !ok || rssi != -50 {
+		t.Errorf("expected a new pair to start from its first sample, got %d %t", rssi, ok)
+	}
+}
+
+func TestRssiFiltersReset(t *testing.T) {
+
+	filters := NewRssiFilters(nil)
+	now := time.Now()
+
+	for _, rssi := range []int8{-60, -60, -60} {
+		filters.Filter("F65F204CB0DB", "112233445566", rssi, now)
+	}
+
+	if rssi, _ := filters.Filter("F65F204CB0DB", "112233445566", -80, now); rssi != -60 {
+		t.Errorf("expected the median to hold -60, got %d", rssi)
+	}
+
+	later := now.Add(rssiFilterReset + time.Second)
+	if rssi, _ := filters.Filter("F65F204CB0DB", "112233445566", -80, later); rssi != -80 {
+		t.Errorf("expected a pair not heard for a while to start again, got %d", rssi)
+	}
+
+	filters.Expire(later.Add(rssiFilterReset + time.Second))
+	if len(filters.pairs) != 0 {
+		t.Errorf("expected the pair to expire")
+	}
+
+	none := NewRssiFilters(&RssiFilterConfig{Type: rssiFilterNone})
+	if rssi, ok := none.Filter("F65F204CB0DB", "112233445566", -99, now); !ok || rssi != -99 {
+		t.Errorf("expected samples through unfiltered, got %d %t", rssi, ok)
+	}
+}
+
+func TestInvalidRssiFilterConfig(t *testing.T) {
+	for _, config := range []*RssiFilterConfig{
+		{Type: "mean"},
+		{Window: -1},
+		{Alpha: 1.5},
+		{OutlierThreshold: -3},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected %#v to be invalid", config)
+		}
+	}
+
+	var config *RssiFilterConfig
+	if err := config.Validate(); err != nil {
+		t.Errorf("expected nil to be valid: %s", err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRssiMinInterval = time.Millisecond * 500
+	defaultRssiMinChange   = 3.0 // dBm
+	defaultRssiHeartbeat   = time.Second * 5
+
+	rssiPolicyExpiry   = time.Minute     // pairs not sent for this long are forgotten
+	rssiStatsInterval  = time.Minute     // between logging the counters
+	maxRssiPolicyDelay = time.Minute * 5 // the longest interval or heartbeat we accept
+)
+
+// RssiPolicyConfig decides which rssi packets are worth publishing. The zero value, or nil, uses
+// the defaults.
+type RssiPolicyConfig struct {
+	MinInterval int     `json:"minInterval,omitempty"` // ms between packets for a device and waypoint
+	MinChange   float64 `json:"minChange,omitempty"`   // dBm the rssi must move by to be sent before the heartbeat
+	Heartbeat   int     `json:"heartbeat,omitempty"`   // ms after which the rssi is sent even if it hasn't moved
+
+	// Devices overrides the fields which are set for each device, by address, eg. to follow a tag
+	// more closely than the phones.
+	Devices map[string]*RssiPolicyConfig `json:"devices,omitempty"`
+}
+
+// Validate checks the config, and its device overrides, before the policy is built with it.
+func (c *RssiPolicyConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if err := c.validateLimits(); err != nil {
+		return err
+	}
+
+	for device, override := range c.Devices {
+		if err := c.ValidateOverride(override); err != nil {
+			return fmt.Errorf("Invalid rssi policy for %s: %s", device, err)
+		}
+	}
+
+	return nil
+}
+
+// ValidateOverride checks a device's override, together with the config it overrides.
+func (c *RssiPolicyConfig) ValidateOverride(override *RssiPolicyConfig) error {
+	if override == nil {
+		return nil
+	}
+
+	if len(override.Devices) > 0 {
+		return fmt.Errorf("A device's rssi policy can't have devices of its own")
+	}
+
+	return c.override(override).validateLimits()
+}
+
+// override returns a copy of the config without its devices, with the fields set in override
+// replacing its own.
+func (c *RssiPolicyConfig) override(override *RssiPolicyConfig) *RssiPolicyConfig {
+	merged := RssiPolicyConfig{}
+	if c != nil {
+		merged = *c
+	}
+	merged.Devices = nil
+
+	if override == nil {
+		return &merged
+	}
+
+	if override.MinInterval != 0 {
+		merged.MinInterval = override.MinInterval
+	}
+	if override.MinChange != 0 {
+		merged.MinChange = override.MinChange
+	}
+	if override.Heartbeat != 0 {
+		merged.Heartbeat = override.Heartbeat
+	}
+
+	return &merged
+}
+
+func (c *RssiPolicyConfig) validateLimits() error {
+
+	if c.MinInterval < 0 || time.Duration(c.MinInterval)*time.Millisecond > maxRssiPolicyDelay {
+		return fmt.Errorf("Invalid rssi min interval %dms", c.MinInterval)
+	}
+
+	if c.Heartbeat < 0 || time.Duration(c.Heartbeat)*time.Millisecond > maxRssiPolicyDelay {
+		return fmt.Errorf("Invalid rssi heartbeat %dms", c.Heartbeat)
+	}
+
+	if c.Heartbeat != 0 && c.Heartbeat < c.MinInterval {
+		return fmt.Errorf("Invalid rssi heartbeat %dms, it can't be shorter than the min interval", c.Heartbeat)
+	}
+
+	if c.MinChange < 0 {
+		return fmt.Errorf("Invalid rssi min change %f", c.MinChange)
+	}
+
+	return nil
+}
+
+// RssiStats counts the rssi packets published and suppressed since the driver started.
+type RssiStats struct {
+	Sent       uint64 `json:"sent"`
+	Suppressed uint64 `json:"suppressed"`
+}
+
+type rssiSent struct {
+	time time.Time
+	rssi int8
+}
+
+type rssiLimits struct {
+	minInterval time.Duration
+	minChange   float64
+	heartbeat   time.Duration
+}
+
+// limits fills in the defaults for the fields which aren't set.
+func (c *RssiPolicyConfig) limits() rssiLimits {
+	limits := rssiLimits{
+		minInterval: time.Duration(c.MinInterval) * time.Millisecond,
+		minChange:   c.MinChange,
+		heartbeat:   time.Duration(c.Heartbeat) * time.Millisecond,
+	}
+
+	if limits.minInterval == 0 {
+		limits.minInterval = defaultRssiMinInterval
+	}
+	if limits.minChange == 0 {
+		limits.minChange = defaultRssiMinChange
+	}
+	if limits.heartbeat == 0 {
+		limits.heartbeat = defaultRssiHeartbeat
+	}
+	if limits.heartbeat < limits.minInterval {
+		limits.heartbeat = limits.minInterval
+	}
+
+	return limits
+}
+
+// RssiPolicy rate limits the rssi packets for each device and waypoint, so the bus traffic
+// follows the changes rather than the advertisements.
+type RssiPolicy struct {
+	sync.Mutex
+	limits  rssiLimits
+	devices map[string]rssiLimits // the overrides, by device
+	sent    map[string]rssiSent
+	stats   RssiStats
+}
+
+func NewRssiPolicy(config *RssiPolicyConfig) *RssiPolicy {
+	p := &RssiPolicy{sent: make(map[string]rssiSent)}
+	p.Configure(config)
+	return p
+}
+
+// Configure replaces the policy config, keeping the counters. Nil uses the defaults.
+func (p *RssiPolicy) Configure(config *RssiPolicyConfig) {
+	p.Lock()
+	defer p.Unlock()
+
+	if config == nil {
+		config = &RssiPolicyConfig{}
+	}
+
+	p.limits = config.limits()
+
+	p.devices = make(map[string]rssiLimits)
+	for device, override := range config.Devices {
+		if override != nil {
+			p.devices[normaliseAddress(device)] = config.override(override).limits()
+		}
+	}
+}
+
+// Allow returns whether the packet should be published, counting it either way. A device's
+// override applies whatever its address type, but random and public addresses are limited apart.
+func (p *RssiPolicy) Allow(device, addressType, waypoint string, rssi int8, now time.Time) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	key := deviceKey(device, addressType) + "/" + normaliseAddress(waypoint)
+
+	limits, ok := p.devices[normaliseAddress(device)]
+	if !ok {
+		limits = p.limits
+	}
+
+	if last, ok := p.sent[key]; ok {
+		elapsed := now.Sub(last.time)
+		change := float64(rssi) - float64(last.rssi)
+		if change < 0 {
+			change = -change
+		}
+
+		if elapsed < limits.minInterval || (change < limits.minChange && elapsed < limits.heartbeat) {
+			p.stats.Suppressed++
+			return false
+		}
+	}
+
+	p.sent[key] = rssiSent{time: now, rssi: rssi}
+	p.stats.Sent++
+	return true
+}
+
+// Stats returns the counters.
+func (p *RssiPolicy) Stats() RssiStats {
+	p.Lock()
+	defer p.Unlock()
+	return p.stats
+}
+
+// Expire forgets the pairs which haven't been sent recently, so they are sent straight away
+// when they are heard again.
+func (p *RssiPolicy) Expire(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	for key, last := range p.sent {
+		if now.Sub(last.time) > rssiPolicyExpiry {
+			delete(p.sent, key)
+		}
+	}
+}
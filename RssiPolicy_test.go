@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+)
+
+func TestRssiPolicy(t *testing.T) {
+
+	policy := NewRssiPolicy(&RssiPolicyConfig{MinInterval: 1000, MinChange: 3, Heartbeat: 5000})
+	start := time.Now()
+
+	allow := func(ms int, waypoint string, rssi int8) bool {
+		return policy.Allow("f6:5f:20:4c:b0:db", "", waypoint, rssi, start.Add(time.Duration(ms)*time.Millisecond))
+	}
+
+	for _, step := range []struct {
+		ms       int
+		waypoint string
+		rssi     int8
+		allowed  bool
+	}{
+		{0, "112233445566", -60, true},     // the first is always sent
+		{200, "112233445566", -80, false},  // too soon, however much it moved
+		{300, "665544332211", -70, true},   // another waypoint
+		{1200, "112233445566", -61, false}, // not moved enough
+		{1500, "112233445566", -64, true},  // moved
+		{4000, "112233445566", -64, false}, // not moved
+		{6600, "112233445566", -64, true},  // heartbeat
+	} {
+		if allowed := allow(step.ms, step.waypoint, step.rssi); allowed != step.allowed {
+			t.Errorf("%dms %s %d: expected allowed %t", step.ms, step.waypoint, step.rssi, step.allowed)
+		}
+	}
+
+	if stats := policy.Stats(); stats.Sent != 4 || stats.Suppressed != 3 {
+		t.Errorf("expected 4 sent and 3 suppressed, got %+v", stats)
+	}
+
+	policy.Expire(start.Add(rssiPolicyExpiry + time.Second*7))
+	if !allow(int((rssiPolicyExpiry+time.Second*8)/time.Millisecond), "112233445566", -64) {
+		t.Errorf("expected an expired pair to be sent straight away")
+	}
+}
+
+func TestRssiPolicyDefaults(t *testing.T) {
+
+	policy := NewRssiPolicy(nil)
+	now := time.Now()
+
+	if !policy.Allow("F65F204CB0DB", "", "112233445566", -60, now) {
+		t.Fatal("expected the first packet to be sent")
+	}
+
+	if policy.Allow("F65F204CB0DB", "", "112233445566", -60, now.Add(defaultRssiMinInterval)) {
+		t.Errorf("expected an unchanged packet to be suppressed")
+	}
+
+	if policy.Allow("F65F204CB0DB", bluez.AddrTypePublic, "112233445566", -60, now.Add(defaultRssiMinInterval)) {
+		t.Errorf("expected an unknown address type to be taken as public")
+	}
+
+	if !policy.Allow("F65F204CB0DB", bluez.AddrTypeRandom, "112233445566", -60, now.Add(defaultRssiMinInterval)) {
+		t.Errorf("expected the random address to be limited apart")
+	}
+
+	if !policy.Allow("F65F204CB0DB", "", "112233445566", -60, now.Add(defaultRssiHeartbeat)) {
+		t.Errorf("expected the heartbeat to be sent")
+	}
+}
+
+func TestRssiPolicyDeviceOverride(t *testing.T) {
+
+	policy := NewRssiPolicy(&RssiPolicyConfig{
+		MinInterval: 1000,
+		Devices: map[string]*RssiPolicyConfig{
+			"f6:5f:20:4c:b0:db": {MinInterval: 200, MinChange: 1},
+		},
+	})
+	now := time.Now()
+
+	for _, device := range []string{"F65F204CB0DB", "112233445566"} {
+		if !policy.Allow(device, "", "AABBCCDDEEFF", -60, now) {
+			t.Fatalf("expected the first packet from %s to be sent", device)
+		}
+	}
+
+	later := now.Add(time.Millisecond * 300)
+
+	if !policy.Allow("F65F204CB0DB", "", "AABBCCDDEEFF", -61, later) {
+		t.Errorf("expected the device's own policy to send a small change sooner")
+	}
+	if policy.Allow("112233445566", "", "AABBCCDDEEFF", -70, later) {
+		t.Errorf("expected the other devices to keep the driver's policy")
+	}
+}
+
+func TestInvalidRssiPolicyConfig(t *testing.T) {
+	for _, config := range []*RssiPolicyConfig{
+		{MinInterval: -1},
+		{Heartbeat: 1000 * 60 * 60},
+		{MinInterval: 2000, Heartbeat: 1000},
+		{MinChange: -2},
+		{Heartbeat: 1000, Devices: map[string]*RssiPolicyConfig{"F65F204CB0DB": {MinInterval: 2000}}},
+		{Devices: map[string]*RssiPolicyConfig{"F65F204CB0DB": {Devices: map[string]*RssiPolicyConfig{"112233445566": {}}}}},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected %#v to be invalid", config)
+		}
+	}
+
+	var config *RssiPolicyConfig
+	if err := config.Validate(); err != nil {
+		t.Errorf("expected nil to be valid: %s", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -31,11 +32,13 @@ type BLETag struct {
 	identifyChannel *channels.IdentifyChannel
 	onOffChannel    *channels.OnOffChannel
 
-	// currently we are using the bluez gatttool wrapper due to issues with
-	// access characteristics with security enabled.
-	gattCmd   *bluez.GattCmd
-	readChar  *bluez.Characteristic
-	alertChar *bluez.Characteristic
+	// tags default to the bluez transport, due to issues with accessing
+	// characteristics with security enabled over the gatt client.
+	transport  Transport
+	readChar   *bluez.Characteristic
+	alertChar  *bluez.Characteristic
+	deviceInfo *DeviceInformation
+	gatttool   *bluez.Options // the tag's own options, over the driver's
 
 	// device *gatt.DiscoveredDevice
 	// service   gatt.ServiceDescription
@@ -62,11 +65,12 @@ func NewBLETag(driver *BLETagDriver, device *gatt.DiscoveredDevice) error {
 	name := "BLE Tag"
 
 	bt := &BLETag{
-		driver: driver,
+		driver:  driver,
+		address: address,
 		info: &model.Device{
 			NaturalID:     address,
 			NaturalIDType: "BLE Mac",
-			Name:          &name, //TODO Fill me in with retrieved value
+			Name:          &name,
 			Signatures: &map[string]string{
 				"ninja:manufacturer": "Sticknfind",
 				"ninja:productName":  "SL6",
@@ -76,45 +80,61 @@ func NewBLETag(driver *BLETagDriver, device *gatt.DiscoveredDevice) error {
 		},
 	}
 
-	conn := driver.conn
-
-	err := conn.ExportDevice(bt)
-	if err != nil {
-		btlog.Fatalf("Failed to export BLE Tag %+v %s", bt, err)
+	if err := bt.newTransport(); err != nil {
+		return err
 	}
 
-	bt.identifyChannel = channels.NewIdentifyChannel(bt)
-	err = conn.ExportChannel(bt, bt.identifyChannel, "identify")
-	if err != nil {
-		fplog.Fatalf("Failed to export BLE Tag identify channel %s, dumping device info", err)
-		spew.Dump(bt)
-	}
-
-	bt.onOffChannel = channels.NewOnOffChannel(bt)
-	err = conn.ExportChannel(bt, bt.onOffChannel, "on-off")
-	if err != nil {
-		fplog.Fatalf("Failed to export BLE Tag on-off channel %s, dumping device info", err)
-		spew.Dump(bt)
+	if t, ok := bt.transport.(*gattTransport); ok {
+		t.attach(device)
 	}
 
 	driver.FoundTags[address] = true
+	driver.tags[address] = bt
 
-	bt.gattCmd = bluez.NewGattCmd(address, bluez.AddrTypeRandom)
+	// we are called from the advertisement, which the gatt client needs back to connect
+	go func() {
+		// discover before exporting so the device is announced with its real name
+		discoveryErr := bt.cacheCharacteristHandles()
 
-	err = bt.cacheCharacteristHandles()
+		bt.deviceInfo.apply(bt.info)
 
-	if err != nil {
-		return fmt.Errorf("Discovery Error: %s", err)
-	}
+		conn := driver.conn
 
-	time.Sleep(1 * time.Second)
+		err := conn.ExportDevice(bt)
+		if err != nil {
+			btlog.Fatalf("Failed to export BLE Tag %+v %s", bt, err)
+		}
 
-	if err := bt.gattCmd.WriteCharacteristic(bt.alertChar.CharValueHandle, "0103"); err != nil {
-		return fmt.Errorf("Alert characteristic write failed: %v", err)
-	}
+		bt.identifyChannel = channels.NewIdentifyChannel(bt)
+		err = conn.ExportChannel(bt, bt.identifyChannel, "identify")
+		if err != nil {
+			fplog.Fatalf("Failed to export BLE Tag identify channel %s, dumping device info", err)
+			spew.Dump(bt)
+		}
+
+		bt.onOffChannel = channels.NewOnOffChannel(bt)
+		err = conn.ExportChannel(bt, bt.onOffChannel, "on-off")
+		if err != nil {
+			fplog.Fatalf("Failed to export BLE Tag on-off channel %s, dumping device info", err)
+			spew.Dump(bt)
+		}
+
+		if discoveryErr != nil {
+			btlog.Errorf("Error creating BLE Tag device %s", discoveryErr)
+			return
+		}
 
-	// TODO Save the configuration
-	driver.saveNewTag(device.Address, device.PublicAddress, bt.readChar, bt.alertChar)
+		time.Sleep(1 * time.Second)
+
+		if err := bt.alert(); err != nil {
+			btlog.Errorf("Alert characteristic write failed: %v", err)
+			btlog.Warningf("Not saving tag %s, it will be discovered again after a restart", device.Address)
+			return
+		}
+
+		// TODO Save the configuration
+		driver.saveNewTag(device.Address, device.PublicAddress, bt.readChar, bt.alertChar, bt.deviceInfo, bt.gatttool)
+	}()
 
 	return nil
 }
@@ -126,11 +146,12 @@ func NewBLETagFromConfig(driver *BLETagDriver, tagConfig *BleTagConfig) error {
 	name := "BLE Tag"
 
 	bt := &BLETag{
-		driver: driver,
+		driver:  driver,
+		address: tagConfig.Address,
 		info: &model.Device{
 			NaturalID:     tagConfig.Address,
 			NaturalIDType: "BLE Mac",
-			Name:          &name, //TODO Fill me in with retrieved value
+			Name:          &name,
 			Signatures: &map[string]string{
 				"ninja:manufacturer": "Sticknfind",
 				"ninja:productName":  "SL6",
@@ -138,8 +159,22 @@ func NewBLETagFromConfig(driver *BLETagDriver, tagConfig *BleTagConfig) error {
 				"ninja:thingType":    "tag",
 			},
 		},
+		deviceInfo: tagConfig.Info,
+		gatttool:   tagConfig.Gatttool,
+	}
+
+	if err := bt.newTransport(); err != nil {
+		return err
 	}
 
+	bt.alertChar = characteristicFromConfig(tagConfig.AlertUUID, tagConfig.AlertHandle, tagConfig.AlertCharValueHandle, tagConfig.AlertProperties)
+	bt.readChar = characteristicFromConfig(tagConfig.ReadUUID, tagConfig.ReadHandle, tagConfig.ReadCharValueHandle, tagConfig.ReadProperties)
+
+	// We ATTEMPT to refresh the characteristics, if the device is not nearby this is OK.
+	bt.cacheCharacteristHandles()
+
+	bt.deviceInfo.apply(bt.info)
+
 	conn := driver.conn
 
 	err := conn.ExportDevice(bt)
@@ -162,28 +197,56 @@ func NewBLETagFromConfig(driver *BLETagDriver, tagConfig *BleTagConfig) error {
 	}
 
 	driver.FoundTags[tagConfig.Address] = true
+	driver.tags[tagConfig.Address] = bt
 
-	bt.gattCmd = bluez.NewGattCmd(tagConfig.Address, bluez.AddrTypeRandom)
+	// Update the configuration
+	driver.saveNewTag(tagConfig.Address, tagConfig.PublicAddress, bt.readChar, bt.alertChar, bt.deviceInfo, bt.gatttool)
 
-	bt.alertChar = &bluez.Characteristic{
-		UUID:            tagConfig.AlertUUID,
-		Handle:          tagConfig.AlertHandle,
-		CharValueHandle: tagConfig.AlertCharValueHandle,
-	}
+	return nil
+}
+
+func (bt *BLETag) newTransport() (err error) {
+	bt.transport, err = newTransport(bt.driver.transportKind(), bt.driver.gattClient, bt.address, false, bt.driver.gattOptions(bt.gatttool), transportEvents{})
+	return err
+}
+
+// alert writes to the alert characteristic, which starts the tag buzzing.
+func (bt *BLETag) alert() error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), gatttoolTimeout)
+	defer cancel()
+
+	return connections.Run(ctx, PriorityTagAlert, bt.address, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), gatttoolTimeout)
+		defer cancel()
+
+		if err := bt.transport.Connect(ctx); err != nil {
+			return err
+		}
+
+		return bt.transport.Write(ctx, bt.alertChar, []byte{0x01, 0x03})
+	})
+}
+
+// characteristicFromConfig restores a characteristic saved by saveNewTag.
+func characteristicFromConfig(uuid, handle, valueHandle string, props bluez.Properties) *bluez.Characteristic {
 
-	bt.readChar = &bluez.Characteristic{
-		UUID:            tagConfig.ReadUUID,
-		Handle:          tagConfig.ReadHandle,
-		CharValueHandle: tagConfig.ReadCharValueHandle,
+	char := &bluez.Characteristic{
+		UUID:       uuid,
+		Properties: props,
 	}
 
-	// We ATTEMPT to refresh the characteristics, if the device is not nearby this is OK.
-	bt.cacheCharacteristHandles()
+	var err error
 
-	// Update the configuration
-	driver.saveNewTag(tagConfig.Address, tagConfig.PublicAddress, bt.readChar, bt.alertChar)
+	if char.Handle, err = bluez.ParseHandle(handle); err != nil {
+		log.Warningf("Bad %s handle in config: %s", uuid, err)
+	}
 
-	return nil
+	if char.CharValueHandle, err = bluez.ParseHandle(valueHandle); err != nil {
+		log.Warningf("Bad %s value handle in config: %s", uuid, err)
+	}
+
+	return char
 }
 
 func (fp *BLETag) GetDeviceInfo() *model.Device {
@@ -200,7 +263,19 @@ func (fp *BLETag) SetEventHandler(sendEvent func(event string, payload interface
 
 func (fp *BLETag) ReadStatus() []byte {
 
-	data, err := fp.gattCmd.ReadCharacteristic(fp.readChar.CharValueHandle)
+	var data []byte
+
+	ctx, cancel := context.WithTimeout(context.Background(), gatttoolTimeout)
+	defer cancel()
+
+	err := connections.Run(ctx, PriorityTagAlert, fp.address, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), gatttoolTimeout)
+		defer cancel()
+
+		var err error
+		data, err = fp.transport.Read(ctx, fp.readChar.CharValueHandle)
+		return err
+	})
 
 	if err != nil {
 		log.Errorf("ReadStatus failed: %s", err)
@@ -247,7 +322,13 @@ func (fp *BLETag) Buzz() (state chan bool, errChan chan error) {
 			return
 		}
 
-		if err := fp.gattCmd.WriteCharacteristic(fp.alertChar.CharValueHandle, "0103"); err != nil {
+		err := fp.alert()
+
+		switch {
+		case err == nil:
+		case bluez.IsConnectionRefused(err), bluez.IsTimeout(err):
+			errChan <- fmt.Errorf("Tag %s is out of range: %s", fp.address, err)
+		default:
 			errChan <- fmt.Errorf("Alert characteristic write failed: %q", err)
 		}
 
@@ -271,7 +352,26 @@ func (fp *BLETag) Identify() error {
 
 func (fp *BLETag) cacheCharacteristHandles() error {
 
-	chars, err := fp.gattCmd.ReadCharacteristics()
+	var chars []*bluez.Characteristic
+
+	ctx, cancel := context.WithTimeout(context.Background(), gatttoolTimeout)
+	defer cancel()
+
+	err := connections.Run(ctx, PriorityDiscovery, fp.address, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), gatttoolTimeout)
+		defer cancel()
+
+		var err error
+		if chars, err = fp.transport.Discover(ctx); err != nil {
+			return err
+		}
+
+		// only read the first time, after that it is cached in the configuration
+		if fp.deviceInfo == nil {
+			fp.deviceInfo = readDeviceInformation(ctx, fp.transport, chars)
+		}
+		return nil
+	})
 
 	if err != nil {
 		return fmt.Errorf("Discovery Error: %s", err)
@@ -21,6 +21,7 @@ type BLETagDriver struct {
 	gattClient *gatt.Client
 	running    bool
 	FoundTags  map[string]bool
+	tags       map[string]*BLETag
 	lkConfig   sync.Mutex
 	Config     *Config
 }
@@ -49,10 +50,31 @@ func NewBLETagDriver(client *gatt.Client) (*BLETagDriver, error) {
 	}
 
 	driver.FoundTags = make(map[string]bool)
+	driver.tags = make(map[string]*BLETag)
+
+	// look for tags which are CLOSE to the sphere!!
+	advertisements.Register("bletag", &AdvertisementMatcher{
+		ServiceUuid: stickNFindServiceUuid,
+		MinRSSI:     minRSSI,
+	}, driver.handleAdvertisement)
 
 	return driver, nil
 }
 
+func (d *BLETagDriver) handleAdvertisement(device *gatt.DiscoveredDevice) {
+	// tags restored from the configuration only get their device once they are advertised
+	if tag, ok := d.tags[device.Address]; ok {
+		if t, ok := tag.transport.(*gattTransport); ok {
+			t.attach(device)
+		}
+	}
+
+	err := NewBLETag(d, device)
+	if err != nil {
+		btlog.Errorf("Error creating BLE Tag device %s", err)
+	}
+}
+
 func (d *BLETagDriver) Configure(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
 	log.Infof("Incoming configuration request. Action:%s Data:%s", request.Action, string(request.Data))
 
@@ -70,7 +92,27 @@ func (d *BLETagDriver) SetEventHandler(sendEvent func(event string, payload inte
 func (fp *BLETagDriver) Start(config *Config) error {
 	btlog.Infof(spew.Sprintf("Starting BLE tag driver %v", config))
 
+	if err := config.Gatttool.Validate(); err != nil {
+		btlog.Errorf("Ignoring gatttool options: %s", err)
+	} else {
+		fp.lkConfig.Lock()
+		fp.Config.Gatttool = config.Gatttool
+		fp.lkConfig.Unlock()
+	}
+
+	if err := validateTransport(config.Transport); err != nil {
+		btlog.Errorf("Ignoring transport: %s", err)
+	} else {
+		fp.lkConfig.Lock()
+		fp.Config.Transport = config.Transport
+		fp.lkConfig.Unlock()
+	}
+
 	for _, tagConfig := range config.BleTags {
+		if err := tagConfig.Gatttool.Validate(); err != nil {
+			btlog.Errorf("Ignoring tag %s gatttool options: %s", tagConfig.Address, err)
+			tagConfig.Gatttool = nil
+		}
 		btlog.Infof("NewBLETagFromConfig address=%s", tagConfig.Address)
 		NewBLETagFromConfig(fp, tagConfig) // NOTE: This also saves it to the configuration
 	}
@@ -84,7 +126,23 @@ func (fp *BLETagDriver) Stop() error {
 	return nil
 }
 
-func (fp *BLETagDriver) saveNewTag(address string, publicAddress bool, readChar *bluez.Characteristic, alertChar *bluez.Characteristic) {
+// gattOptions returns the driver's gatttool options, with the tag's overrides.
+func (fp *BLETagDriver) gattOptions(override *bluez.Options) *bluez.Options {
+	fp.lkConfig.Lock()
+	defer fp.lkConfig.Unlock()
+	return fp.Config.Gatttool.Override(override)
+}
+
+func (fp *BLETagDriver) transportKind() string {
+	fp.lkConfig.Lock()
+	defer fp.lkConfig.Unlock()
+	if fp.Config.Transport == "" {
+		return transportBluez
+	}
+	return fp.Config.Transport
+}
+
+func (fp *BLETagDriver) saveNewTag(address string, publicAddress bool, readChar *bluez.Characteristic, alertChar *bluez.Characteristic, info *DeviceInformation, options *bluez.Options) {
 
 	fp.lkConfig.Lock()
 
@@ -96,11 +154,15 @@ func (fp *BLETagDriver) saveNewTag(address string, publicAddress bool, readChar
 		Address:              address,
 		PublicAddress:        publicAddress,
 		ReadUUID:             readChar.UUID,
-		ReadHandle:           readChar.Handle,
-		ReadCharValueHandle:  readChar.CharValueHandle,
+		ReadHandle:           bluez.FormatHandle(readChar.Handle),
+		ReadCharValueHandle:  bluez.FormatHandle(readChar.CharValueHandle),
+		ReadProperties:       readChar.Properties,
 		AlertUUID:            alertChar.UUID,
-		AlertHandle:          alertChar.Handle,
-		AlertCharValueHandle: alertChar.CharValueHandle,
+		AlertHandle:          bluez.FormatHandle(alertChar.Handle),
+		AlertCharValueHandle: bluez.FormatHandle(alertChar.CharValueHandle),
+		AlertProperties:      alertChar.Properties,
+		Info:                 info,
+		Gatttool:             options,
 	}
 
 	// replace in the list
@@ -126,6 +188,12 @@ func (fp *BLETagDriver) saveNewTag(address string, publicAddress bool, readChar
 // Config is persisted by HomeCloud, and provided when the app starts.
 type Config struct {
 	BleTags []*BleTagConfig `json:"bleTags"`
+
+	// Gatttool selects the adapter and security level used to talk to the tags, nil for the defaults.
+	Gatttool *bluez.Options `json:"gatttool,omitempty"`
+
+	// Transport is how we talk to the tags, bluez (the default) or gatt.
+	Transport string `json:"transport,omitempty"`
 }
 
 // BleTagConfig is persisted by HomeCloud, and provided when the app starts.
@@ -133,11 +201,18 @@ type BleTagConfig struct {
 	Address       string `json:"address"`
 	PublicAddress bool   `json:"publicAddress"`
 
-	ReadUUID            string `json:"readUUID"`
-	ReadHandle          string `json:"readHandle"`
-	ReadCharValueHandle string `json:"readCharValueHandle"`
+	ReadUUID            string           `json:"readUUID"`
+	ReadHandle          string           `json:"readHandle"`
+	ReadCharValueHandle string           `json:"readCharValueHandle"`
+	ReadProperties      bluez.Properties `json:"readProperties,omitempty"`
+
+	AlertUUID            string           `json:"alertUUID"`
+	AlertHandle          string           `json:"alertHandle"`
+	AlertCharValueHandle string           `json:"alertCharValueHandle"`
+	AlertProperties      bluez.Properties `json:"alertProperties,omitempty"`
+
+	Info *DeviceInformation `json:"info,omitempty"`
 
-	AlertUUID            string `json:"alertUUID"`
-	AlertHandle          string `json:"alertHandle"`
-	AlertCharValueHandle string `json:"alertCharValueHandle"`
+	// Gatttool overrides the driver's options for this tag, eg. a higher security level.
+	Gatttool *bluez.Options `json:"gatttool,omitempty"`
 }
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+	"github.com/ninjasphere/gatt"
+)
+
+const (
+	transportGatt  = "gatt"  // the gatt client, which shares the radio with scanning
+	transportBluez = "bluez" // gatttool or D-Bus, as chosen by the bluez options
+)
+
+var (
+	errNotConnected           = errors.New("Not connected")
+	errDisconnectNotSupported = errors.New("The gatt client can't disconnect")
+)
+
+// Transport is a connection to a single device. FlowerPowers and waypoints have always used
+// the gatt client, and tags bluez, but each driver can be configured to use either.
+type Transport interface {
+	// Connect returns once the device is connected, after the Connected event has been sent.
+	Connect(ctx context.Context) error
+
+	// Discover lists the device's characteristics. Over the gatt client this is done with bluez,
+	// so must happen while the client isn't connected, as most devices only accept one connection.
+	Discover(ctx context.Context) ([]*bluez.Characteristic, error)
+
+	// Read reads the value with the given handle. Over the gatt client, reads before it has
+	// connected go through bluez, as discovery does.
+	Read(ctx context.Context, handle uint16) ([]byte, error)
+
+	// Write writes the characteristic's value with a write request, returning an error if the
+	// device rejects it, unless the characteristic only supports writes without response. The gatt
+	// client can't report the device's response, so a readable value is read back instead.
+	Write(ctx context.Context, char *bluez.Characteristic, value []byte) error
+
+	// Subscribe enables or disables notifications from the characteristic declared at start,
+	// whose descriptors run up to end.
+	Subscribe(ctx context.Context, start, end uint16, enable bool) error
+
+	// Disconnect closes the connection, after which the Disconnected event is sent.
+	Disconnect() error
+}
+
+// transportEvents are called by a transport as the connection comes and goes, and notifications
+// arrive. Any of them may be nil.
+type transportEvents struct {
+	Connected    func()
+	Disconnected func()
+	Notification func(notification *gatt.Notification)
+}
+
+func (e transportEvents) connected() {
+	if e.Connected != nil {
+		e.Connected()
+	}
+}
+
+func (e transportEvents) disconnected() {
+	if e.Disconnected != nil {
+		e.Disconnected()
+	}
+}
+
+func (e transportEvents) notification(notification *gatt.Notification) {
+	if e.Notification != nil {
+		e.Notification(notification)
+	}
+}
+
+// newTransport creates a transport of the given kind. Over the gatt client, characteristics are
+// still discovered with bluez, which must happen while the client isn't connected.
+func newTransport(kind string, client *gatt.Client, address string, publicAddress bool, options *bluez.Options, events transportEvents) (Transport, error) {
+
+	cmd, err := bluez.New(address, addrType(publicAddress), options)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "", transportGatt:
+		return newGattTransport(client, address, publicAddress, cmd, events), nil
+
+	case transportBluez:
+		session, err := bluez.NewSession(address, addrType(publicAddress), options)
+		if err != nil {
+			return nil, err
+		}
+		return newBluezTransport(cmd, session, events), nil
+	}
+
+	return nil, fmt.Errorf("Unknown transport %q", kind)
+}
+
+// validateTransport checks a configured transport, empty is the driver's default.
+func validateTransport(kind string) error {
+	switch kind {
+	case "", transportGatt, transportBluez:
+		return nil
+	}
+	return fmt.Errorf("Invalid transport %q, expected gatt or bluez", kind)
+}
+
+// gattClient is the part of the shared gatt client a transport uses, replaced by the tests.
+type gattClient interface {
+	Connect(address string, publicAddress bool) error
+	ReadByHandle(address string, handle uint16) chan []byte
+	SendRawCommands(address string, cmds []string)
+	Notify(address string, enable bool, start, end uint16, useNotify, useIndicate bool)
+}
+
+// gattTransport uses the shared gatt client. The client reports the connection through the
+// device it discovered, so the transport must be attached to each device it is advertised as.
+type gattTransport struct {
+	sync.Mutex
+	client        gattClient
+	address       string
+	publicAddress bool
+	discovery     bluez.Gatt
+	events        transportEvents
+	connected     bool
+	connecting    chan struct{} // closed when the client reports the connection
+}
+
+func newGattTransport(client gattClient, address string, publicAddress bool, discovery bluez.Gatt, events transportEvents) *gattTransport {
+	return &gattTransport{
+		client:        client,
+		address:       address,
+		publicAddress: publicAddress,
+		discovery:     discovery,
+		events:        events,
+	}
+}
+
+// attach takes over the device's callbacks.
+func (t *gattTransport) attach(device *gatt.DiscoveredDevice) {
+	device.Connected = t.deviceConnected
+	device.Disconnected = t.deviceDisconnected
+	device.Notification = t.events.notification
+}
+
+func (t *gattTransport) deviceConnected() {
+	t.Lock()
+	t.connected = true
+	if t.connecting != nil {
+		close(t.connecting)
+		t.connecting = nil
+	}
+	t.Unlock()
+
+	t.events.connected()
+}
+
+func (t *gattTransport) deviceDisconnected() {
+	t.Lock()
+	t.connected = false
+	t.Unlock()
+
+	t.events.disconnected()
+}
+
+func (t *gattTransport) isConnected() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.connected
+}
+
+func (t *gattTransport) Connect(ctx context.Context) error {
+
+	t.Lock()
+	if t.connected {
+		t.Unlock()
+		return nil
+	}
+	if t.connecting == nil {
+		t.connecting = make(chan struct{})
+	}
+	connecting := t.connecting
+	t.Unlock()
+
+	if err := t.client.Connect(t.address, t.publicAddress); err != nil {
+		return err
+	}
+
+	select {
+	case <-connecting:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Failed to connect to %s: %s", t.address, ctx.Err())
+	}
+}
+
+func (t *gattTransport) Discover(ctx context.Context) ([]*bluez.Characteristic, error) {
+	return t.discovery.ReadCharacteristics(ctx)
+}
+
+func (t *gattTransport) Read(ctx context.Context, handle uint16) ([]byte, error) {
+
+	if !t.isConnected() {
+		return t.discovery.ReadCharacteristic(ctx, handle)
+	}
+
+	return t.readConnected(ctx, handle)
+}
+
+// readConnected reads over the gatt client, never bluez, which can't connect alongside it.
+func (t *gattTransport) readConnected(ctx context.Context, handle uint16) ([]byte, error) {
+	select {
+	case data := <-t.client.ReadByHandle(t.address, handle):
+		return data, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Timed out reading handle %d", handle)
+	}
+}
+
+// Write sends the write over the connected gatt client. The client only sends raw packets, so
+// when the value is readable it is read back to check the device took it.
+func (t *gattTransport) Write(ctx context.Context, char *bluez.Characteristic, value []byte) error {
+
+	if !t.isConnected() {
+		return errNotConnected
+	}
+
+	if char.Properties.Has(bluez.PropWriteWithoutResponse) && !char.Properties.Has(bluez.PropWrite) {
+		t.client.SendRawCommands(t.address, []string{attWriteCommand(char.CharValueHandle, value)})
+		return nil
+	}
+
+	t.client.SendRawCommands(t.address, []string{attWriteRequest(char.CharValueHandle, value)})
+
+	if !char.Properties.Has(bluez.PropRead) {
+		return nil
+	}
+
+	written, err := t.readConnected(ctx, char.CharValueHandle)
+	if err != nil {
+		return fmt.Errorf("Failed to check write to %s: %s", bluez.FormatHandle(char.CharValueHandle), err)
+	}
+
+	if !bytes.Equal(written, value) {
+		return fmt.Errorf("Write to %s failed, wrote % X but read back % X", bluez.FormatHandle(char.CharValueHandle), value, written)
+	}
+
+	return nil
+}
+
+func (t *gattTransport) Subscribe(ctx context.Context, start, end uint16, enable bool) error {
+
+	if !t.isConnected() {
+		return errNotConnected
+	}
+
+	t.client.Notify(t.address, enable, start, end, true, false)
+	return nil
+}
+
+func (t *gattTransport) Disconnect() error {
+	return errDisconnectNotSupported
+}
+
+// notificationListener is implemented by the bluez backends which can receive notifications.
+type notificationListener interface {
+	Listen(ctx context.Context, cccdHandle uint16, indicate bool) (*bluez.Listener, error)
+}
+
+// descriptorReader is implemented by the bluez backends which can discover descriptors.
+type descriptorReader interface {
+	ReadDescriptors(ctx context.Context, start, end uint16) ([]*bluez.Descriptor, error)
+}
+
+// bluezTransport connects on demand for each command, and keeps a listener running for each
+// subscription.
+type bluezTransport struct {
+	sync.Mutex
+	cmd       bluez.Gatt
+	session   bluez.Gatt
+	events    transportEvents
+	connected bool
+	listeners map[uint16]*bluez.Listener // by characteristic declaration handle
+}
+
+func newBluezTransport(cmd, session bluez.Gatt, events transportEvents) *bluezTransport {
+	return &bluezTransport{
+		cmd:       cmd,
+		session:   session,
+		events:    events,
+		listeners: make(map[uint16]*bluez.Listener),
+	}
+}
+
+// Connect only marks the transport as connected, bluez connects as needed, so a missing device
+// is reported by the first read or write.
+func (t *bluezTransport) Connect(ctx context.Context) error {
+	t.Lock()
+	connected := t.connected
+	t.connected = true
+	t.Unlock()
+
+	if !connected {
+		t.events.connected()
+	}
+	return nil
+}
+
+func (t *bluezTransport) Discover(ctx context.Context) ([]*bluez.Characteristic, error) {
+	return t.cmd.ReadCharacteristics(ctx)
+}
+
+func (t *bluezTransport) Read(ctx context.Context, handle uint16) ([]byte, error) {
+	return t.session.ReadCharacteristic(ctx, handle)
+}
+
+func (t *bluezTransport) Write(ctx context.Context, char *bluez.Characteristic, value []byte) error {
+	return t.session.Write(ctx, char, fmt.Sprintf("%x", value))
+}
+
+func (t *bluezTransport) Subscribe(ctx context.Context, start, end uint16, enable bool) error {
+
+	t.Lock()
+	existing := t.listeners[start]
+	delete(t.listeners, start)
+	t.Unlock()
+
+	if existing != nil {
+		existing.Close()
+	}
+
+	if !enable {
+		return nil
+	}
+
+	l, ok := t.cmd.(notificationListener)
+	if !ok {
+		return fmt.Errorf("Notifications aren't supported by %T", t.cmd)
+	}
+
+	cccd, err := t.clientConfiguration(ctx, start, end)
+	if err != nil {
+		return err
+	}
+
+	// the listener outlives the context, it runs until it is unsubscribed
+	listener, err := l.Listen(context.Background(), cccd, false)
+	if err != nil {
+		return err
+	}
+
+	t.Lock()
+	t.listeners[start] = listener
+	t.Unlock()
+
+	go func() {
+		for notification := range listener.Notifications {
+			t.events.notification(&gatt.Notification{Handle: notification.Handle, Data: notification.Value})
+		}
+		if err := listener.Err(); err != nil {
+			log.Warningf("Stopped listening to handle %d: %s", start, err)
+		}
+	}()
+
+	return nil
+}
+
+// clientConfiguration finds the characteristic's client configuration descriptor, assuming it
+// directly follows the value if the descriptors can't be discovered.
+func (t *bluezTransport) clientConfiguration(ctx context.Context, start, end uint16) (uint16, error) {
+
+	reader, ok := t.cmd.(descriptorReader)
+	if !ok {
+		return start + 2, nil
+	}
+
+	descriptors, err := reader.ReadDescriptors(ctx, start+2, end)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, descriptor := range descriptors {
+		if descriptor.UUID == bluez.ClientCharacteristicConfigurationUUID {
+			return descriptor.Handle, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Characteristic %s has no client configuration descriptor", bluez.FormatHandle(start))
+}
+
+func (t *bluezTransport) Disconnect() error {
+
+	t.Lock()
+	listeners := t.listeners
+	t.listeners = make(map[uint16]*bluez.Listener)
+	connected := t.connected
+	t.connected = false
+	t.Unlock()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	if closer, ok := t.session.(interface {
+		Close() error
+	}); ok {
+		closer.Close()
+	}
+
+	if connected {
+		t.events.disconnected()
+	}
+	return nil
+}
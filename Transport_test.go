@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+	"github.com/ninjasphere/driver-go-blecombined/bluez/gatttooltest"
+	"github.com/ninjasphere/gatt"
+)
+
+// the test binary doubles as the fake gatttool for the bluez transport
+func TestMain(m *testing.M) {
+	gatttooltest.Main()
+	os.Exit(m.Run())
+}
+
+// fakeTransport is an in-memory device, with a value for each handle.
+type fakeTransport struct {
+	sync.Mutex
+	chars      []*bluez.Characteristic
+	values     map[uint16][]byte
+	rejected   map[uint16]error // the error response to writes
+	subscribed map[uint16]bool  // by characteristic declaration handle
+	writes     []string
+	connected  bool
+	events     transportEvents
+}
+
+func newFakeTransport(chars ...*bluez.Characteristic) *fakeTransport {
+	return &fakeTransport{
+		chars:      chars,
+		values:     make(map[uint16][]byte),
+		rejected:   make(map[uint16]error),
+		subscribed: make(map[uint16]bool),
+	}
+}
+
+func (f *fakeTransport) Connect(ctx context.Context) error {
+	f.Lock()
+	connected := f.connected
+	f.connected = true
+	f.Unlock()
+
+	if !connected {
+		f.events.connected()
+	}
+	return nil
+}
+
+func (f *fakeTransport) Discover(ctx context.Context) ([]*bluez.Characteristic, error) {
+	return f.chars, nil
+}
+
+func (f *fakeTransport) Read(ctx context.Context, handle uint16) ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	value, ok := f.values[handle]
+	if !ok {
+		return nil, fmt.Errorf("No value for handle %d", handle)
+	}
+	return value, nil
+}
+
+func (f *fakeTransport) Write(ctx context.Context, char *bluez.Characteristic, value []byte) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if !f.connected {
+		return errNotConnected
+	}
+
+	f.writes = append(f.writes, fmt.Sprintf("%s=%x", bluez.FormatHandle(char.CharValueHandle), value))
+	if err := f.rejected[char.CharValueHandle]; err != nil {
+		return err
+	}
+	f.values[char.CharValueHandle] = value
+	return nil
+}
+
+func (f *fakeTransport) Subscribe(ctx context.Context, start, end uint16, enable bool) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if !f.connected {
+		return errNotConnected
+	}
+
+	f.subscribed[start] = enable
+	return nil
+}
+
+func (f *fakeTransport) Disconnect() error {
+	f.Lock()
+	connected := f.connected
+	f.connected = false
+	f.Unlock()
+
+	if connected {
+		f.events.disconnected()
+	}
+	return nil
+}
+
+var fakeFlowerPowerChars = []*bluez.Characteristic{
+	{UUID: "00002a00-0000-1000-8000-00805f9b34fb", Handle: 0x0002, CharValueHandle: 0x0003, Properties: bluez.PropRead},
+	{UUID: "39e1fa01-84a8-11e2-afba-0002a5d5c51b", Handle: 0x0024, CharValueHandle: 0x0025, Properties: bluez.PropRead | bluez.PropNotify},
+	{UUID: "39e1fa06-84a8-11e2-afba-0002a5d5c51b", Handle: 0x0038, CharValueHandle: 0x0039, Properties: bluez.PropRead | bluez.PropWrite},
+	{UUID: "39e1fc01-84a8-11e2-afba-0002a5d5c51b", Handle: 0x0050, CharValueHandle: 0x0051, Properties: bluez.PropRead},
+}
+
+func newFakeFlowerPower(t *testing.T) (*FlowerPower, *fakeTransport) {
+	transport := newFakeTransport(fakeFlowerPowerChars...)
+
+	fp := &FlowerPower{transport: transport, gattDevice: &gatt.DiscoveredDevice{Address: "A0:14:3D:08:B4:90"}}
+	transport.events = transportEvents{
+		Connected:    fp.deviceConnected,
+		Disconnected: fp.deviceDisconnected,
+	}
+
+	chars, err := transport.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.handles = newGattHandles(chars)
+
+	return fp, transport
+}
+
+func TestFlowerPowerTransport(t *testing.T) {
+
+	fp, transport := newFakeFlowerPower(t)
+
+	if err := fp.EnableLiveMode(); err != errNotConnected {
+		t.Errorf("expected live mode to need a connection, got %v", err)
+	}
+
+	if err := transport.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !fp.connected {
+		t.Errorf("expected the connected event")
+	}
+
+	if err := fp.EnableLiveMode(); err != nil {
+		t.Fatal(err)
+	}
+
+	transport.values[0x0051] = []byte{0x34, 0x12, 0xff}
+	nbEntries, err := fp.readUint(historyNbEntriesUuid, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nbEntries != 0x1234 {
+		t.Errorf("expected 0x1234 entries, got %#x", nbEntries)
+	}
+
+	rejected := &bluez.Error{Kind: bluez.ErrSecurity, Op: "char-write-req", Output: "Characteristic Write Request failed: Attribute requires authentication before read/write"}
+	transport.rejected[0x0039] = rejected
+	if err := fp.DisableLiveMode(); err != rejected {
+		t.Errorf("expected the device's error response, got %v", err)
+	}
+
+	expected := []string{"0x0039=01", "0x0039=00"}
+	if fmt.Sprint(transport.writes) != fmt.Sprint(expected) {
+		t.Errorf("expected writes %v, got %v", expected, transport.writes)
+	}
+
+	sunlight, err := fp.handles.get(sunlightUuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.subscribe(sunlight, true); err != nil {
+		t.Fatal(err)
+	}
+	if !transport.subscribed[0x0024] {
+		t.Errorf("expected the sunlight to be subscribed")
+	}
+
+	if err := transport.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if fp.connected {
+		t.Errorf("expected the disconnected event")
+	}
+}
+
+func TestFlowerPowerStaleHandles(t *testing.T) {
+
+	fp, transport := newFakeFlowerPower(t)
+	transport.Connect(context.Background())
+
+	// a refused write doesn't mean the handles have changed
+	transport.rejected[0x0039] = &bluez.Error{Kind: bluez.ErrSecurity, Op: "char-write-req"}
+	if err := fp.EnableLiveMode(); err == nil {
+		t.Fatal("expected live mode to fail")
+	}
+	if fp.staleHandles {
+		t.Errorf("expected a security error to keep the handles")
+	}
+
+	transport.rejected[0x0039] = &bluez.Error{Kind: bluez.ErrInvalidHandle, Op: "char-write-req"}
+	if err := fp.EnableLiveMode(); err == nil {
+		t.Fatal("expected live mode to fail")
+	}
+	if fp.currentHandles() == nil || !fp.staleHandles {
+		t.Errorf("expected the handles to be kept until we disconnect")
+	}
+
+	transport.Disconnect()
+
+	if fp.currentHandles() != nil || fp.staleHandles {
+		t.Errorf("expected the handles to be forgotten once disconnected")
+	}
+}
+
+func TestReadDeviceInformation(t *testing.T) {
+
+	transport := newFakeTransport(fakeFlowerPowerChars...)
+
+	// nothing is cached until the name has been read, so it is tried again
+	if info := readDeviceInformation(context.Background(), transport, fakeFlowerPowerChars); info != nil {
+		t.Errorf("expected no information when the name couldn't be read, got %+v", info)
+	}
+
+	transport.values[0x0003] = []byte("Flower power B490\x00\x00")
+
+	info := readDeviceInformation(context.Background(), transport, fakeFlowerPowerChars)
+
+	if info == nil || info.Name != "Flower power B490" {
+		t.Errorf("bad information %+v", info)
+	}
+}
+
+func TestTagAlert(t *testing.T) {
+
+	alertChar := &bluez.Characteristic{UUID: stickNFindWriteUUID, Handle: 0x0024, CharValueHandle: 0x0025, Properties: bluez.PropWriteWithoutResponse}
+
+	transport := newFakeTransport(alertChar)
+	tag := &BLETag{transport: transport, alertChar: alertChar}
+
+	if err := tag.alert(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(transport.values[0x0025], []byte{0x01, 0x03}) {
+		t.Errorf("expected the alert to be written, got % X", transport.values[0x0025])
+	}
+}
+
+func TestBluezTransportNotifications(t *testing.T) {
+
+	path, cleanup := gatttooltest.Use(t, "bluez/testdata/listen.txt")
+	defer cleanup()
+
+	cmd, err := bluez.NewGattCmd("F6:5F:20:4C:B0:DB", bluez.AddrTypeRandom, &bluez.Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan *gatt.Notification, 2)
+	transport := newBluezTransport(cmd, cmd, transportEvents{Notification: func(notification *gatt.Notification) {
+		received <- notification
+	}})
+
+	ctx := context.Background()
+
+	transport.Connect(ctx)
+	if err := transport.Subscribe(ctx, 0x002b, 0x002d, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []byte{0x01, 0x02} {
+		select {
+		case notification := <-received:
+			if notification.Handle != 0x002c || !bytes.Equal(notification.Data, []byte{expected, 0x00}) {
+				t.Errorf("unexpected notification %+v", notification)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for notification %d", expected)
+		}
+	}
+
+	transport.Subscribe(ctx, 0x002b, 0x002d, false)
+
+	transport.Lock()
+	listeners := len(transport.listeners)
+	transport.Unlock()
+
+	if listeners != 0 {
+		t.Errorf("expected unsubscribing to stop the listener")
+	}
+}
+
+// fakeGattClient records the raw commands sent to the device, storing written values unless
+// ignoreWrites is set, and answers reads with the stored values.
+type fakeGattClient struct {
+	commands     []string
+	values       map[uint16][]byte
+	ignoreWrites bool
+}
+
+func (f *fakeGattClient) Connect(address string, publicAddress bool) error {
+	return nil
+}
+
+func (f *fakeGattClient) ReadByHandle(address string, handle uint16) chan []byte {
+	result := make(chan []byte, 1)
+	result <- f.values[handle]
+	return result
+}
+
+func (f *fakeGattClient) SendRawCommands(address string, cmds []string) {
+	for _, cmd := range cmds {
+		f.commands = append(f.commands, cmd)
+		packet, _ := hex.DecodeString(cmd)
+		if f.ignoreWrites || len(packet) < 3 {
+			continue
+		}
+		f.values[uint16(packet[1])|uint16(packet[2])<<8] = packet[3:]
+	}
+}
+
+func (f *fakeGattClient) Notify(address string, enable bool, start, end uint16, useNotify, useIndicate bool) {
+}
+
+func TestGattTransportWrite(t *testing.T) {
+
+	client := &fakeGattClient{values: map[uint16][]byte{}}
+	transport := newGattTransport(client, "A0:14:3D:08:B4:90", false, nil, transportEvents{})
+
+	liveMode := &bluez.Characteristic{Handle: 0x0038, CharValueHandle: 0x0039, Properties: bluez.PropRead | bluez.PropWrite}
+
+	if err := transport.Write(context.Background(), liveMode, []byte{0x01}); err != errNotConnected {
+		t.Errorf("expected the write to need a connection, got %v", err)
+	}
+
+	transport.deviceConnected()
+
+	if err := transport.Write(context.Background(), liveMode, []byte{0x01}); err != nil {
+		t.Fatal(err)
+	}
+
+	client.ignoreWrites = true
+	if err := transport.Write(context.Background(), liveMode, []byte{0x00}); err == nil {
+		t.Errorf("expected an error when the value doesn't change")
+	}
+
+	alert := &bluez.Characteristic{Handle: 0x0024, CharValueHandle: 0x0025, Properties: bluez.PropWriteWithoutResponse}
+	if err := transport.Write(context.Background(), alert, []byte{0x02}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"12390001", "12390000", "52250002"}
+	if fmt.Sprint(client.commands) != fmt.Sprint(expected) {
+		t.Errorf("expected commands %v, got %v", expected, client.commands)
+	}
+}
+
+func TestValidateTransport(t *testing.T) {
+	for _, kind := range []string{"", transportGatt, transportBluez} {
+		if err := validateTransport(kind); err != nil {
+			t.Errorf("expected %q to be valid: %s", kind, err)
+		}
+	}
+
+	if err := validateTransport("hci"); err == nil {
+		t.Errorf("expected an unknown transport to be invalid")
+	}
+
+	if _, err := newTransport("hci", nil, "F6:5F:20:4C:B0:DB", false, nil, transportEvents{}); err == nil {
+		t.Errorf("expected an unknown transport to fail")
+	}
+}
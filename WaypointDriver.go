@@ -1,14 +1,15 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
+	"context"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ninjasphere/go-ninja/logger"
 
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
 	"github.com/ninjasphere/gatt"
 	"github.com/ninjasphere/go-ninja/api"
 	"github.com/ninjasphere/go-ninja/model"
@@ -17,51 +18,111 @@ import (
 
 var wplog = logger.GetLogger("driver-go-waypoint")
 
-type waypointPayload struct {
-	Sequence    uint8
-	AddressType uint8
-	Rssi        int8
-	Valid       uint8
-}
-
-type adPacket struct {
-	Device   string `json:"device"`
-	Waypoint string `json:"waypoint"`
-	Rssi     int8   `json:"rssi"`
-	IsSphere bool   `json:"isSphere"`
-}
-
 type ninjaPacket struct {
 	Device   string `json:"device"`
 	Waypoint string `json:"waypoint"`
 	Rssi     int8   `json:"rssi"`
 	IsSphere bool   `json:"isSphere"`
 	name     string `json:"name,omitempty"`
+
+	// AddressType is public or random, empty if the sphere didn't say.
+	AddressType string `json:"addressType,omitempty"`
+
+	// Distance is in metres, give or take the accuracy. Both are left out if the rssi isn't usable.
+	Distance float64 `json:"distance,omitempty"`
+	Accuracy float64 `json:"accuracy,omitempty"`
 }
 
 type WaypointDriver struct {
 	conn            *ninja.Connection
 	sendEvent       func(event string, payload interface{}) error
+	notify          func(topic string, payload interface{}) error // SendNotification, replaced by the tests
 	client          *gatt.Client
 	activeWaypoints map[string]bool
+	transports      map[string]Transport
+	lkLinks         sync.Mutex
+	links           map[string]*ScheduledConnection // nil while the connection is queued
+	filters         *RssiFilters
+	policy          *RssiPolicy
+	distance        *DistanceEstimator
+	sequences       *waypointSequences
+	location        *LocationEngine
 	running         bool
+	lkConfig        sync.Mutex
+	Config          *WaypointConfig
+}
+
+// WaypointConfig is persisted by HomeCloud, and provided when the app starts.
+type WaypointConfig struct {
+	// Transport is how we talk to the waypoints, gatt (the default) or bluez.
+	Transport string `json:"transport,omitempty"`
+
+	// Gatttool selects the adapter and security level used by the bluez transport, nil for the defaults.
+	Gatttool *bluez.Options `json:"gatttool,omitempty"`
+
+	// Rooms names the room each waypoint is in, by address. Waypoints without a room are their own zone.
+	Rooms map[string]string `json:"rooms,omitempty"`
+
+	// RssiFilter smooths the samples before they are published, nil for a short moving median.
+	RssiFilter *RssiFilterConfig `json:"rssiFilter,omitempty"`
+
+	// RssiPolicy limits how often the rssi is published, nil for the defaults.
+	RssiPolicy *RssiPolicyConfig `json:"rssiPolicy,omitempty"`
+
+	// Calibration is each device's measured power at 1m, by address, for devices which don't advertise it.
+	Calibration map[string]*DistanceCalibration `json:"calibration,omitempty"`
+
+	// PathLoss is the path loss exponent for the distance estimates, zero for free space.
+	PathLoss float64 `json:"pathLoss,omitempty"`
+}
+
+// deviceKey identifies a device by its address and type. A random address can be the same as a
+// public one, they are different devices, but an unknown type is taken to be public.
+func deviceKey(device, addressType string) string {
+	device = normaliseAddress(device)
+	if addressType == bluez.AddrTypeRandom {
+		device += "/" + addressType
+	}
+	return device
 }
 
-func (w *WaypointDriver) sendRssi(device string, name string, waypoint string, rssi int8, isSphere bool) {
+func (w *WaypointDriver) sendRssi(device string, name string, waypoint string, rssi int8, addressType string, isSphere bool) {
 	device = strings.ToUpper(device)
 
-	wplog.Infof(">> Device:%s Waypoint:%s Rssi: %d", device, waypoint, rssi)
+	key := deviceKey(device, addressType)
 
-	ninjaPacket := ninjaPacket{
-		Device:   device,
-		Waypoint: waypoint,
-		Rssi:     rssi,
-		IsSphere: isSphere,
-		name:     name,
+	rssi, ok := w.filters.Filter(key, waypoint, rssi, time.Now())
+	if !ok {
+		wplog.Debugf("Dropped outlier Device:%s Waypoint:%s", device, waypoint)
+		return
 	}
 
-	w.conn.SendNotification("$device/"+device+"/TEMPPATH/rssi", ninjaPacket)
+	// the location engine wants every sample, only the bus is spared
+	if w.policy.Allow(device, addressType, waypoint, rssi, time.Now()) {
+		wplog.Debugf(">> Device:%s Waypoint:%s Rssi: %d", device, waypoint, rssi)
 
+		ninjaPacket := ninjaPacket{
+			Device:   device,
+			Waypoint: waypoint,
+			Rssi:     rssi,
+			IsSphere: isSphere,
+			name:     name,
+
+			AddressType: addressType,
+		}
+		ninjaPacket.Distance, ninjaPacket.Accuracy = w.distance.Estimate(device, addressType, rssi)
+
+		w.notify("$device/"+device+"/TEMPPATH/rssi", ninjaPacket)
+	}
+
+	w.sendZoneEvents(w.location.Add(device, addressType, waypoint, rssi, time.Now()))
+}
+
+func (w *WaypointDriver) sendZoneEvents(events []*ZoneEvent) {
+	for _, event := range events {
+		wplog.Infof("Device %s %s zone %s", event.Device, event.Event, event.Zone)
+		w.notify("$device/"+event.Device+"/TEMPPATH/zone", event)
+	}
 }
 
 func NewWaypointDriver(client *gatt.Client) (*WaypointDriver, error) {
@@ -77,7 +138,19 @@ func NewWaypointDriver(client *gatt.Client) (*WaypointDriver, error) {
 		conn:            conn,
 		client:          client,
 		activeWaypoints: make(map[string]bool),
+		transports:      make(map[string]Transport),
+		links:           make(map[string]*ScheduledConnection),
+		filters:         NewRssiFilters(nil),
+		policy:          NewRssiPolicy(nil),
+		distance:        NewDistanceEstimator(),
+		sequences:       newWaypointSequences(),
+		location:        NewLocationEngine(),
 		running:         true,
+		Config:          &WaypointConfig{},
+	}
+
+	myWaypointDriver.notify = func(topic string, payload interface{}) error {
+		return conn.SendNotification(topic, payload)
 	}
 
 	err = conn.ExportDriver(myWaypointDriver)
@@ -87,6 +160,14 @@ func NewWaypointDriver(client *gatt.Client) (*WaypointDriver, error) {
 		return nil, err
 	}
 
+	advertisements.Register("waypoint", &AdvertisementMatcher{
+		LocalName: regexp.MustCompile("^" + waypointLocalName + "$"),
+	}, myWaypointDriver.handleSphereWaypoint)
+
+	advertisements.Register("distance", &AdvertisementMatcher{
+		ManufacturerDataPrefix: iBeaconPrefix,
+	}, myWaypointDriver.distance.handleAdvertisement)
+
 	myWaypointDriver.startWaypointLoop()
 
 	return myWaypointDriver, nil
@@ -94,6 +175,7 @@ func NewWaypointDriver(client *gatt.Client) (*WaypointDriver, error) {
 
 func (w *WaypointDriver) startWaypointLoop() {
 	go func() {
+		lastStats := time.Now()
 		for {
 			time.Sleep(1 * time.Second)
 			if w.running == true {
@@ -105,6 +187,22 @@ func (w *WaypointDriver) startWaypointLoop() {
 					}
 				}
 				w.conn.PublishRaw("$location/waypoints", numWaypoints)
+				w.conn.PublishRaw("$location/connection-queue", connections.QueueDepth())
+				w.sendZoneEvents(w.location.Expire(time.Now()))
+				w.filters.Expire(time.Now())
+				w.policy.Expire(time.Now())
+
+				if time.Since(lastStats) > rssiStatsInterval {
+					stats := w.policy.Stats()
+					wplog.Infof("Rssi packets sent: %d suppressed: %d", stats.Sent, stats.Suppressed)
+
+					waypoints := w.sequences.Stats()
+					for _, waypoint := range sortedWaypoints(waypoints) {
+						stats := waypoints[waypoint]
+						wplog.Infof("Waypoint %s reports received: %d lost: %d duplicates: %d invalid: %d", waypoint, stats.Received, stats.Lost, stats.Duplicates, stats.Invalid)
+					}
+					lastStats = time.Now()
+				}
 			}
 		}
 	}()
@@ -112,55 +210,134 @@ func (w *WaypointDriver) startWaypointLoop() {
 
 func (w *WaypointDriver) handleSphereWaypoint(device *gatt.DiscoveredDevice) {
 	if w.running {
+		wplog.Infof("Found waypoint %s", device.Address)
 		if w.activeWaypoints[device.Address] == true {
 			wplog.Infof("waypoint %s already handled", device.Address)
 			return
 		}
 
-		if device.Advertisement.LocalName != "NinjaSphereWaypoint" {
+		if device.Advertisement.LocalName != waypointLocalName {
 			wplog.Infof("device %s not actually sphere waypoint", device.Advertisement.LocalName)
 			return
 		}
 
-		if device.Connected == nil {
-			device.Connected = func() {
-				wplog.Infof("Connected to waypoint: %s", device.Address)
-				w.client.Notify(device.Address, true, waypointStartHandle, waypointEndHandle, true, false)
-				w.activeWaypoints[device.Address] = true
+		transport, ok := w.transports[device.Address]
+		if !ok {
+			var err error
+			transport, err = w.newTransport(device)
+			if err != nil {
+				wplog.Errorf("Failed to create waypoint %s transport: %s", device.Address, err)
+				return
+			}
+			w.transports[device.Address] = transport
+		}
+
+		if t, ok := transport.(*gattTransport); ok {
+			t.attach(device)
+		}
+
+		w.lkLinks.Lock()
+		_, connecting := w.links[device.Address]
+		if !connecting {
+			w.links[device.Address] = nil
+		}
+		w.lkLinks.Unlock()
+
+		if connecting {
+			wplog.Infof("waypoint %s already connecting", device.Address)
+			return
+		}
+
+		wplog.Infof("Connecting to sphere waypoint %s", device.PublicAddress)
+
+		// we are called from the advertisement, which the gatt client needs back to connect
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), connectionQueueTimeout)
+			defer cancel()
+
+			link, err := connections.Connect(ctx, PriorityWaypoint, device.Address, transport)
+
+			w.lkLinks.Lock()
+			defer w.lkLinks.Unlock()
+
+			if err != nil {
+				wplog.Errorf("Connect error:%s", err)
+				delete(w.links, device.Address)
+				return
 			}
 
-			device.Disconnected = func() {
-				wplog.Infof("Disconnected from waypoint: %s", device.Address)
-				w.activeWaypoints[device.Address] = false
+			if _, ok := w.links[device.Address]; !ok {
+				// disconnected before we got here
+				link.Release()
+				return
 			}
+			w.links[device.Address] = link
+		}()
+	}
+}
 
-			device.Notification = func(notification *gatt.Notification) {
+func (w *WaypointDriver) newTransport(device *gatt.DiscoveredDevice) (Transport, error) {
 
-				var payload waypointPayload
-				err := binary.Read(bytes.NewReader(notification.Data), binary.LittleEndian, &payload)
-				if err != nil {
-					wplog.Errorf("Failed to read waypoint payload : %s", err)
-				}
+	var transport Transport
 
-				packet := &adPacket{
-					Device:   fmt.Sprintf("%x", reverse(notification.Data[4:])),
-					Waypoint: strings.Replace(device.Address, ":", "", -1),
-					Rssi:     payload.Rssi,
-					IsSphere: false,
-				}
+	events := transportEvents{
+		Connected: func() {
+			wplog.Infof("Connected to waypoint: %s", device.Address)
+			w.sequences.Reset(device.Address)
+			ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+			defer cancel()
+			if err := transport.Subscribe(ctx, waypointStartHandle, waypointEndHandle, true); err != nil {
+				wplog.Errorf("Failed to subscribe to waypoint %s: %s", device.Address, err)
+			}
+			w.activeWaypoints[device.Address] = true
+		},
+
+		Disconnected: func() {
+			wplog.Infof("Disconnected from waypoint: %s", device.Address)
+			w.activeWaypoints[device.Address] = false
+
+			w.lkLinks.Lock()
+			link := w.links[device.Address]
+			delete(w.links, device.Address)
+			w.lkLinks.Unlock()
 
-				w.sendRssi(packet.Device, "", packet.Waypoint, packet.Rssi, packet.IsSphere)
+			link.Release()
+		},
+
+		Notification: func(notification *gatt.Notification) {
+
+			report, err := decodeWaypointReport(notification.Data)
+			if err != nil {
+				wplog.Errorf("Failed to read waypoint %s report: %s", device.Address, err)
+				w.sequences.Invalid(device.Address)
+				return
 			}
-		}
 
-		err := w.client.Connect(device.Address, device.PublicAddress)
-		wplog.Infof("Connecting to sphere waypoint %s", device.PublicAddress)
-		if err != nil {
-			wplog.Errorf("Connect error:%s", err)
-			return
-		}
+			lost, ok := w.sequences.Track(device.Address, report.Sequence)
+			if !ok {
+				wplog.Debugf("Dropped repeated report %d from waypoint %s", report.Sequence, device.Address)
+				return
+			}
+			if lost > 0 {
+				wplog.Debugf("Waypoint %s lost %d reports before %d", device.Address, lost, report.Sequence)
+			}
+
+			if !report.Valid {
+				wplog.Debugf("Dropped invalid report %d from waypoint %s", report.Sequence, device.Address)
+				w.sequences.Invalid(device.Address)
+				return
+			}
 
+			w.sendRssi(report.Device, "", strings.Replace(device.Address, ":", "", -1), report.Rssi, report.AddressType, false)
+		},
 	}
+
+	w.lkConfig.Lock()
+	kind, options := w.Config.Transport, w.Config.Gatttool
+	w.lkConfig.Unlock()
+
+	transport, err := newTransport(kind, w.client, device.Address, device.PublicAddress, options, events)
+	return transport, err
 }
 
 func (d *WaypointDriver) GetModuleInfo() *model.Module {
@@ -171,8 +348,54 @@ func (d *WaypointDriver) SetEventHandler(sendEvent func(event string, payload in
 	d.sendEvent = sendEvent
 }
 
-func (w *WaypointDriver) Start() error {
+func (w *WaypointDriver) Start(config *WaypointConfig) error {
 	wplog.Infof("Starting waypoint driver")
+
+	if config != nil {
+		if err := config.Gatttool.Validate(); err != nil {
+			wplog.Errorf("Ignoring gatttool options: %s", err)
+			config.Gatttool = nil
+		}
+		if err := validateTransport(config.Transport); err != nil {
+			wplog.Errorf("Ignoring transport: %s", err)
+			config.Transport = ""
+		}
+		if err := config.RssiFilter.Validate(); err != nil {
+			wplog.Errorf("Ignoring rssi filter: %s", err)
+			config.RssiFilter = nil
+		}
+		if config.RssiPolicy != nil {
+			for device, override := range config.RssiPolicy.Devices {
+				if err := config.RssiPolicy.ValidateOverride(override); err != nil {
+					wplog.Errorf("Ignoring rssi policy for %s: %s", device, err)
+					delete(config.RssiPolicy.Devices, device)
+				}
+			}
+		}
+		if err := config.RssiPolicy.Validate(); err != nil {
+			wplog.Errorf("Ignoring rssi policy: %s", err)
+			config.RssiPolicy = nil
+		}
+		if err := validatePathLoss(config.PathLoss); err != nil {
+			wplog.Errorf("Ignoring path loss: %s", err)
+			config.PathLoss = 0
+		}
+		for device, calibration := range config.Calibration {
+			if err := calibration.Validate(); err != nil {
+				wplog.Errorf("Ignoring calibration for %s: %s", device, err)
+				delete(config.Calibration, device)
+			}
+		}
+		w.lkConfig.Lock()
+		w.Config = config
+		w.lkConfig.Unlock()
+
+		w.location.SetRooms(config.Rooms)
+		w.filters.Configure(config.RssiFilter)
+		w.policy.Configure(config.RssiPolicy)
+		w.distance.SetCalibration(config.Calibration, config.PathLoss)
+	}
+
 	w.running = true
 	return nil
 }
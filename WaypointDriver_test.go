@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+)
+
+// newTestWaypointDriver returns a driver which records the notifications it sends.
+func newTestWaypointDriver(policy *RssiPolicyConfig) (*WaypointDriver, *[]string) {
+	sent := []string{}
+	w := &WaypointDriver{
+		filters:   NewRssiFilters(nil),
+		policy:    NewRssiPolicy(policy),
+		distance:  NewDistanceEstimator(),
+		sequences: newWaypointSequences(),
+		location:  NewLocationEngine(),
+		Config:    &WaypointConfig{},
+		notify: func(topic string, payload interface{}) error {
+			sent = append(sent, topic)
+			return nil
+		},
+	}
+	return w, &sent
+}
+
+func TestSendRssiRandomAddressOverride(t *testing.T) {
+
+	w, sent := newTestWaypointDriver(&RssiPolicyConfig{
+		MinInterval: 60000,
+		Heartbeat:   60000,
+		Devices: map[string]*RssiPolicyConfig{
+			"f6:5f:20:4c:b0:db": {MinInterval: 1, MinChange: 0.1, Heartbeat: 1},
+		},
+	})
+
+	for _, rssi := range []int8{-60, -64} {
+		w.sendRssi("f65f204cb0db", "", "112233445566", rssi, bluez.AddrTypeRandom, true)
+		w.sendRssi("aabbccddeeff", "", "112233445566", rssi, bluez.AddrTypeRandom, true)
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	counts := map[string]int{}
+	for _, topic := range *sent {
+		if strings.HasSuffix(topic, "/TEMPPATH/rssi") {
+			counts[topic]++
+		}
+	}
+
+	if counts["$device/F65F204CB0DB/TEMPPATH/rssi"] != 2 {
+		t.Errorf("expected the random address to follow its device's policy, got %v", *sent)
+	}
+	if counts["$device/AABBCCDDEEFF/TEMPPATH/rssi"] != 1 {
+		t.Errorf("expected the other device to keep the driver's policy, got %v", *sent)
+	}
+}
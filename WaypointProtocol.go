@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+)
+
+// The waypoint notifies a report for each advertisement it hears: the header, then the
+// advertiser's address, least significant byte first.
+const (
+	waypointHeaderLength  = 4
+	waypointAddressLength = 6
+	waypointReportLength  = waypointHeaderLength + waypointAddressLength
+
+	waypointAddressPublic = 0
+	waypointAddressRandom = 1
+)
+
+type waypointPayload struct {
+	Sequence    uint8
+	AddressType uint8
+	Rssi        int8
+	Valid       uint8
+}
+
+// waypointReport is a decoded waypoint notification.
+type waypointReport struct {
+	Sequence    uint8
+	AddressType string // bluez.AddrTypePublic or bluez.AddrTypeRandom
+	Rssi        int8
+	Valid       bool
+	Device      string // the address, as hex without colons
+}
+
+// decodeWaypointReport decodes a waypoint notification. Anything after the address is ignored,
+// so later firmware can add to the report.
+func decodeWaypointReport(data []byte) (*waypointReport, error) {
+
+	if len(data) < waypointReportLength {
+		return nil, fmt.Errorf("Short waypoint report, expected %d bytes, got %d", waypointReportLength, len(data))
+	}
+
+	var payload waypointPayload
+	if err := binary.Read(bytes.NewReader(data[:waypointHeaderLength]), binary.LittleEndian, &payload); err != nil {
+		return nil, err
+	}
+
+	report := &waypointReport{
+		Sequence: payload.Sequence,
+		Rssi:     payload.Rssi,
+		Valid:    payload.Valid != 0,
+		Device:   fmt.Sprintf("%x", reverse(data[waypointHeaderLength:waypointReportLength])),
+	}
+
+	switch payload.AddressType {
+	case waypointAddressPublic:
+		report.AddressType = bluez.AddrTypePublic
+	case waypointAddressRandom:
+		report.AddressType = bluez.AddrTypeRandom
+	default:
+		return nil, fmt.Errorf("Unknown waypoint address type %d", payload.AddressType)
+	}
+
+	return report, nil
+}
+
+// WaypointPacketStats counts the reports from a waypoint since it connected.
+type WaypointPacketStats struct {
+	Received   uint64 `json:"received"`
+	Lost       uint64 `json:"lost"` // skipped sequence numbers
+	Duplicates uint64 `json:"duplicates"`
+	Invalid    uint64 `json:"invalid"` // undecodable, or marked not valid by the waypoint
+}
+
+type waypointSequence struct {
+	last  uint8
+	heard bool
+	stats WaypointPacketStats
+}
+
+// waypointSequences follows the sequence numbers of each waypoint's reports, to measure how many
+// are lost on the way.
+type waypointSequences struct {
+	sync.Mutex
+	waypoints map[string]*waypointSequence
+}
+
+func newWaypointSequences() *waypointSequences {
+	return &waypointSequences{waypoints: make(map[string]*waypointSequence)}
+}
+
+// get must be called with the lock held.
+func (s *waypointSequences) get(waypoint string) *waypointSequence {
+	waypoint = normaliseAddress(waypoint)
+	sequence, ok := s.waypoints[waypoint]
+	if !ok {
+		sequence = &waypointSequence{}
+		s.waypoints[waypoint] = sequence
+	}
+	return sequence
+}
+
+// Track records a report's sequence number, returning how many reports were missed before it,
+// and false if it is a repeat of the last one.
+func (s *waypointSequences) Track(waypoint string, sequence uint8) (int, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	w := s.get(waypoint)
+
+	lost := 0
+	if w.heard {
+		if sequence == w.last {
+			w.stats.Duplicates++
+			return 0, false
+		}
+		lost = int(sequence - w.last - 1) // wraps at 256
+	}
+
+	w.last, w.heard = sequence, true
+	w.stats.Received++
+	w.stats.Lost += uint64(lost)
+
+	return lost, true
+}
+
+// Invalid counts a report which couldn't be used.
+func (s *waypointSequences) Invalid(waypoint string) {
+	s.Lock()
+	defer s.Unlock()
+	s.get(waypoint).stats.Invalid++
+}
+
+// Reset starts the waypoint's sequence and counters again, eg. when it reconnects.
+func (s *waypointSequences) Reset(waypoint string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.waypoints, normaliseAddress(waypoint))
+}
+
+// Stats returns the counters by waypoint.
+func (s *waypointSequences) Stats() map[string]WaypointPacketStats {
+	s.Lock()
+	defer s.Unlock()
+
+	stats := make(map[string]WaypointPacketStats)
+	for waypoint, sequence := range s.waypoints {
+		stats[waypoint] = sequence.stats
+	}
+	return stats
+}
+
+// sortedWaypoints returns the waypoints in the stats in order, for logging.
+func sortedWaypoints(stats map[string]WaypointPacketStats) []string {
+	waypoints := []string{}
+	for waypoint := range stats {
+		waypoints = append(waypoints, waypoint)
+	}
+	sort.Strings(waypoints)
+	return waypoints
+}
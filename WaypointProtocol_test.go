@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez"
+)
+
+func TestDecodeWaypointReport(t *testing.T) {
+
+	report, err := decodeWaypointReport([]byte{0x07, 0x01, 0xc4, 0x01, 0xdb, 0xb0, 0x4c, 0x20, 0x5f, 0xf6})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := waypointReport{Sequence: 7, AddressType: bluez.AddrTypeRandom, Rssi: -60, Valid: true, Device: "f65f204cb0db"}
+	if *report != expected {
+		t.Errorf("expected %+v, got %+v", expected, *report)
+	}
+
+	// extra bytes are for later firmware
+	report, err = decodeWaypointReport([]byte{0x08, 0x00, 0xc4, 0x00, 0xdb, 0xb0, 0x4c, 0x20, 0x5f, 0xf6, 0xff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.AddressType != bluez.AddrTypePublic || report.Valid || report.Device != "f65f204cb0db" {
+		t.Errorf("unexpected report %+v", *report)
+	}
+
+	for _, data := range [][]byte{
+		nil,
+		{0x07, 0x01, 0xc4, 0x01},
+		{0x07, 0x01, 0xc4, 0x01, 0xdb, 0xb0, 0x4c, 0x20, 0x5f},
+		{0x07, 0x02, 0xc4, 0x01, 0xdb, 0xb0, 0x4c, 0x20, 0x5f, 0xf6},
+	} {
+		if _, err := decodeWaypointReport(data); err == nil {
+			t.Errorf("expected % x to be rejected", data)
+		}
+	}
+}
+
+func TestWaypointSequences(t *testing.T) {
+
+	s := newWaypointSequences()
+
+	for _, step := range []struct {
+		sequence uint8
+		lost     int
+		ok       bool
+	}{
+		{250, 0, true},
+		{251, 0, true},
+		{251, 0, false}, // repeated
+		{254, 2, true},
+		{1, 2, true}, // wrapped
+	} {
+		lost, ok := s.Track("88:c2:55:ca:e9:4a", step.sequence)
+		if lost != step.lost || ok != step.ok {
+			t.Errorf("sequence %d: expected %d lost %t, got %d %t", step.sequence, step.lost, step.ok, lost, ok)
+		}
+	}
+
+	s.Invalid("88C255CAE94A")
+
+	expected := WaypointPacketStats{Received: 4, Lost: 4, Duplicates: 1, Invalid: 1}
+	if stats := s.Stats()["88C255CAE94A"]; stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+
+	s.Reset("88:c2:55:ca:e9:4a")
+	if lost, ok := s.Track("88:c2:55:ca:e9:4a", 100); lost != 0 || !ok {
+		t.Errorf("expected a reconnected waypoint to start again, got %d %t", lost, ok)
+	}
+}
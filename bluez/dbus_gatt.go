@@ -0,0 +1,550 @@
+package bluez
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+// BlueZ exports each device it knows about, and once connected its services, characteristics
+// and descriptors, named after their handles:
+//
+// /org/bluez/hci0/dev_F6_5F_20_4C_B0_DB/service0028/char002b/desc002d
+
+const (
+	bluezBusName            = "org.bluez"
+	bluezAdapter            = "org.bluez.Adapter1"
+	bluezDevice             = "org.bluez.Device1"
+	bluezGattService        = "org.bluez.GattService1"
+	bluezGattCharacteristic = "org.bluez.GattCharacteristic1"
+	bluezGattDescriptor     = "org.bluez.GattDescriptor1"
+
+	dbusObjectManager = "org.freedesktop.DBus.ObjectManager"
+	dbusProperties    = "org.freedesktop.DBus.Properties"
+
+	defaultAdapter = "hci0"
+
+	servicesResolvedPoll = time.Millisecond * 100
+	disconnectTimeout    = time.Second * 5
+)
+
+// the characteristic flags BlueZ reports, in Properties bit order
+var flagProperties = map[string]Properties{
+	"broadcast":                   PropBroadcast,
+	"read":                        PropRead,
+	"write-without-response":      PropWriteWithoutResponse,
+	"write":                       PropWrite,
+	"notify":                      PropNotify,
+	"indicate":                    PropIndicate,
+	"authenticated-signed-writes": PropAuthenticatedSignedWrites,
+	"extended-properties":         PropExtendedProperties,
+}
+
+// D-Bus errors which mean we aren't allowed, rather than something going wrong.
+var dbusSecurityErrors = map[string]bool{
+	"org.bluez.Error.NotPermitted":            true,
+	"org.bluez.Error.NotAuthorized":           true,
+	"org.bluez.Error.AuthenticationFailed":    true,
+	"org.bluez.Error.AuthenticationRejected":  true,
+	"org.bluez.Error.AuthenticationCanceled":  true,
+	"org.freedesktop.DBus.Error.AccessDenied": true,
+}
+
+type managedObjects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+
+// DBusGatt talks to a device through bluetoothd over D-Bus, instead of running gatttool.
+// The device must already be known to BlueZ, ie. it has been seen by a BlueZ scan. Like a
+// gatttool command, each method connects if the device isn't already connected and disconnects
+// again when it's done, unless it is a session.
+type DBusGatt struct {
+	baddr          string
+	adapterAddress string          // the adapter's address from the options, until its path is found
+	devicePath     dbus.ObjectPath // empty until the adapter is found
+	session        bool            // stay connected between commands
+	conn           *dbus.Conn      // the system bus, replaced by the tests
+}
+
+// NewDBusGatt create a D-Bus gatt handler, the adapter is taken from the options.
+func NewDBusGatt(baddr string, options *Options) (*DBusGatt, error) {
+
+	if !addressRegex.MatchString(baddr) {
+		return nil, fmt.Errorf("Invalid address %q", baddr)
+	}
+
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	d := &DBusGatt{baddr: baddr}
+
+	switch {
+	case options == nil || options.Adapter == "":
+		d.devicePath = devicePath(defaultAdapter, baddr)
+	case adapterRegex.MatchString(options.Adapter):
+		d.devicePath = devicePath(options.Adapter, baddr)
+	default:
+		d.adapterAddress = options.Adapter
+	}
+
+	return d, nil
+}
+
+// NewDBusSession is NewDBusGatt, but the device is left connected between commands.
+func NewDBusSession(baddr string, options *Options) (*DBusGatt, error) {
+	d, err := NewDBusGatt(baddr, options)
+	if err != nil {
+		return nil, err
+	}
+	d.session = true
+	return d, nil
+}
+
+func devicePath(adapter, baddr string) dbus.ObjectPath {
+	return dbus.ObjectPath("/org/bluez/" + adapter + "/dev_" + strings.Replace(strings.ToUpper(baddr), ":", "_", -1))
+}
+
+// ReadCharacteristics lists the device's characteristics, connecting if we aren't already.
+func (d *DBusGatt) ReadCharacteristics(ctx context.Context) ([]*Characteristic, error) {
+
+	disconnect, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+
+	objects, err := d.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chars := []*Characteristic{}
+
+	for objectPath, ifaces := range objects {
+		props, ok := ifaces[bluezGattCharacteristic]
+		if !ok || !d.owns(objectPath) {
+			continue
+		}
+
+		handle, err := pathHandle(objectPath, "char")
+		if err != nil {
+			return nil, parseError("ReadCharacteristics", string(objectPath), err)
+		}
+
+		char := &Characteristic{
+			UUID:   variantString(props["UUID"]),
+			Handle: handle,
+			// the value always follows the declaration
+			CharValueHandle: handle + 1,
+		}
+
+		if flags, ok := props["Flags"].Value().([]string); ok {
+			for _, flag := range flags {
+				char.Properties |= flagProperties[flag]
+			}
+		}
+
+		chars = append(chars, char)
+	}
+
+	sort.Sort(charsByHandle(chars))
+
+	return chars, nil
+}
+
+// ReadPrimaryServices lists the device's primary services. BlueZ doesn't tell us where a
+// service ends, so it is taken to be just before the next one starts.
+func (d *DBusGatt) ReadPrimaryServices(ctx context.Context) ([]*Service, error) {
+
+	disconnect, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+
+	objects, err := d.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	services := []*Service{}
+
+	for objectPath, ifaces := range objects {
+		props, ok := ifaces[bluezGattService]
+		if !ok || !d.owns(objectPath) {
+			continue
+		}
+
+		if primary, ok := props["Primary"].Value().(bool); ok && !primary {
+			continue
+		}
+
+		start, err := pathHandle(objectPath, "service")
+		if err != nil {
+			return nil, parseError("ReadPrimaryServices", string(objectPath), err)
+		}
+
+		services = append(services, &Service{UUID: variantString(props["UUID"]), StartHandle: start})
+	}
+
+	sort.Sort(servicesByHandle(services))
+
+	for i, service := range services {
+		service.EndHandle = 0xffff
+		if i+1 < len(services) {
+			service.EndHandle = services[i+1].StartHandle - 1
+		}
+	}
+
+	return services, nil
+}
+
+// ReadDescriptors lists the descriptors with handles between start and end.
+func (d *DBusGatt) ReadDescriptors(ctx context.Context, start, end uint16) ([]*Descriptor, error) {
+
+	disconnect, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+
+	objects, err := d.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptors := []*Descriptor{}
+
+	for objectPath, ifaces := range objects {
+		props, ok := ifaces[bluezGattDescriptor]
+		if !ok || !d.owns(objectPath) {
+			continue
+		}
+
+		handle, err := pathHandle(objectPath, "desc")
+		if err != nil {
+			return nil, parseError("ReadDescriptors", string(objectPath), err)
+		}
+
+		if handle >= start && handle <= end {
+			descriptors = append(descriptors, &Descriptor{UUID: variantString(props["UUID"]), Handle: handle})
+		}
+	}
+
+	sort.Sort(descriptorsByHandle(descriptors))
+
+	return descriptors, nil
+}
+
+// ReadCharacteristic reads the characteristic with the given value handle.
+func (d *DBusGatt) ReadCharacteristic(ctx context.Context, handle uint16) ([]byte, error) {
+
+	disconnect, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+
+	charPath, err := d.characteristicPath(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+
+	call, err := d.call(ctx, charPath, bluezGattCharacteristic+".ReadValue", map[string]dbus.Variant{})
+	if err != nil {
+		return nil, err
+	}
+
+	value := []byte{}
+	if err := call.Store(&value); err != nil {
+		return nil, parseError("ReadValue", string(charPath), err)
+	}
+
+	return value, nil
+}
+
+// WriteCharacteristic writes a hex value to the characteristic, without waiting for a response.
+func (d *DBusGatt) WriteCharacteristic(ctx context.Context, handle uint16, value string) error {
+	return d.writeValue(ctx, handle, value, "command")
+}
+
+// WriteCharacteristicRequest writes a hex value to the characteristic, waiting for the device to confirm it.
+func (d *DBusGatt) WriteCharacteristicRequest(ctx context.Context, handle uint16, value string) error {
+	return d.writeValue(ctx, handle, value, "request")
+}
+
+// Write writes a value to the characteristic, as a request if it supports them, so the write is
+// confirmed, or as a command if it only supports writes without response.
+func (d *DBusGatt) Write(ctx context.Context, char *Characteristic, value string) error {
+
+	request, err := useWriteRequest(char)
+	if err != nil {
+		return err
+	}
+
+	if request {
+		return d.WriteCharacteristicRequest(ctx, char.CharValueHandle, value)
+	}
+	return d.WriteCharacteristic(ctx, char.CharValueHandle, value)
+}
+
+func (d *DBusGatt) writeValue(ctx context.Context, handle uint16, value, writeType string) error {
+
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("Invalid value %q: %s", value, err)
+	}
+
+	disconnect, err := d.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	charPath, err := d.characteristicPath(ctx, handle)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.call(ctx, charPath, bluezGattCharacteristic+".WriteValue", data, map[string]dbus.Variant{
+		"type": dbus.MakeVariant(writeType),
+	})
+
+	return err
+}
+
+// characteristicPath finds the object for the characteristic with the given value handle.
+func (d *DBusGatt) characteristicPath(ctx context.Context, handle uint16) (dbus.ObjectPath, error) {
+
+	objects, err := d.resolve(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for objectPath, ifaces := range objects {
+		if _, ok := ifaces[bluezGattCharacteristic]; !ok || !d.owns(objectPath) {
+			continue
+		}
+		if declaration, err := pathHandle(objectPath, "char"); err == nil && declaration+1 == handle {
+			return objectPath, nil
+		}
+	}
+
+	return "", &Error{Kind: ErrInvalidHandle, Op: "characteristic", Err: fmt.Errorf("No characteristic with value handle %s on %s", FormatHandle(handle), d.baddr)}
+}
+
+// connect connects to the device if it isn't already, returning a function which disconnects
+// again unless this is a session, or the device was already connected, eg. by a session.
+func (d *DBusGatt) connect(ctx context.Context) (func(), error) {
+
+	if d.devicePath == "" {
+		if err := d.findAdapter(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	connected, err := d.deviceProperty(ctx, "Connected")
+	if err != nil {
+		return nil, err
+	}
+
+	if connected, _ := connected.Value().(bool); connected {
+		return func() {}, nil
+	}
+
+	log.Infof("Connecting to %s over D-Bus", d.baddr)
+	if _, err := d.call(ctx, d.devicePath, bluezDevice+".Connect"); err != nil {
+		return nil, err
+	}
+
+	if d.session {
+		return func() {}, nil
+	}
+
+	return func() {
+		// the command's context may be done already
+		ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+		defer cancel()
+
+		if _, err := d.call(ctx, d.devicePath, bluezDevice+".Disconnect"); err != nil {
+			log.Warningf("Failed to disconnect from %s: %s", d.baddr, err)
+		}
+	}, nil
+}
+
+// findAdapter finds the path of the adapter which was given by its address.
+func (d *DBusGatt) findAdapter(ctx context.Context) error {
+
+	objects, err := d.managedObjects(ctx)
+	if err != nil {
+		return err
+	}
+
+	for objectPath, ifaces := range objects {
+		if props, ok := ifaces[bluezAdapter]; ok && strings.EqualFold(variantString(props["Address"]), d.adapterAddress) {
+			d.devicePath = devicePath(path.Base(string(objectPath)), d.baddr)
+			return nil
+		}
+	}
+
+	return &Error{Op: "adapter", Err: fmt.Errorf("No adapter with address %s", d.adapterAddress)}
+}
+
+// resolve waits for BlueZ to discover the connected device's services, then returns everything
+// BlueZ has exported.
+func (d *DBusGatt) resolve(ctx context.Context) (managedObjects, error) {
+
+	for {
+		resolved, err := d.deviceProperty(ctx, "ServicesResolved")
+		if err != nil {
+			return nil, err
+		}
+
+		if resolved, _ := resolved.Value().(bool); resolved {
+			break
+		}
+
+		select {
+		case <-time.After(servicesResolvedPoll):
+		case <-ctx.Done():
+			return nil, newError(ctx, "ServicesResolved", "", ctx.Err())
+		}
+	}
+
+	return d.managedObjects(ctx)
+}
+
+func (d *DBusGatt) managedObjects(ctx context.Context) (managedObjects, error) {
+
+	call, err := d.call(ctx, "/", dbusObjectManager+".GetManagedObjects")
+	if err != nil {
+		return nil, err
+	}
+
+	objects := managedObjects{}
+	if err := call.Store(&objects); err != nil {
+		return nil, parseError("GetManagedObjects", "", err)
+	}
+
+	return objects, nil
+}
+
+func (d *DBusGatt) deviceProperty(ctx context.Context, name string) (dbus.Variant, error) {
+
+	call, err := d.call(ctx, d.devicePath, dbusProperties+".Get", bluezDevice, name)
+	if err != nil {
+		return dbus.Variant{}, err
+	}
+
+	var value dbus.Variant
+	if err := call.Store(&value); err != nil {
+		return dbus.Variant{}, parseError(name, "", err)
+	}
+
+	return value, nil
+}
+
+// call calls a BlueZ method, giving up if the context is done first.
+func (d *DBusGatt) call(ctx context.Context, objectPath dbus.ObjectPath, method string, args ...interface{}) (*dbus.Call, error) {
+
+	if d.conn == nil {
+		conn, err := dbus.SystemBus()
+		if err != nil {
+			return nil, newError(ctx, method, "", err)
+		}
+		d.conn = conn
+	}
+
+	log.Debugf("dbus %s %s %v", objectPath, method, args)
+
+	call := d.conn.Object(bluezBusName, objectPath).Go(method, 0, nil, args...)
+
+	select {
+	case call = <-call.Done:
+	case <-ctx.Done():
+		return nil, newError(ctx, method, "", ctx.Err())
+	}
+
+	if call.Err != nil {
+		return nil, dbusError(ctx, method, call.Err)
+	}
+
+	return call, nil
+}
+
+// owns returns true for the objects below the device.
+func (d *DBusGatt) owns(objectPath dbus.ObjectPath) bool {
+	return strings.HasPrefix(string(objectPath), string(d.devicePath)+"/")
+}
+
+// dbusError classifies a failed call by its D-Bus error name, and BlueZ's message.
+func dbusError(ctx context.Context, method string, err error) *Error {
+
+	name := ""
+	switch e := err.(type) {
+	case dbus.Error:
+		name = e.Name
+	case *dbus.Error:
+		name = e.Name
+	}
+
+	e := newError(ctx, method, name+": "+err.Error(), err)
+
+	switch {
+	case dbusSecurityErrors[name]:
+		e.Kind = ErrSecurity
+	case name == "org.freedesktop.DBus.Error.NoReply", name == "org.freedesktop.DBus.Error.Timeout":
+		e.Kind = ErrTimeout
+	case strings.Contains(err.Error(), "connection-refused"), strings.Contains(err.Error(), "abort-by-local"):
+		// eg. br-connection-refused, or le-connection-abort-by-local when the device isn't there
+		e.Kind = ErrConnectionRefused
+	}
+
+	return e
+}
+
+// pathHandle parses the handle from the last element of an object path, eg. char002b
+func pathHandle(objectPath dbus.ObjectPath, prefix string) (uint16, error) {
+
+	name := path.Base(string(objectPath))
+
+	if !strings.HasPrefix(name, prefix) {
+		return 0, fmt.Errorf("Expected %s in %s", prefix, objectPath)
+	}
+
+	handle, err := strconv.ParseUint(strings.TrimPrefix(name, prefix), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid handle in %s: %s", objectPath, err)
+	}
+
+	return uint16(handle), nil
+}
+
+func variantString(v dbus.Variant) string {
+	s, _ := v.Value().(string)
+	return s
+}
+
+type charsByHandle []*Characteristic
+
+func (b charsByHandle) Len() int           { return len(b) }
+func (b charsByHandle) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b charsByHandle) Less(i, j int) bool { return b[i].Handle < b[j].Handle }
+
+type servicesByHandle []*Service
+
+func (b servicesByHandle) Len() int           { return len(b) }
+func (b servicesByHandle) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b servicesByHandle) Less(i, j int) bool { return b[i].StartHandle < b[j].StartHandle }
+
+type descriptorsByHandle []*Descriptor
+
+func (b descriptorsByHandle) Len() int           { return len(b) }
+func (b descriptorsByHandle) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b descriptorsByHandle) Less(i, j int) bool { return b[i].Handle < b[j].Handle }
@@ -0,0 +1,409 @@
+package bluez
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+// The D-Bus tests run against a fake org.bluez, on a private bus started with dbus-daemon.
+
+const fakeBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+const (
+	fakeAdapterAddress = "00:1A:7D:DA:71:13"
+	fakeDevicePath     = "/org/bluez/hci0/dev_F6_5F_20_4C_B0_DB"
+)
+
+// fakeBluez is a device with a generic access service, and a service with a readable
+// characteristic and a writable one with a client configuration descriptor.
+type fakeBluez struct {
+	sync.Mutex
+	connected   bool
+	connects    int
+	disconnects int
+	value       []byte
+	written     [][]byte
+	types       []string
+}
+
+func (f *fakeBluez) objects() managedObjects {
+
+	variant := dbus.MakeVariant
+	service := func(uuid string) map[string]map[string]dbus.Variant {
+		return map[string]map[string]dbus.Variant{bluezGattService: {"UUID": variant(uuid), "Primary": variant(true)}}
+	}
+	char := func(uuid string, flags ...string) map[string]map[string]dbus.Variant {
+		return map[string]map[string]dbus.Variant{bluezGattCharacteristic: {"UUID": variant(uuid), "Flags": variant(flags)}}
+	}
+
+	return managedObjects{
+		"/org/bluez/hci0":                                   {bluezAdapter: {"Address": variant(fakeAdapterAddress)}},
+		fakeDevicePath:                                      {bluezDevice: {"Address": variant("F6:5F:20:4C:B0:DB")}},
+		fakeDevicePath + "/service0001":                     service("00001800-0000-1000-8000-00805f9b34fb"),
+		fakeDevicePath + "/service0001/char0002":            char("00002a00-0000-1000-8000-00805f9b34fb", "read"),
+		fakeDevicePath + "/service0028":                     service("39e1fa00-84a8-11e2-afba-0002a5d5c51b"),
+		fakeDevicePath + "/service0028/char0029":            char("39e1fa01-84a8-11e2-afba-0002a5d5c51b", "read", "notify"),
+		fakeDevicePath + "/service0028/char002b":            char("39e1fa06-84a8-11e2-afba-0002a5d5c51b", "read", "write"),
+		fakeDevicePath + "/service0028/char002b/desc002d":   {bluezGattDescriptor: {"UUID": variant(ClientCharacteristicConfigurationUUID)}},
+		fakeDevicePath + "/service0028/char002e":            char("39e1fa07-84a8-11e2-afba-0002a5d5c51b", "write-without-response"),
+		"/org/bluez/hci0/dev_11_22_33_44_55_66/service0010": service("0000180f-0000-1000-8000-00805f9b34fb"),
+	}
+}
+
+func (f *fakeBluez) export(t *testing.T, conn *dbus.Conn) {
+
+	exports := []struct {
+		path    dbus.ObjectPath
+		iface   string
+		methods map[string]interface{}
+	}{
+		{"/", dbusObjectManager, map[string]interface{}{
+			"GetManagedObjects": func() (managedObjects, *dbus.Error) {
+				return f.objects(), nil
+			},
+		}},
+		{fakeDevicePath, dbusProperties, map[string]interface{}{
+			"Get": func(iface, name string) (dbus.Variant, *dbus.Error) {
+				f.Lock()
+				defer f.Unlock()
+				switch name {
+				case "Connected", "ServicesResolved":
+					return dbus.MakeVariant(f.connected), nil
+				}
+				return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.InvalidArgs", []interface{}{"No such property " + name})
+			},
+		}},
+		{fakeDevicePath, bluezDevice, map[string]interface{}{
+			"Connect": func() *dbus.Error {
+				f.Lock()
+				defer f.Unlock()
+				f.connected = true
+				f.connects++
+				return nil
+			},
+			"Disconnect": func() *dbus.Error {
+				f.Lock()
+				defer f.Unlock()
+				f.connected = false
+				f.disconnects++
+				return nil
+			},
+		}},
+		{fakeDevicePath + "/service0028/char0029", bluezGattCharacteristic, map[string]interface{}{
+			"ReadValue": func(options map[string]dbus.Variant) ([]byte, *dbus.Error) {
+				return f.value, nil
+			},
+		}},
+		{fakeDevicePath + "/service0028/char002b", bluezGattCharacteristic, map[string]interface{}{
+			"ReadValue": func(options map[string]dbus.Variant) ([]byte, *dbus.Error) {
+				return nil, dbus.NewError("org.bluez.Error.NotPermitted", []interface{}{"Read not permitted"})
+			},
+			"WriteValue": f.writeValue,
+		}},
+		{fakeDevicePath + "/service0028/char002e", bluezGattCharacteristic, map[string]interface{}{
+			"ReadValue": func(options map[string]dbus.Variant) ([]byte, *dbus.Error) {
+				time.Sleep(time.Second)
+				return nil, nil
+			},
+			"WriteValue": f.writeValue,
+		}},
+	}
+
+	for _, e := range exports {
+		if err := conn.ExportMethodTable(e.methods, e.path, e.iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply, err := conn.RequestName(bluezBusName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("Failed to own %s: %v %v", bluezBusName, reply, err)
+	}
+}
+
+func (f *fakeBluez) writeValue(value []byte, options map[string]dbus.Variant) *dbus.Error {
+	f.Lock()
+	defer f.Unlock()
+	f.written = append(f.written, value)
+	f.types = append(f.types, variantString(options["type"]))
+	return nil
+}
+
+// startBus starts a private dbus-daemon, returning its address.
+func startBus(t *testing.T) (string, func()) {
+
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+
+	dir, err := ioutil.TempDir("", "bluez-dbus")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := filepath.Join(dir, "bus.conf")
+	if err := ioutil.WriteFile(config, []byte(fmt.Sprintf(fakeBusConfig, dir)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		cleanup()
+		t.Fatalf("Failed to read the bus address: %s", err)
+	}
+
+	return strings.TrimSpace(address), cleanup
+}
+
+func dialBus(t *testing.T, address string) *dbus.Conn {
+	conn, err := dbus.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Auth(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Hello(); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func newFakeDBusGatt(t *testing.T, options *Options) (*DBusGatt, *fakeBluez, func()) {
+
+	address, stop := startBus(t)
+
+	server := dialBus(t, address)
+	fake := &fakeBluez{value: []byte{0x01, 0x03}}
+	fake.export(t, server)
+
+	d, err := NewDBusGatt("F6:5F:20:4C:B0:DB", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.conn = dialBus(t, address)
+
+	return d, fake, func() {
+		d.conn.Close()
+		server.Close()
+		stop()
+	}
+}
+
+func TestNewDBusGatt(t *testing.T) {
+
+	d, err := NewDBusGatt("f6:5f:20:4c:b0:db", &Options{Adapter: "hci1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.devicePath != "/org/bluez/hci1/dev_F6_5F_20_4C_B0_DB" {
+		t.Errorf("Unexpected device path %s", d.devicePath)
+	}
+
+	if _, err := NewDBusGatt("F6:5F:20:4C:B0", nil); err == nil {
+		t.Error("Expected an invalid address to fail")
+	}
+}
+
+func TestDBusGattDiscovery(t *testing.T) {
+
+	d, fake, cleanup := newFakeDBusGatt(t, nil)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	chars, err := d.ReadCharacteristics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*Characteristic{
+		{UUID: "00002a00-0000-1000-8000-00805f9b34fb", Handle: 0x0002, CharValueHandle: 0x0003, Properties: PropRead},
+		{UUID: "39e1fa01-84a8-11e2-afba-0002a5d5c51b", Handle: 0x0029, CharValueHandle: 0x002a, Properties: PropRead | PropNotify},
+		{UUID: "39e1fa06-84a8-11e2-afba-0002a5d5c51b", Handle: 0x002b, CharValueHandle: 0x002c, Properties: PropRead | PropWrite},
+		{UUID: "39e1fa07-84a8-11e2-afba-0002a5d5c51b", Handle: 0x002e, CharValueHandle: 0x002f, Properties: PropWriteWithoutResponse},
+	}
+
+	if !reflect.DeepEqual(chars, expected) {
+		for _, char := range chars {
+			t.Logf("%+v", char)
+		}
+		t.Fatal("Unexpected characteristics")
+	}
+
+	services, err := d.ReadPrimaryServices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedServices := []*Service{
+		{UUID: "00001800-0000-1000-8000-00805f9b34fb", StartHandle: 0x0001, EndHandle: 0x0027},
+		{UUID: "39e1fa00-84a8-11e2-afba-0002a5d5c51b", StartHandle: 0x0028, EndHandle: 0xffff},
+	}
+
+	if !reflect.DeepEqual(services, expectedServices) {
+		for _, service := range services {
+			t.Logf("%+v", service)
+		}
+		t.Fatal("Unexpected services")
+	}
+
+	descriptors, err := d.ReadDescriptors(ctx, 0x002d, 0x002d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(descriptors) != 1 || *descriptors[0] != (Descriptor{UUID: ClientCharacteristicConfigurationUUID, Handle: 0x002d}) {
+		t.Fatalf("Unexpected descriptors %v", descriptors)
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+
+	// each command connects and disconnects again, like gatttool
+	if fake.connects != 3 || fake.disconnects != 3 || fake.connected {
+		t.Errorf("Expected to connect and disconnect 3 times, got %d and %d", fake.connects, fake.disconnects)
+	}
+}
+
+func TestDBusGattSession(t *testing.T) {
+
+	d, fake, cleanup := newFakeDBusGatt(t, nil)
+	defer cleanup()
+
+	d.session = true
+
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := d.ReadCharacteristic(ctx, 0x002a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+
+	if fake.connects != 1 || fake.disconnects != 0 {
+		t.Errorf("Expected a session to connect once and stay connected, got %d and %d", fake.connects, fake.disconnects)
+	}
+}
+
+func TestDBusGattAdapterAddress(t *testing.T) {
+
+	d, _, cleanup := newFakeDBusGatt(t, &Options{Adapter: strings.ToLower(fakeAdapterAddress)})
+	defer cleanup()
+
+	if _, err := d.ReadCharacteristic(context.Background(), 0x002a); err != nil {
+		t.Fatal(err)
+	}
+	if d.devicePath != fakeDevicePath {
+		t.Errorf("Expected the adapter to be found by its address, got %s", d.devicePath)
+	}
+
+	d, _, cleanup = newFakeDBusGatt(t, &Options{Adapter: "00:1A:7D:DA:71:14"})
+	defer cleanup()
+
+	if _, err := d.ReadCharacteristic(context.Background(), 0x002a); err == nil {
+		t.Error("Expected an unknown adapter address to fail")
+	}
+}
+
+func TestDBusGattReadWrite(t *testing.T) {
+
+	d, fake, cleanup := newFakeDBusGatt(t, nil)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	value, err := d.ReadCharacteristic(ctx, 0x002a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(value, []byte{0x01, 0x03}) {
+		t.Errorf("Unexpected value %x", value)
+	}
+
+	if err := d.Write(ctx, &Characteristic{Handle: 0x002b, CharValueHandle: 0x002c, Properties: PropWrite}, "0100"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write(ctx, &Characteristic{Handle: 0x002e, CharValueHandle: 0x002f, Properties: PropWriteWithoutResponse}, "ff"); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+
+	if !reflect.DeepEqual(fake.written, [][]byte{{0x01, 0x00}, {0xff}}) || !reflect.DeepEqual(fake.types, []string{"request", "command"}) {
+		t.Errorf("Unexpected writes %x %v", fake.written, fake.types)
+	}
+
+	if err := d.WriteCharacteristic(ctx, 0x002c, "zz"); err == nil {
+		t.Error("Expected an invalid value to fail")
+	}
+}
+
+func TestDBusGattErrors(t *testing.T) {
+
+	d, _, cleanup := newFakeDBusGatt(t, nil)
+	defer cleanup()
+
+	_, err := d.ReadCharacteristic(context.Background(), 0x002c)
+	if !IsSecurity(err) {
+		t.Errorf("Expected a security error, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	_, err = d.ReadCharacteristic(ctx, 0x002f)
+	if !IsTimeout(err) {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+
+	_, err = d.ReadCharacteristic(context.Background(), 0x0040)
+	if err == nil {
+		t.Error("Expected a missing characteristic to fail")
+	}
+}
@@ -0,0 +1,133 @@
+package bluez
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ErrorKind classifies why a gatttool command failed.
+type ErrorKind int
+
+const (
+	ErrUnknown ErrorKind = iota
+	ErrTimeout
+	ErrCanceled
+	ErrConnectionRefused
+	ErrSecurity // permission denied, or the link isn't authenticated/encrypted enough
+	ErrParse
+	ErrInvalidHandle // the device has no attribute with the handle, eg. after a firmware update
+	ErrDisconnected  // the link dropped during the command
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrTimeout:
+		return "timeout"
+	case ErrCanceled:
+		return "canceled"
+	case ErrConnectionRefused:
+		return "connection refused"
+	case ErrSecurity:
+		return "security"
+	case ErrParse:
+		return "parse"
+	case ErrInvalidHandle:
+		return "invalid handle"
+	case ErrDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// Error is returned by the GattCmd and GattSession methods.
+type Error struct {
+	Kind   ErrorKind
+	Op     string // the gatttool command, eg. --char-read
+	Output string // what gatttool printed, if anything
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s failed (%s): %s", e.Op, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s failed (%s): %s", e.Op, e.Kind, strings.TrimSpace(e.Output))
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsTimeout returns true if the command timed out, either on our deadline or gatttool's.
+func IsTimeout(err error) bool {
+	return kindOf(err) == ErrTimeout
+}
+
+// IsConnectionRefused returns true if the device refused the connection, usually because it's out of range.
+func IsConnectionRefused(err error) bool {
+	return kindOf(err) == ErrConnectionRefused
+}
+
+// IsSecurity returns true if the command failed on a permission or security level.
+func IsSecurity(err error) bool {
+	return kindOf(err) == ErrSecurity
+}
+
+// IsParse returns true if gatttool's output couldn't be understood.
+func IsParse(err error) bool {
+	return kindOf(err) == ErrParse
+}
+
+// IsDisconnected returns true if the link dropped during the command, even after reconnecting.
+func IsDisconnected(err error) bool {
+	return kindOf(err) == ErrDisconnected
+}
+
+// IsInvalidHandle returns true if the device has no attribute with the handle which was used.
+func IsInvalidHandle(err error) bool {
+	return kindOf(err) == ErrInvalidHandle
+}
+
+func kindOf(err error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return ErrUnknown
+}
+
+// newError classifies a failed command from the context and gatttool's output.
+func newError(ctx context.Context, op, output string, err error) *Error {
+
+	kind := ErrUnknown
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		kind, err = ErrTimeout, ctx.Err()
+	case ctx.Err() == context.Canceled:
+		kind, err = ErrCanceled, ctx.Err()
+	case strings.Contains(output, "Connection refused"):
+		kind = ErrConnectionRefused
+	case strings.Contains(output, "Connection timed out"):
+		kind = ErrTimeout
+	case strings.Contains(output, "Invalid handle"),
+		strings.Contains(output, "Attribute not found"):
+		kind = ErrInvalidHandle
+	case strings.Contains(output, "Permission denied"),
+		strings.Contains(output, "Operation not permitted"),
+		strings.Contains(output, "Insufficient"), // Authentication, Authorization or Encryption
+		strings.Contains(output, "requires authentication"),
+		strings.Contains(output, "requires authorization"),
+		strings.Contains(output, "requires encryption"), // BlueZ's att_ecode2str, "Attribute requires ... before read/write"
+		strings.Contains(output, "Encryption Key Size is insufficient"),
+		strings.Contains(output, "security"):
+		kind = ErrSecurity
+	}
+
+	return &Error{Kind: kind, Op: op, Output: output, Err: err}
+}
+
+// parseError is returned when the command succeeded, but its output didn't make sense.
+func parseError(op, output string, err error) *Error {
+	return &Error{Kind: ErrParse, Op: op, Output: output, Err: err}
+}
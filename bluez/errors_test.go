@@ -0,0 +1,66 @@
+package bluez
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewErrorKinds(t *testing.T) {
+	ctx := context.Background()
+	exit := errors.New("exit status 1")
+
+	outputs := map[string]ErrorKind{
+		"connect error: Connection refused (111)":                                                          ErrConnectionRefused,
+		"connect error: Connection timed out (110)":                                                        ErrTimeout,
+		"connect: Permission denied (13)":                                                                  ErrSecurity,
+		"Characteristic Write Request failed: Insufficient authentication":                                 ErrSecurity,
+		"Characteristic value/descriptor read failed: Attribute requires authentication before read/write": ErrSecurity,
+		"Characteristic value/descriptor read failed: Attribute requires authorization before read/write":  ErrSecurity,
+		"Characteristic Write Request failed: Attribute requires encryption before read/write":             ErrSecurity,
+		"Characteristic Write Request failed: Encryption Key Size is insufficient":                         ErrSecurity,
+		"Characteristic Write Request failed: Attribute can't be written":                                  ErrUnknown,
+		"Characteristic Write Request failed: Invalid handle":                                              ErrInvalidHandle,
+		"Read characteristics by UUID failed: Attribute not found":                                         ErrInvalidHandle,
+	}
+
+	for output, kind := range outputs {
+		if err := newError(ctx, "--char-write", output, exit); err.Kind != kind {
+			t.Errorf("expected %s from %q, got %s", kind, output, err.Kind)
+		}
+	}
+}
+
+func TestNewErrorContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	err := newError(ctx, "--char-read", "", errors.New("signal: killed"))
+	if !IsTimeout(err) {
+		t.Errorf("expected a timeout, got %s", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	if err := newError(ctx, "--char-read", "", errors.New("signal: killed")); err.Kind != ErrCanceled {
+		t.Errorf("expected canceled, got %s", err)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	start := time.Now()
+	_, err := run(ctx, "sleep", "5")
+
+	if !IsTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if time.Since(start) > time.Second*2 {
+		t.Errorf("expected the process to be killed on the deadline")
+	}
+}
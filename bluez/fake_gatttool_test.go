@@ -0,0 +1,43 @@
+package bluez
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ninjasphere/driver-go-blecombined/bluez/gatttooltest"
+)
+
+func TestMain(m *testing.M) {
+	gatttooltest.Main()
+	os.Exit(m.Run())
+}
+
+// useFakeGatttool returns the path of the fake gatttool, which will replay the named script from
+// testdata. Call the returned function to clean up.
+func useFakeGatttool(t *testing.T, script string) (string, func()) {
+	return gatttooltest.Use(t, filepath.Join("testdata", script))
+}
+
+func newFakeGattCmd(t *testing.T, script string) (*GattCmd, func()) {
+	path, cleanup := useFakeGatttool(t, script)
+	gc, err := NewGattCmd("F6:5F:20:4C:B0:DB", AddrTypeRandom, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc.path = path
+	return gc, cleanup
+}
+
+func newFakeGattSession(t *testing.T, script string) (*GattSession, func()) {
+	path, cleanup := useFakeGatttool(t, script)
+	s, err := NewGattSession("F6:5F:20:4C:B0:DB", AddrTypeRandom, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.path = path
+	return s, func() {
+		s.Close()
+		cleanup()
+	}
+}
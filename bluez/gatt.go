@@ -0,0 +1,63 @@
+package bluez
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	BackendGatttool = "gatttool"
+	BackendDBus     = "dbus"
+)
+
+// Gatt is what the drivers need to discover, read and write a device's characteristics. It is
+// implemented over gatttool by GattCmd and GattSession, and over D-Bus by DBusGatt.
+type Gatt interface {
+	ReadCharacteristics(ctx context.Context) ([]*Characteristic, error)
+	ReadCharacteristic(ctx context.Context, handle uint16) ([]byte, error)
+	WriteCharacteristic(ctx context.Context, handle uint16, value string) error
+	WriteCharacteristicRequest(ctx context.Context, handle uint16, value string) error
+	Write(ctx context.Context, char *Characteristic, value string) error
+}
+
+var (
+	_ Gatt = (*GattCmd)(nil)
+	_ Gatt = (*GattSession)(nil)
+	_ Gatt = (*DBusGatt)(nil)
+)
+
+// New creates a Gatt for the backend selected in the options, which may be nil for gatttool.
+func New(baddr, addrType string, options *Options) (Gatt, error) {
+	switch backend(options) {
+	case BackendDBus:
+		return NewDBusGatt(baddr, options)
+	default:
+		return NewGattCmd(baddr, addrType, options)
+	}
+}
+
+// NewSession is New, but the connection is kept open between commands. BlueZ does that for
+// us on D-Bus, over gatttool it is a GattSession.
+func NewSession(baddr, addrType string, options *Options) (Gatt, error) {
+	switch backend(options) {
+	case BackendDBus:
+		return NewDBusSession(baddr, options)
+	default:
+		return NewGattSession(baddr, addrType, options)
+	}
+}
+
+func backend(options *Options) string {
+	if options == nil || options.Backend == "" {
+		return BackendGatttool
+	}
+	return options.Backend
+}
+
+func validateBackend(backend string) error {
+	switch backend {
+	case "", BackendGatttool, BackendDBus:
+		return nil
+	}
+	return fmt.Errorf("Invalid backend %q, expected gatttool or dbus", backend)
+}
@@ -0,0 +1,178 @@
+package bluez
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// gatttool -b F6:5F:20:4C:B0:DB -t random -l medium --primary
+// attr handle = 0x0001, end grp handle = 0x0007 uuid: 00001800-0000-1000-8000-00805f9b34fb
+//
+// gatttool -b F6:5F:20:4C:B0:DB -t random -l medium --char-desc -s 0x002c -e 0x002d
+// handle = 0x002c, uuid = 8da71352-6804-4fc0-b8dd-34a5389ed0d0
+// handle = 0x002d, uuid = 00002902-0000-1000-8000-00805f9b34fb
+
+var (
+	serviceRegex    = regexp.MustCompile(`attr handle = ([0-9a-fx]+), end grp handle = ([0-9a-fx]+) uuid: ([0-9a-f-]+)`)
+	descriptorRegex = regexp.MustCompile(`^handle = ([0-9a-fx]+), uuid = ([0-9a-f-]+)$`)
+)
+
+// Attribute types which --char-desc lists along with the descriptors.
+const (
+	PrimaryServiceUUID   = "00002800-0000-1000-8000-00805f9b34fb"
+	SecondaryServiceUUID = "00002801-0000-1000-8000-00805f9b34fb"
+	IncludeUUID          = "00002802-0000-1000-8000-00805f9b34fb"
+	CharacteristicUUID   = "00002803-0000-1000-8000-00805f9b34fb"
+
+	// ClientCharacteristicConfigurationUUID is the descriptor written to enable notifications, see Listen.
+	ClientCharacteristicConfigurationUUID = "00002902-0000-1000-8000-00805f9b34fb"
+)
+
+// Properties is the characteristic properties bitmask.
+type Properties uint8
+
+const (
+	PropBroadcast Properties = 1 << iota
+	PropRead
+	PropWriteWithoutResponse
+	PropWrite
+	PropNotify
+	PropIndicate
+	PropAuthenticatedSignedWrites
+	PropExtendedProperties
+)
+
+var propertyNames = []string{"broadcast", "read", "write-without-response", "write", "notify", "indicate", "authenticated-signed-writes", "extended-properties"}
+
+// Has returns true if all of the given properties are set.
+func (p Properties) Has(props Properties) bool {
+	return p&props == props
+}
+
+func (p Properties) String() string {
+	names := []string{}
+	for i, name := range propertyNames {
+		if p.Has(1 << uint(i)) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// Service is a primary service, and the range of handles its characteristics are in.
+type Service struct {
+	UUID        string
+	StartHandle uint16
+	EndHandle   uint16
+}
+
+// Descriptor is an attribute belonging to a characteristic, eg. its client configuration.
+type Descriptor struct {
+	UUID   string
+	Handle uint16
+}
+
+// ReadPrimaryServices query a device for it's primary services
+func (gc *GattCmd) ReadPrimaryServices(ctx context.Context) ([]*Service, error) {
+
+	services := []*Service{}
+
+	data, err := run(ctx, gc.path, gc.args("--primary")...)
+
+	if err != nil {
+		return services, err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+
+	for scanner.Scan() {
+		m := serviceRegex.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+
+		start, err := ParseHandle(m[1])
+		if err != nil {
+			return services, parseError("--primary", scanner.Text(), err)
+		}
+
+		end, err := ParseHandle(m[2])
+		if err != nil {
+			return services, parseError("--primary", scanner.Text(), err)
+		}
+
+		services = append(services, &Service{UUID: m[3], StartHandle: start, EndHandle: end})
+	}
+
+	return services, nil
+}
+
+// ReadServiceCharacteristics query a device for the characteristics of one of it's services
+func (gc *GattCmd) ReadServiceCharacteristics(ctx context.Context, service *Service) ([]*Characteristic, error) {
+	return gc.readCharacteristics(ctx, "-s", FormatHandle(service.StartHandle), "-e", FormatHandle(service.EndHandle))
+}
+
+// ReadDescriptors query a device for the descriptors between the start and end handles, usually
+// the handles after a characteristic's value up to the next characteristic. The service and
+// characteristic declarations and values in the range are left out.
+func (gc *GattCmd) ReadDescriptors(ctx context.Context, start, end uint16) ([]*Descriptor, error) {
+
+	descriptors := []*Descriptor{}
+
+	data, err := run(ctx, gc.path, gc.args("--char-desc", "-s", FormatHandle(start), "-e", FormatHandle(end))...)
+
+	if err != nil {
+		return descriptors, err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+
+	values := map[uint16]bool{}
+
+	for scanner.Scan() {
+		m := descriptorRegex.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+
+		handle, err := ParseHandle(m[1])
+		if err != nil {
+			return descriptors, parseError("--char-desc", scanner.Text(), err)
+		}
+
+		switch m[2] {
+		case PrimaryServiceUUID, SecondaryServiceUUID, IncludeUUID:
+			continue
+		case CharacteristicUUID:
+			// the value follows the declaration
+			values[handle+1] = true
+			continue
+		}
+
+		if values[handle] {
+			continue
+		}
+
+		descriptors = append(descriptors, &Descriptor{UUID: m[2], Handle: handle})
+	}
+
+	return descriptors, nil
+}
+
+// ParseHandle parses the hex handles printed by gatttool, eg. 0x0025
+func ParseHandle(handle string) (uint16, error) {
+	value, err := strconv.ParseUint(handle, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid handle %q: %s", handle, err)
+	}
+	return uint16(value), nil
+}
+
+// FormatHandle formats a handle as gatttool prints and expects it, eg. 0x0025
+func FormatHandle(handle uint16) string {
+	return fmt.Sprintf("0x%04x", handle)
+}
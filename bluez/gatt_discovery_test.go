@@ -0,0 +1,62 @@
+package bluez
+
+import (
+	"context"
+	"testing"
+)
+
+func TestReadPrimaryServices(t *testing.T) {
+	gc, cleanup := newFakeGattCmd(t, "discovery.txt")
+	defer cleanup()
+
+	ctx := context.Background()
+
+	services, err := gc.ReadPrimaryServices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(services) != 3 {
+		t.Fatalf("expected 3 services, got %d", len(services))
+	}
+
+	tag := services[2]
+	if tag.UUID != "cd54cc79-ce6c-4cf4-9747-447e0fbe6295" || tag.StartHandle != 0x28 || tag.EndHandle != 0xffff {
+		t.Errorf("bad service %#v", tag)
+	}
+
+	chars, err := gc.ReadServiceCharacteristics(ctx, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(chars) != 2 {
+		t.Fatalf("expected 2 characteristics, got %d", len(chars))
+	}
+
+	if !chars[0].Properties.Has(PropRead|PropWrite|PropNotify) || chars[0].Properties.Has(PropIndicate) {
+		t.Errorf("bad read characteristic properties %s", chars[0].Properties)
+	}
+
+	if chars[1].Properties.String() != "write-without-response|write" {
+		t.Errorf("bad alert characteristic properties %s", chars[1].Properties)
+	}
+}
+
+func TestReadDescriptors(t *testing.T) {
+	gc, cleanup := newFakeGattCmd(t, "discovery.txt")
+	defer cleanup()
+
+	ctx := context.Background()
+
+	for _, handles := range [][2]uint16{{0x2d, 0x2d}, {0x28, 0x2f}} {
+		descriptors, err := gc.ReadDescriptors(ctx, handles[0], handles[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(descriptors) != 1 || descriptors[0].UUID != ClientCharacteristicConfigurationUUID || descriptors[0].Handle != 0x2d {
+			t.Errorf("expected just the client configuration in %04x-%04x, got %#v", handles[0], handles[1], descriptors)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package bluez
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gatttool -b F6:5F:20:4C:B0:DB -t random -l medium --char-write-req -a 0x0026 -n 0100 --listen
+//
+// Characteristic value was written successfully
+// Notification handle = 0x0025 value: 01 03
+// Indication   handle = 0x0025 value: 01 03
+
+const (
+	listenTimeout = time.Second * 15 // for the client configuration write, before notifications start
+
+	cccdNotify   = "0100"
+	cccdIndicate = "0200"
+)
+
+var notificationRegex = regexp.MustCompile(`(Notification|Indication)\s+handle = ([0-9a-fx]+) value: ([0-9a-f ]*)`)
+
+// Notification is a value sent by the device on a characteristic we are listening to.
+type Notification struct {
+	Handle     uint16 // the characteristic value handle
+	Value      []byte
+	Indication bool // the device asked for confirmation, which gatttool sends
+}
+
+// Listener delivers the notifications for a handle until it is closed, or gatttool exits.
+type Listener struct {
+	Notifications <-chan *Notification
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	lkErr  sync.Mutex
+	err    error
+}
+
+// Listen enables notifications (or indications) by writing to the characteristic's client
+// configuration descriptor, then keeps the connection open to receive them. It returns once
+// the descriptor has been written.
+func (gc *GattCmd) Listen(ctx context.Context, cccdHandle uint16, indicate bool) (*Listener, error) {
+
+	value := cccdNotify
+	if indicate {
+		value = cccdIndicate
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	params := gc.args("--char-write-req", "-a", FormatHandle(cccdHandle), "-n", value, "--listen")
+
+	log.Infof("exec %s %v", gc.path, params)
+
+	cmd := exec.CommandContext(ctx, gc.path, params...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, newError(ctx, "--listen", "", err)
+	}
+	cmd.Stderr = cmd.Stdout
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, newError(ctx, "--listen", "", err)
+	}
+
+	notifications := make(chan *Notification, 16)
+
+	l := &Listener{
+		Notifications: notifications,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
+
+	written := make(chan error, 1)
+
+	go func() {
+		defer close(l.done)
+		defer close(notifications)
+
+		var output bytes.Buffer
+		enabled := false
+
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			if !enabled {
+				output.WriteString(line + "\n")
+				if strings.Contains(line, "written successfully") {
+					enabled = true
+					written <- nil
+				}
+				continue
+			}
+
+			notification, err := parseNotification(line)
+			if err != nil {
+				log.Warningf("Listen %s: %s", gc.baddr, err)
+				continue
+			}
+			if notification == nil {
+				continue
+			}
+
+			select {
+			case notifications <- notification:
+			case <-ctx.Done():
+			}
+		}
+
+		err := cmd.Wait()
+
+		if !enabled {
+			if err == nil {
+				err = fmt.Errorf("gatttool exited")
+			}
+			written <- newError(ctx, "--listen", output.String(), err)
+			return
+		}
+
+		// being closed is a clean shutdown, anything else is the link dropping
+		if ctx.Err() == nil {
+			l.setErr(newError(ctx, "--listen", output.String(), fmt.Errorf("gatttool exited: %v", err)))
+		}
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			cancel()
+			<-l.done
+			return nil, err
+		}
+	case <-time.After(listenTimeout):
+		cancel()
+		<-l.done
+		return nil, &Error{Kind: ErrTimeout, Op: "--listen", Err: fmt.Errorf("No response after %s", listenTimeout)}
+	}
+
+	return l, nil
+}
+
+// Close stops gatttool, which drops the connection and with it the subscription. The
+// notifications channel is closed once everything has shut down.
+func (l *Listener) Close() error {
+	l.cancel()
+	<-l.done
+	return l.Err()
+}
+
+// Err returns why the listener stopped, or nil if it was closed.
+func (l *Listener) Err() error {
+	l.lkErr.Lock()
+	defer l.lkErr.Unlock()
+	return l.err
+}
+
+func (l *Listener) setErr(err error) {
+	l.lkErr.Lock()
+	defer l.lkErr.Unlock()
+	l.err = err
+}
+
+// parseNotification returns nil for lines which aren't notifications.
+func parseNotification(line string) (*Notification, error) {
+	m := notificationRegex.FindStringSubmatch(line)
+
+	if m == nil {
+		return nil, nil
+	}
+
+	handle, err := ParseHandle(m[2])
+	if err != nil {
+		return nil, parseError("--listen", line, err)
+	}
+
+	value, err := hex.DecodeString(strings.Replace(strings.TrimSpace(m[3]), " ", "", -1))
+	if err != nil {
+		return nil, parseError("--listen", line, err)
+	}
+
+	return &Notification{
+		Handle:     handle,
+		Value:      value,
+		Indication: m[1] == "Indication",
+	}, nil
+}
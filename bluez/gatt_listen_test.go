@@ -0,0 +1,74 @@
+package bluez
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseNotification(t *testing.T) {
+	n, err := parseNotification("Notification handle = 0x0025 value: 01 03 ff")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n == nil || n.Handle != 0x0025 || !bytes.Equal(n.Value, []byte{0x01, 0x03, 0xff}) || n.Indication {
+		t.Errorf("bad notification %#v", n)
+	}
+
+	n, err = parseNotification("Indication   handle = 0x0031 value: 64 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n == nil || n.Handle != 0x0031 || !bytes.Equal(n.Value, []byte{0x64}) || !n.Indication {
+		t.Errorf("bad indication %#v", n)
+	}
+
+	if n, err := parseNotification("Characteristic value was written successfully"); n != nil || err != nil {
+		t.Errorf("expected nothing from a write response, got %#v %v", n, err)
+	}
+
+	if _, err := parseNotification("Notification handle = 0x0025 value: 0"); !IsParse(err) {
+		t.Errorf("expected a parse error, got %v", err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	gc, cleanup := newFakeGattCmd(t, "listen.txt")
+	defer cleanup()
+
+	listener, err := gc.Listen(context.Background(), 0x002d, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []byte{0x01, 0x02} {
+		select {
+		case n := <-listener.Notifications:
+			if n.Handle != 0x002c || n.Value[0] != expected {
+				t.Errorf("bad notification %#v", n)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for notification %d", expected)
+		}
+	}
+
+	if err := listener.Close(); err != nil {
+		t.Errorf("expected a clean shutdown, got %s", err)
+	}
+
+	if _, ok := <-listener.Notifications; ok {
+		t.Errorf("expected the notifications to be closed")
+	}
+}
+
+func TestListenConnectionRefused(t *testing.T) {
+	gc, cleanup := newFakeGattCmd(t, "listen.txt")
+	defer cleanup()
+
+	if _, err := gc.Listen(context.Background(), 0x002d, true); !IsConnectionRefused(err) {
+		t.Errorf("expected connection refused, got %v", err)
+	}
+}
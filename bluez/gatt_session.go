@@ -0,0 +1,430 @@
+package bluez
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gatttool -b F6:5F:20:4C:B0:DB -t random -l medium -I
+//
+// [                 ][LE]> connect
+// Attempting to connect to F6:5F:20:4C:B0:DB
+// Connection successful
+// [F6:5F:20:4C:B0:DB][LE]> char-read-hnd 0x0025
+// Characteristic value/descriptor: 01 03
+// [F6:5F:20:4C:B0:DB][LE]> characteristics
+// handle: 0x0002, char properties: 0x0a, char value handle: 0x0003, uuid: 00002a00-0000-1000-8000-00805f9b34fb
+
+const (
+	sessionTimeout     = time.Second * 10 // for a command to complete, if the context doesn't have an earlier deadline
+	sessionIdleTimeout = time.Second * 30 // before the connection is dropped so the device advertises again
+
+	// characteristics prints the list once discovery has finished, with nothing after it, so the
+	// list is complete once the output has been quiet for this long.
+	characteristicsQuietPeriod = time.Millisecond * 500
+)
+
+var (
+	promptRegex = regexp.MustCompile(`^(\[[0-9A-Fa-f: ]*\]\[LE\]>\s*)+`)
+	escapeRegex = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+	errDisconnected = errors.New("Disconnected")
+)
+
+// GattSession keeps an interactive gatttool running, and its connection open, between commands.
+// The connection is re-established when the link drops, and closed after it has been idle for a while.
+type GattSession struct {
+	sync.Mutex
+	baddr  string
+	params []string // the address and options, see gatttoolParams
+	path   string   // of gatttool, replaced by the tests
+
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	lines     chan string
+	connected bool
+	idle      *time.Timer
+}
+
+// NewGattSession create a gatt session, gatttool isn't started until the first command. Options
+// may be nil for the defaults.
+func NewGattSession(baddr, addrType string, options *Options) (*GattSession, error) {
+
+	params, err := gatttoolParams(baddr, addrType, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GattSession{baddr: baddr, params: params, path: gatttoolPath(options)}, nil
+}
+
+// ReadCharacteristics query a device for it's characteristics
+func (s *GattSession) ReadCharacteristics(ctx context.Context) ([]*Characteristic, error) {
+
+	chars := []*Characteristic{}
+
+	err := s.do(ctx, func() error {
+		chars = chars[:0]
+
+		if err := s.send(ctx, "characteristics"); err != nil {
+			return err
+		}
+
+		timeout := time.After(sessionTimeout)
+
+		for {
+			line, ok, err := s.receive(ctx, "characteristics", timeout)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				if len(chars) > 0 {
+					return nil
+				}
+				return s.timedOut("characteristics")
+			}
+
+			c, err := parseCharacteristic(line)
+			if err != nil {
+				return parseError("characteristics", line, err)
+			}
+			if c != nil {
+				chars = append(chars, c)
+				timeout = time.After(characteristicsQuietPeriod)
+				continue
+			}
+
+			if err := responseError(ctx, "characteristics", line); err != nil {
+				return err
+			}
+		}
+	})
+
+	return chars, err
+}
+
+// ReadCharacteristic read the caractersitic using the handle
+func (s *GattSession) ReadCharacteristic(ctx context.Context, handle uint16) ([]byte, error) {
+
+	var payload []byte
+
+	err := s.do(ctx, func() error {
+		return s.exchange(ctx, []string{"char-read-hnd " + FormatHandle(handle)}, func(line string) (bool, error) {
+			if value := decodeValue(line); value != "" {
+				data, err := hex.DecodeString(strings.Replace(value, " ", "", -1))
+				if err != nil {
+					return true, parseError("char-read-hnd", line, err)
+				}
+				payload = data
+				return true, nil
+			}
+			return false, responseError(ctx, "char-read-hnd", line)
+		})
+	})
+
+	return payload, err
+}
+
+// WriteCharacteristic write a value to the caractersitic using the handle, without waiting for a response
+func (s *GattSession) WriteCharacteristic(ctx context.Context, handle uint16, value string) error {
+
+	return s.do(ctx, func() error {
+		return s.send(ctx, "char-write-cmd "+FormatHandle(handle)+" "+value)
+	})
+}
+
+// WriteCharacteristicRequest write a value to the caractersitic using the handle, waiting for the write response
+func (s *GattSession) WriteCharacteristicRequest(ctx context.Context, handle uint16, value string) error {
+
+	return s.do(ctx, func() error {
+		return s.exchange(ctx, []string{"char-write-req " + FormatHandle(handle) + " " + value}, func(line string) (bool, error) {
+			if strings.Contains(line, "written successfully") {
+				return true, nil
+			}
+			return false, responseError(ctx, "char-write-req", line)
+		})
+	})
+}
+
+// Write writes a value to the characteristic, as a request if it supports them, so the write is
+// confirmed, or as a command if it only supports writes without response.
+func (s *GattSession) Write(ctx context.Context, char *Characteristic, value string) error {
+
+	request, err := useWriteRequest(char)
+	if err != nil {
+		return err
+	}
+
+	if request {
+		return s.WriteCharacteristicRequest(ctx, char.CharValueHandle, value)
+	}
+	return s.WriteCharacteristic(ctx, char.CharValueHandle, value)
+}
+
+// Close disconnects and stops gatttool.
+func (s *GattSession) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+
+	s.stop()
+	return nil
+}
+
+// do runs a command on a connected session, reconnecting and trying again once if the link has dropped.
+func (s *GattSession) do(ctx context.Context, command func() error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+
+	err := s.connect(ctx)
+
+	if err == nil {
+		err = command()
+	}
+
+	if err == errDisconnected {
+		log.Infof("gatttool session to %s dropped, reconnecting", s.baddr)
+		s.connected = false
+		if err = s.connect(ctx); err == nil {
+			err = command()
+		}
+	}
+
+	if err == errDisconnected {
+		s.connected = false
+		err = &Error{Kind: ErrDisconnected, Op: "session", Err: fmt.Errorf("The link to %s dropped again after reconnecting", s.baddr)}
+	}
+
+	if s.cmd != nil {
+		s.idle = time.AfterFunc(sessionIdleTimeout, s.disconnectIdle)
+	}
+
+	return err
+}
+
+// connect starts gatttool if it isn't running, then connects to the device if we aren't connected.
+func (s *GattSession) connect(ctx context.Context) error {
+
+	if s.cmd != nil {
+		s.drain()
+	}
+
+	if s.cmd == nil {
+		if err := s.start(); err != nil {
+			return err
+		}
+	}
+
+	if s.connected {
+		return nil
+	}
+
+	err := s.exchange(ctx, []string{"connect"}, func(line string) (bool, error) {
+		if strings.Contains(line, "Connection successful") {
+			return true, nil
+		}
+		return false, responseError(ctx, "connect", line)
+	})
+
+	if err == errDisconnected {
+		err = newError(ctx, "connect", "", fmt.Errorf("Failed to connect to %s", s.baddr))
+	}
+
+	s.connected = err == nil
+
+	return err
+}
+
+func (s *GattSession) start() error {
+
+	params := append(append([]string{}, s.params...), "-I")
+
+	log.Infof("exec %s %v", s.path, params)
+
+	cmd := exec.Command(s.path, params...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	lines := make(chan string, 64)
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if line := cleanSessionLine(scanner.Text()); line != "" {
+				log.Debugf("session %s: %q", s.baddr, line)
+				lines <- line
+			}
+		}
+		close(lines)
+		cmd.Wait()
+	}()
+
+	s.cmd, s.stdin, s.lines, s.connected = cmd, stdin, lines, false
+
+	return nil
+}
+
+// stop kills gatttool, it is restarted by the next command.
+func (s *GattSession) stop() {
+	if s.cmd == nil {
+		return
+	}
+
+	s.stdin.Write([]byte("exit\n"))
+	s.stdin.Close()
+	s.cmd.Process.Kill()
+
+	// unblock the reader so it can reap the process
+	go func(lines chan string) {
+		for range lines {
+		}
+	}(s.lines)
+
+	s.cmd, s.stdin, s.lines, s.connected = nil, nil, nil, false
+}
+
+// exchange sends the commands and passes each line of output to handle until it is done.
+// gatttool is stopped if the context is done first.
+func (s *GattSession) exchange(ctx context.Context, commands []string, handle func(line string) (bool, error)) error {
+
+	for _, command := range commands {
+		if err := s.send(ctx, command); err != nil {
+			return err
+		}
+	}
+
+	timeout := time.After(sessionTimeout)
+
+	for {
+		line, ok, err := s.receive(ctx, commands[0], timeout)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return s.timedOut(commands[0])
+		}
+		done, err := handle(line)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// receive waits for the next line of output, returning false if there wasn't one before the timeout.
+// gatttool is stopped if the context is done first.
+func (s *GattSession) receive(ctx context.Context, op string, timeout <-chan time.Time) (string, bool, error) {
+	select {
+	case line, ok := <-s.lines:
+		if !ok {
+			s.stop()
+			return "", false, newError(ctx, op, "", fmt.Errorf("gatttool exited"))
+		}
+		if isDisconnect(line) {
+			return "", false, errDisconnected
+		}
+		return line, true, nil
+	case <-ctx.Done():
+		// we can't tell what state gatttool is in, so start again next time
+		s.stop()
+		return "", false, newError(ctx, op, "", ctx.Err())
+	case <-timeout:
+		return "", false, nil
+	}
+}
+
+// timedOut stops gatttool, which didn't answer the command in time.
+func (s *GattSession) timedOut(op string) error {
+	s.stop()
+	return &Error{Kind: ErrTimeout, Op: op, Err: fmt.Errorf("No response after %s", sessionTimeout)}
+}
+
+// send writes a command to gatttool, without waiting for its output.
+func (s *GattSession) send(ctx context.Context, command string) error {
+	log.Debugf("session %s> %s", s.baddr, command)
+	if _, err := io.WriteString(s.stdin, command+"\n"); err != nil {
+		s.stop()
+		return newError(ctx, command, "", err)
+	}
+	return nil
+}
+
+// drain discards output left over from earlier commands, noting if the link dropped in the meantime.
+func (s *GattSession) drain() {
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.stop()
+				return
+			}
+			if isDisconnect(line) {
+				s.connected = false
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *GattSession) disconnectIdle() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.cmd != nil && s.connected {
+		log.Infof("gatttool session to %s idle, disconnecting", s.baddr)
+		io.WriteString(s.stdin, "disconnect\n")
+		s.connected = false
+	}
+}
+
+// cleanSessionLine strips the colours and prompts gatttool prints in interactive mode.
+func cleanSessionLine(line string) string {
+	line = escapeRegex.ReplaceAllString(line, "")
+	line = strings.Trim(line, "\r ")
+	line = promptRegex.ReplaceAllString(line, "")
+	return strings.TrimSpace(line)
+}
+
+func isDisconnect(line string) bool {
+	return strings.Contains(line, "Command Failed: Disconnected") ||
+		strings.Contains(line, "Invalid file descriptor") ||
+		strings.Contains(line, "Connection reset by peer")
+}
+
+// responseError returns an error for lines reporting a failed command, and nil for anything else.
+func responseError(ctx context.Context, op, line string) error {
+	switch {
+	case strings.HasPrefix(line, "Error:"), strings.HasPrefix(line, "Command Failed:"), strings.Contains(line, "failed:"):
+		return newError(ctx, op, line, nil)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package bluez
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCleanSessionLine(t *testing.T) {
+	lines := map[string]string{
+		"[                 ][LE]> connect": "connect",
+		"\x1b[0;94m[F6:5F:20:4C:B0:DB]\x1b[0m[LE]> Characteristic value/descriptor: 01 03 \r": "Characteristic value/descriptor: 01 03",
+		"[F6:5F:20:4C:B0:DB][LE]> [F6:5F:20:4C:B0:DB][LE]> Connection successful":             "Connection successful",
+		"\x1b[0;91mError: \x1b[0mconnect error: Connection refused (111)":                     "Error: connect error: Connection refused (111)",
+		"[F6:5F:20:4C:B0:DB][LE]> ": "",
+	}
+
+	for line, expected := range lines {
+		if cleaned := cleanSessionLine(line); cleaned != expected {
+			t.Errorf("expected %q from %q, got %q", expected, line, cleaned)
+		}
+	}
+}
+
+func TestInteractiveCharacteristic(t *testing.T) {
+	c, err := parseCharacteristic("handle: 0x0002, char properties: 0x0a, char value handle: 0x0003, uuid: 00002a00-0000-1000-8000-00805f9b34fb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c == nil {
+		t.Fatalf("expected a characteristic")
+	}
+
+	if c.Handle != 0x0002 || c.CharValueHandle != 0x0003 || c.Properties != PropRead|PropWrite || c.UUID != "00002a00-0000-1000-8000-00805f9b34fb" {
+		t.Errorf("bad characteristic %#v", c)
+	}
+
+	if c, _ := parseCharacteristic("Attempting to connect to F6:5F:20:4C:B0:DB"); c != nil {
+		t.Errorf("expected no characteristic")
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	for _, line := range []string{
+		"Error: connect error: Connection refused (111)",
+		"Command Failed: Disconnected",
+		"Error: Characteristic Write Request failed: Attribute can't be written",
+	} {
+		if responseError(context.Background(), "test", line) == nil {
+			t.Errorf("expected an error from %q", line)
+		}
+	}
+
+	for _, line := range []string{"Attempting to connect to F6:5F:20:4C:B0:DB", "char-read-hnd 0x0025"} {
+		if err := responseError(context.Background(), "test", line); err != nil {
+			t.Errorf("expected no error from %q, got %s", line, err)
+		}
+	}
+
+	if !isDisconnect("Command Failed: Disconnected") || isDisconnect("Connection successful") {
+		t.Errorf("bad disconnect detection")
+	}
+}
+
+func TestSession(t *testing.T) {
+	s, cleanup := newFakeGattSession(t, "session.txt")
+	defer cleanup()
+
+	ctx := context.Background()
+
+	alert := &Characteristic{CharValueHandle: 0x002f, Properties: PropWriteWithoutResponse | PropWrite}
+
+	if err := s.Write(ctx, alert, "0103"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.ReadCharacteristic(ctx, 0x002c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || data[0] != 0x01 || data[1] != 0x03 {
+		t.Errorf("bad value % X", data)
+	}
+
+	chars, err := s.ReadCharacteristics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chars) != 3 || chars[1].CharValueHandle != 0x002c {
+		t.Errorf("bad characteristics %#v", chars)
+	}
+
+	// the link drops, so the session reconnects and reads again
+	data, err = s.ReadCharacteristic(ctx, 0x002c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || data[0] != 0x00 {
+		t.Errorf("bad value after reconnecting % X", data)
+	}
+}
+
+func TestSessionCharacteristicsFailed(t *testing.T) {
+	s, cleanup := newFakeGattSession(t, "session_characteristics_failed.txt")
+	defer cleanup()
+
+	if chars, err := s.ReadCharacteristics(context.Background()); !IsSecurity(err) {
+		t.Errorf("expected a security error, got %v %#v", err, chars)
+	}
+}
+
+func TestSessionDroppedAgain(t *testing.T) {
+	s, cleanup := newFakeGattSession(t, "session_dropped.txt")
+	defer cleanup()
+
+	if _, err := s.ReadCharacteristic(context.Background(), 0x002c); !IsDisconnected(err) {
+		t.Errorf("expected a disconnected error, got %v", err)
+	}
+
+	if s.connected {
+		t.Errorf("expected the session to reconnect next time")
+	}
+}
+
+func TestSessionConnectionRefused(t *testing.T) {
+	s, cleanup := newFakeGattSession(t, "session_refused.txt")
+	defer cleanup()
+
+	if _, err := s.ReadCharacteristic(context.Background(), 0x002c); !IsConnectionRefused(err) {
+		t.Errorf("expected connection refused, got %v", err)
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	s, cleanup := newFakeGattSession(t, "hang.txt")
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+
+	if err := s.WriteCharacteristic(ctx, 0x002f, "0103"); !IsTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+
+	if s.cmd != nil {
+		t.Errorf("expected gatttool to be stopped after the timeout")
+	}
+}
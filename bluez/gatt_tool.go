@@ -6,10 +6,12 @@ package bluez
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/davecgh/go-spew/spew"
@@ -18,7 +20,7 @@ import (
 
 var (
 	log       = loggo.GetLogger("bluez")
-	charRegex = regexp.MustCompile("handle = (?P<handle>[0-9a-fx]+), char properties = (?P<char_props>[0-9a-fx]+), char value handle = (?P<char_value_handle>[0-9a-fx]+), uuid = (?P<uuid>[0-9a-f-]+)")
+	charRegex = regexp.MustCompile("handle(?: =|:) (?P<handle>[0-9a-fx]+), char properties(?: =|:) (?P<char_props>[0-9a-fx]+), char value handle(?: =|:) (?P<char_value_handle>[0-9a-fx]+), uuid(?: =|:) (?P<uuid>[0-9a-f-]+)")
 	readRegex = regexp.MustCompile(`Characteristic value\/descriptor: ([0-9a-f ]+)`)
 )
 
@@ -33,22 +35,29 @@ const (
 
 // GattCmd this is the handle to a bluez gatt cmd.
 type GattCmd struct {
-	baddr, addrType string
+	baddr  string
+	params []string // the address and options, see gatttoolParams
+	path   string   // of gatttool, replaced by the tests
 }
 
 // Characteristic holds the attributes needed to address a characteristic via the api.
 type Characteristic struct {
 	UUID            string
-	Handle          string // use this to READ
-	CharValueHandle string // use this to WRITE
+	Handle          uint16 // the declaration
+	CharValueHandle uint16 // use this to READ and WRITE
+	Properties      Properties
 }
 
 // ReadCharacteristics query a device for it's characteristics
-func (gc *GattCmd) ReadCharacteristics() ([]*Characteristic, error) {
+func (gc *GattCmd) ReadCharacteristics(ctx context.Context) ([]*Characteristic, error) {
+	return gc.readCharacteristics(ctx)
+}
+
+func (gc *GattCmd) readCharacteristics(ctx context.Context, handleRange ...string) ([]*Characteristic, error) {
 
 	chars := []*Characteristic{}
 
-	data, err := run(bluezGattPath, "-b", gc.baddr, "-t", gc.addrType, "-l", "medium", "--characteristics")
+	data, err := run(ctx, gc.path, gc.args(append([]string{"--characteristics"}, handleRange...)...)...)
 
 	if err != nil {
 		return chars, err
@@ -57,28 +66,60 @@ func (gc *GattCmd) ReadCharacteristics() ([]*Characteristic, error) {
 	scanner := bufio.NewScanner(strings.NewReader(data))
 
 	for scanner.Scan() {
-		params := getAttributes(scanner.Text())
-
-		c := &Characteristic{
-			UUID:            params["uuid"],
-			Handle:          params["handle"],
-			CharValueHandle: params["char_value_handle"],
+		c, err := parseCharacteristic(scanner.Text())
+		if err != nil {
+			return chars, parseError("--characteristics", scanner.Text(), err)
+		}
+		if c != nil {
+			chars = append(chars, c)
 		}
+	}
+
+	return chars, nil
+}
+
+// parseCharacteristic returns nil for lines which don't describe a characteristic.
+func parseCharacteristic(line string) (*Characteristic, error) {
 
-		chars = append(chars, c)
+	params := getAttributes(line)
 
-		log.Infof(spew.Sprintf("%#v", c))
+	if params == nil {
+		return nil, nil
 	}
 
-	return chars, nil
+	handle, err := ParseHandle(params["handle"])
+	if err != nil {
+		return nil, err
+	}
+
+	valueHandle, err := ParseHandle(params["char_value_handle"])
+	if err != nil {
+		return nil, err
+	}
+
+	props, err := strconv.ParseUint(params["char_props"], 0, 8)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid properties %q: %s", params["char_props"], err)
+	}
+
+	c := &Characteristic{
+		UUID:            params["uuid"],
+		Handle:          handle,
+		CharValueHandle: valueHandle,
+		Properties:      Properties(props),
+	}
+
+	log.Infof(spew.Sprintf("%#v", c))
+
+	return c, nil
 }
 
 // ReadCharacteristic connect to a ble device and read the caractersitic using the handle
-func (gc *GattCmd) ReadCharacteristic(handle string) ([]byte, error) {
+func (gc *GattCmd) ReadCharacteristic(ctx context.Context, handle uint16) ([]byte, error) {
 
 	payload := []byte{}
 
-	data, err := run(bluezGattPath, "-b", gc.baddr, "-t", gc.addrType, "-l", "medium", "--char-read", "-a", handle)
+	data, err := run(ctx, gc.path, gc.args("--char-read", "-a", FormatHandle(handle))...)
 
 	if err != nil {
 		return payload, err
@@ -87,31 +128,95 @@ func (gc *GattCmd) ReadCharacteristic(handle string) ([]byte, error) {
 	// extract the value
 	value := decodeValue(data)
 
+	// gatttool exits successfully when the device rejects the read
+	if value == "" && strings.Contains(data, "read failed:") {
+		return payload, newError(ctx, "--char-read", data, nil)
+	}
+
+	if value == "" {
+		return payload, parseError("--char-read", data, fmt.Errorf("No value read from %s", FormatHandle(handle)))
+	}
+
 	// strip spaces
 	value = strings.Replace(value, " ", "", -1)
 
-	return hex.DecodeString(value)
+	payload, err = hex.DecodeString(value)
+	if err != nil {
+		return payload, parseError("--char-read", data, err)
+	}
+
+	return payload, nil
+}
+
+// WriteCharacteristic connect to a ble device and write a value to the caractersitic using the handle,
+// without waiting for a response
+func (gc *GattCmd) WriteCharacteristic(ctx context.Context, handle uint16, value string) error {
+
+	_, err := run(ctx, gc.path, gc.args("--char-write", "-a", FormatHandle(handle), "-n", value)...)
+
+	return err
 }
 
-// WriteCharacteristic connect to a ble device and write a value to the caractersitic using the handle
-func (gc *GattCmd) WriteCharacteristic(handle, value string) error {
+// WriteCharacteristicRequest connect to a ble device and write a value to the caractersitic using the handle,
+// waiting for the device to confirm the write
+func (gc *GattCmd) WriteCharacteristicRequest(ctx context.Context, handle uint16, value string) error {
 
-	_, err := run(bluezGattPath, "-b", gc.baddr, "-t", gc.addrType, "-l", "medium", "--char-write", "-a", handle, "-n", value)
+	data, err := run(ctx, gc.path, gc.args("--char-write-req", "-a", FormatHandle(handle), "-n", value)...)
+
+	if err == nil && !strings.Contains(data, "written successfully") {
+		err = newError(ctx, "--char-write-req", data, nil)
+	}
 
 	return err
 }
 
-// NewGattCmd create a gatt cmd handler.
-func NewGattCmd(baddr, addrType string) (error *GattCmd) {
+// Write writes a value to the characteristic, as a request if it supports them, so the write is
+// confirmed, or as a command if it only supports writes without response.
+func (gc *GattCmd) Write(ctx context.Context, char *Characteristic, value string) error {
 
-	// TODO is this a valid address / type
+	request, err := useWriteRequest(char)
+	if err != nil {
+		return err
+	}
 
-	return &GattCmd{baddr, addrType}
+	if request {
+		return gc.WriteCharacteristicRequest(ctx, char.CharValueHandle, value)
+	}
+	return gc.WriteCharacteristic(ctx, char.CharValueHandle, value)
 }
 
-func run(cmd string, params ...string) (string, error) {
+// useWriteRequest picks how to write to a characteristic. Characteristics without properties,
+// eg. from an old configuration, are written with a command as they always used to be.
+func useWriteRequest(char *Characteristic) (bool, error) {
+	switch {
+	case char.Properties.Has(PropWrite):
+		return true, nil
+	case char.Properties.Has(PropWriteWithoutResponse), char.Properties == 0:
+		return false, nil
+	}
+	return false, fmt.Errorf("Characteristic %s isn't writable (%s)", char.UUID, char.Properties)
+}
 
-	cmdExec := exec.Command(cmd, params...)
+// NewGattCmd create a gatt cmd handler, options may be nil for the defaults.
+func NewGattCmd(baddr, addrType string, options *Options) (*GattCmd, error) {
+
+	params, err := gatttoolParams(baddr, addrType, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GattCmd{baddr: baddr, params: params, path: gatttoolPath(options)}, nil
+}
+
+// args appends the command to the address and options.
+func (gc *GattCmd) args(command ...string) []string {
+	return append(append([]string{}, gc.params...), command...)
+}
+
+// run executes gatttool, killing it if the context is done before it exits.
+func run(ctx context.Context, cmd string, params ...string) (string, error) {
+
+	cmdExec := exec.CommandContext(ctx, cmd, params...)
 
 	log.Infof("exec %s %v", cmd, params)
 
@@ -120,17 +225,27 @@ func run(cmd string, params ...string) (string, error) {
 	cmdExec.Stderr = &out
 	err := cmdExec.Run()
 	if err != nil {
-		return out.String(), err
+		return out.String(), newError(ctx, operation(params), out.String(), err)
 	}
 	log.Debugf("run: %q\n", out.String())
 
 	if strings.Contains(out.String(), "Connection refused") {
-		return out.String(), fmt.Errorf("Connection refused.")
+		return out.String(), newError(ctx, operation(params), out.String(), fmt.Errorf("Connection refused."))
 	}
 
 	return out.String(), nil
 }
 
+// operation picks the gatttool command out of its parameters, for errors.
+func operation(params []string) string {
+	for _, param := range params {
+		if strings.HasPrefix(param, "--") {
+			return param
+		}
+	}
+	return "gatttool"
+}
+
 func getAttributes(line string) map[string]string {
 
 	matches := charRegex.FindAllStringSubmatch(line, -1)
@@ -1,8 +1,10 @@
 package bluez
 
 import (
+	"context"
 	"encoding/hex"
 	"testing"
+	"time"
 )
 
 const (
@@ -40,3 +42,115 @@ func TestHexDecode(t *testing.T) {
 	}
 
 }
+
+func TestReadCharacteristics(t *testing.T) {
+	gc, cleanup := newFakeGattCmd(t, "characteristics.txt")
+	defer cleanup()
+
+	chars, err := gc.ReadCharacteristics(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(chars) != 4 {
+		t.Fatalf("expected 4 characteristics, got %d", len(chars))
+	}
+
+	if chars[3].UUID != "673e2b62-5b2c-4bb0-876d-87bcaa06d66f" || chars[3].Handle != 0x002e || chars[3].CharValueHandle != 0x002f {
+		t.Errorf("bad characteristic %#v", chars[3])
+	}
+}
+
+func TestReadCharacteristic(t *testing.T) {
+	gc, cleanup := newFakeGattCmd(t, "read.txt")
+	defer cleanup()
+
+	ctx := context.Background()
+
+	data, err := gc.ReadCharacteristic(ctx, 0x0003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "SL6\x00" {
+		t.Errorf("bad value %q", data)
+	}
+
+	if _, err := gc.ReadCharacteristic(ctx, 0x0005); !IsParse(err) {
+		t.Errorf("expected a parse error, got %v", err)
+	}
+
+	if _, err := gc.ReadCharacteristic(ctx, 0x002c); !IsSecurity(err) {
+		t.Errorf("expected the read needing authentication to be a security error, got %v", err)
+	}
+
+	if err := gc.WriteCharacteristic(ctx, 0x002f, "0103"); err != nil {
+		t.Errorf("expected the write to succeed, got %s", err)
+	}
+}
+
+func TestConnectionRefused(t *testing.T) {
+	gc, cleanup := newFakeGattCmd(t, "connection_refused.txt")
+	defer cleanup()
+
+	ctx := context.Background()
+
+	if _, err := gc.ReadCharacteristics(ctx); !IsConnectionRefused(err) {
+		t.Errorf("expected connection refused, got %v", err)
+	}
+
+	if err := gc.WriteCharacteristic(ctx, 0x002f, "0103"); !IsConnectionRefused(err) {
+		t.Errorf("expected connection refused, got %v", err)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	gc, cleanup := newFakeGattCmd(t, "hang.txt")
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+
+	start := time.Now()
+
+	if err := gc.WriteCharacteristic(ctx, 0x002f, "0103"); !IsTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+
+	if time.Since(start) > time.Second*5 {
+		t.Errorf("expected gatttool to be killed on the deadline")
+	}
+}
+
+func TestWritePicksRequestOrCommand(t *testing.T) {
+	gc, cleanup := newFakeGattCmd(t, "read.txt")
+	defer cleanup()
+
+	ctx := context.Background()
+
+	for _, props := range []Properties{PropWrite, PropWriteWithoutResponse, PropWrite | PropWriteWithoutResponse, 0} {
+		if err := gc.Write(ctx, &Characteristic{CharValueHandle: 0x002f, Properties: props}, "0103"); err != nil {
+			t.Errorf("expected a write to a %s characteristic to succeed, got %s", props, err)
+		}
+	}
+
+	if err := gc.Write(ctx, &Characteristic{CharValueHandle: 0x002c, Properties: PropRead | PropWrite}, "0100"); err == nil {
+		t.Errorf("expected the failed write request to be an error")
+	}
+
+	if err := gc.Write(ctx, &Characteristic{CharValueHandle: 0x002c, Properties: PropRead | PropNotify}, "0100"); err == nil {
+		t.Errorf("expected a write to a read only characteristic to fail")
+	}
+}
+
+func TestUseWriteRequest(t *testing.T) {
+	for props, expected := range map[Properties]bool{
+		PropWrite:                            true,
+		PropWrite | PropWriteWithoutResponse: true,
+		PropWriteWithoutResponse:             false,
+		0:                                    false,
+	} {
+		if request, err := useWriteRequest(&Characteristic{Properties: props}); err != nil || request != expected {
+			t.Errorf("expected %s to use a request %t, got %t %v", props, expected, request, err)
+		}
+	}
+}
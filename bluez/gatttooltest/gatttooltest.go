@@ -0,0 +1,204 @@
+// Package gatttooltest provides a fake gatttool for tests, which replays a recorded script
+// instead of talking to a radio. The test binary doubles as the fake, so a package's TestMain
+// must call Main first.
+//
+// A script is a list of commands, each followed by its output:
+//
+//	$ --char-read -a 0x0025
+//	Characteristic value/descriptor: 01 03
+//	$ char-read-hnd 0x0025
+//	Command Failed: Disconnected
+//	! exit 1
+//
+// Commands are the gatttool options (without the address and Options), or the lines sent to an interactive
+// session. The same command may be listed more than once, the responses are used in order. Lines
+// starting with "!" are directives: "! exit <status>", "! sleep <duration>", "! wait", which
+// blocks until the process is killed, and "! later <duration>". In a session, the output after
+// "! later" is printed that long after the next prompt, as gatttool prints the results of
+// commands which wait on the device:
+//
+//	$ char-read-hnd 0x0025
+//	! later 50ms
+//	Characteristic value/descriptor: 01 03
+package gatttooltest
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const scriptEnv = "BLUEZ_FAKE_GATTTOOL"
+
+// Main runs the fake gatttool and exits if the test binary was started as one.
+func Main() {
+	if script := os.Getenv(scriptEnv); script != "" {
+		os.Exit(run(script, os.Args[1:]))
+	}
+}
+
+// Use returns the path of the fake gatttool, which will replay the script. Call the returned
+// function to clean up.
+func Use(t testing.TB, script string) (string, func()) {
+	path, err := filepath.Abs(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv(scriptEnv, path)
+
+	return os.Args[0], func() {
+		os.Unsetenv(scriptEnv)
+	}
+}
+
+type fakeExchange struct {
+	command string
+	output  []string
+	used    bool
+}
+
+func run(script string, args []string) int {
+
+	data, err := ioutil.ReadFile(script)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fake gatttool: %s\n", err)
+		return 2
+	}
+
+	exchanges := []*fakeExchange{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "$ "):
+			exchanges = append(exchanges, &fakeExchange{command: strings.TrimPrefix(line, "$ ")})
+		case len(exchanges) > 0 && line != "":
+			last := exchanges[len(exchanges)-1]
+			last.output = append(last.output, line)
+		}
+	}
+
+	find := func(command string) *fakeExchange {
+		var found *fakeExchange
+		for _, exchange := range exchanges {
+			if exchange.command == command {
+				found = exchange
+				if !exchange.used {
+					exchange.used = true
+					return exchange
+				}
+			}
+		}
+		return found
+	}
+
+	command, addr, interactive := []string{}, "", false
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-b":
+			addr = args[i+1]
+			i++
+		case "-t", "-l", "-i", "-m", "-p":
+			i++
+		case "-I":
+			interactive = true
+		default:
+			command = append(command, args[i])
+		}
+	}
+
+	if !interactive {
+		exchange := find(strings.Join(command, " "))
+		if exchange == nil {
+			fmt.Printf("fake gatttool: no response for %q\n", strings.Join(command, " "))
+			return 2
+		}
+		status, _ := replay(exchange.output)
+		return status
+	}
+
+	prompt := "[" + addr + "][LE]> "
+	fmt.Print(prompt)
+
+	stdin := bufio.NewScanner(os.Stdin)
+	for stdin.Scan() {
+		line := strings.TrimSpace(stdin.Text())
+
+		switch line {
+		case "exit", "quit":
+			return 0
+		case "disconnect":
+			fmt.Print(prompt)
+			continue
+		}
+
+		exchange := find(line)
+		if exchange == nil {
+			fmt.Printf("Error: %s: command not found\n", strings.Fields(line)[0])
+			fmt.Print(prompt)
+			continue
+		}
+
+		now, later, delay := splitLater(exchange.output)
+
+		if status, exit := replay(now); exit {
+			return status
+		}
+
+		fmt.Print(prompt)
+
+		if len(later) > 0 {
+			go func() {
+				time.Sleep(delay)
+				for _, line := range later {
+					fmt.Print("\r" + line + "\n" + prompt)
+				}
+			}()
+		}
+	}
+
+	return 0
+}
+
+// splitLater splits the output at a "! later" directive, returning the delay before the rest.
+func splitLater(output []string) ([]string, []string, time.Duration) {
+	for i, line := range output {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "!" && fields[1] == "later" {
+			delay, _ := time.ParseDuration(fields[2])
+			return output[:i], output[i+1:], delay
+		}
+	}
+	return output, nil, 0
+}
+
+// replay prints the output, returning the exit status if the script exits.
+func replay(output []string) (int, bool) {
+	for _, line := range output {
+		fields := strings.Fields(line)
+
+		switch {
+		case fields[0] != "!":
+			fmt.Println(line)
+		case fields[1] == "exit":
+			status, _ := strconv.Atoi(fields[2])
+			return status, true
+		case fields[1] == "sleep":
+			d, _ := time.ParseDuration(fields[2])
+			time.Sleep(d)
+		case fields[1] == "wait":
+			time.Sleep(time.Hour) // until we are killed
+		}
+	}
+	return 0, false
+}
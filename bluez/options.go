@@ -0,0 +1,152 @@
+package bluez
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+const (
+	SecurityLow    = "low"
+	SecurityMedium = "medium"
+	SecurityHigh   = "high"
+
+	minMTU = 23 // the LE default, gatttool can't go lower
+	maxMTU = 517
+)
+
+var (
+	addressRegex = regexp.MustCompile(`^([0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}$`)
+	adapterRegex = regexp.MustCompile(`^hci[0-9]+$`)
+)
+
+// Options configure how gatttool talks to a device. The zero value, or nil, uses the default
+// adapter at medium security, which is what we always used to do.
+type Options struct {
+	SecurityLevel string `json:"securityLevel,omitempty"` // low, medium or high
+	Adapter       string `json:"adapter,omitempty"`       // eg. hci1, or the adapter's address
+	MTU           int    `json:"mtu,omitempty"`
+	PSM           int    `json:"psm,omitempty"`     // for ATT over BR/EDR, zero for LE
+	Backend       string `json:"backend,omitempty"` // gatttool (the default) or dbus
+	Path          string `json:"path,omitempty"`    // of gatttool, eg. for a BlueZ built from source
+}
+
+// Validate checks the options before anything is run with them.
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+
+	switch o.SecurityLevel {
+	case "", SecurityLow, SecurityMedium, SecurityHigh:
+	default:
+		return fmt.Errorf("Invalid security level %q, expected low, medium or high", o.SecurityLevel)
+	}
+
+	if o.Adapter != "" && !adapterRegex.MatchString(o.Adapter) && !addressRegex.MatchString(o.Adapter) {
+		return fmt.Errorf("Invalid adapter %q, expected eg. hci0", o.Adapter)
+	}
+
+	if o.MTU != 0 && (o.MTU < minMTU || o.MTU > maxMTU) {
+		return fmt.Errorf("Invalid MTU %d, expected %d to %d", o.MTU, minMTU, maxMTU)
+	}
+
+	// PSMs are odd, with an even upper byte
+	if o.PSM != 0 && (o.PSM < 0 || o.PSM > 0xffff || o.PSM&0x0001 == 0 || o.PSM&0x0100 != 0) {
+		return fmt.Errorf("Invalid PSM %d", o.PSM)
+	}
+
+	if err := validateBackend(o.Backend); err != nil {
+		return err
+	}
+
+	if o.Path != "" && !filepath.IsAbs(o.Path) {
+		return fmt.Errorf("Invalid gatttool path %q, expected an absolute path", o.Path)
+	}
+
+	return nil
+}
+
+// Override returns a copy of the options with the fields set in override replacing them, eg. for a
+// device which needs a higher security level than the others. Either may be nil.
+func (o *Options) Override(override *Options) *Options {
+	if override == nil {
+		return o
+	}
+
+	merged := Options{}
+	if o != nil {
+		merged = *o
+	}
+
+	if override.SecurityLevel != "" {
+		merged.SecurityLevel = override.SecurityLevel
+	}
+	if override.Adapter != "" {
+		merged.Adapter = override.Adapter
+	}
+	if override.MTU != 0 {
+		merged.MTU = override.MTU
+	}
+	if override.PSM != 0 {
+		merged.PSM = override.PSM
+	}
+	if override.Backend != "" {
+		merged.Backend = override.Backend
+	}
+	if override.Path != "" {
+		merged.Path = override.Path
+	}
+
+	return &merged
+}
+
+// gatttoolPath returns where to find gatttool, options may be nil.
+func gatttoolPath(options *Options) string {
+	if options == nil || options.Path == "" {
+		return bluezGattPath
+	}
+	return options.Path
+}
+
+// gatttoolParams returns the parameters which go before the command on every gatttool invocation.
+func gatttoolParams(baddr, addrType string, options *Options) ([]string, error) {
+
+	if !addressRegex.MatchString(baddr) {
+		return nil, fmt.Errorf("Invalid address %q", baddr)
+	}
+
+	if addrType != AddrTypePublic && addrType != AddrTypeRandom {
+		return nil, fmt.Errorf("Invalid address type %q, expected public or random", addrType)
+	}
+
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	if options == nil {
+		options = &Options{}
+	}
+
+	level := options.SecurityLevel
+	if level == "" {
+		level = SecurityMedium
+	}
+
+	params := []string{"-b", baddr, "-t", addrType, "-l", level}
+
+	if options.Adapter != "" {
+		params = append(params, "-i", options.Adapter)
+	}
+
+	if options.MTU != 0 {
+		params = append(params, "-m", strconv.Itoa(options.MTU))
+	}
+
+	if options.PSM != 0 {
+		params = append(params, "-p", strconv.Itoa(options.PSM))
+	}
+
+	return params, nil
+}
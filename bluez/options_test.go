@@ -0,0 +1,77 @@
+package bluez
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGatttoolParams(t *testing.T) {
+	params, err := gatttoolParams("F6:5F:20:4C:B0:DB", AddrTypeRandom, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(params, " ") != "-b F6:5F:20:4C:B0:DB -t random -l medium" {
+		t.Errorf("bad default params %v", params)
+	}
+
+	params, err = gatttoolParams("F6:5F:20:4C:B0:DB", AddrTypePublic, &Options{
+		SecurityLevel: SecurityHigh,
+		Adapter:       "hci1",
+		MTU:           48,
+		PSM:           31,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(params, " ") != "-b F6:5F:20:4C:B0:DB -t public -l high -i hci1 -m 48 -p 31" {
+		t.Errorf("bad params %v", params)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []*Options{
+		{SecurityLevel: "paranoid"},
+		{Adapter: "usb0"},
+		{MTU: 22},
+		{MTU: 1024},
+		{PSM: 30},
+		{PSM: 0x0101},
+		{Backend: "hcitool"},
+		{Path: "bin/gatttool"},
+	} {
+		if err := options.Validate(); err == nil {
+			t.Errorf("expected %#v to be invalid", options)
+		}
+	}
+
+	for _, addr := range []string{"F6:5F:20:4C:B0", "F65F204CB0DB", ""} {
+		if _, err := NewGattCmd(addr, AddrTypeRandom, nil); err == nil {
+			t.Errorf("expected address %q to be invalid", addr)
+		}
+	}
+
+	if _, err := NewGattSession("F6:5F:20:4C:B0:DB", "static", nil); err == nil {
+		t.Errorf("expected the address type to be invalid")
+	}
+}
+
+func TestOptionsOverride(t *testing.T) {
+	driver := &Options{SecurityLevel: SecurityLow, Adapter: "hci1"}
+
+	if merged := driver.Override(nil); merged != driver {
+		t.Errorf("expected the driver's options without an override, got %+v", merged)
+	}
+
+	merged := driver.Override(&Options{SecurityLevel: SecurityHigh})
+	if *merged != (Options{SecurityLevel: SecurityHigh, Adapter: "hci1"}) {
+		t.Errorf("bad options %+v", merged)
+	}
+	if driver.SecurityLevel != SecurityLow {
+		t.Errorf("expected the driver's options to be left alone")
+	}
+
+	var defaults *Options
+	if merged := defaults.Override(&Options{MTU: 48, Path: "/opt/bluez/bin/gatttool"}); *merged != (Options{MTU: 48, Path: "/opt/bluez/bin/gatttool"}) {
+		t.Errorf("bad options over the defaults %+v", merged)
+	}
+}
@@ -59,11 +59,11 @@ func main() {
 		log.FatalError(err, "Failed to create BLE Tag driver")
 	}
 
-	client.Advertisement = handleAdvertisement
+	client.Advertisement = advertisements.Handle
 
 	client.Rssi = func(address string, name string, rssi int8) {
 		//log.Printf("Rssi update address:%s rssi:%d", address, rssi)
-		wpDriver.sendRssi(strings.Replace(address, ":", "", -1), name, mac, rssi, true)
+		wpDriver.sendRssi(strings.Replace(address, ":", "", -1), name, mac, rssi, "", true)
 		//spew.Dump(device);
 	}
 
@@ -78,6 +78,8 @@ func main() {
 		log.FatalError(err, "Failed to start scanning")
 	}
 
+	connections.SetScanner(client, true)
+
 	//----------------------------------------------------------------------------------------
 
 	c := make(chan os.Signal, 1)
@@ -87,36 +89,3 @@ func main() {
 	s := <-c
 	fmt.Println("Got signal:", s)
 }
-
-func handleAdvertisement(device *gatt.DiscoveredDevice) {
-
-	if device.Advertisement.LocalName == "NinjaSphereWaypoint" {
-		log.Infof("Found waypoint %s", device.Address)
-		wpDriver.handleSphereWaypoint(device)
-	}
-
-	for uuid := range device.Advertisement.ServiceUuids {
-		if uuid == flowerPowerServiceUuid {
-			if fpDriver.announcedFlowerPowers[device.Address] {
-				return
-			}
-			log.Infof("Found Flower Power %s", device.Address)
-			err := NewFlowerPower(fpDriver, device)
-			if err != nil {
-				log.Errorf("Error creating FlowerPower device ", err)
-			}
-		}
-	}
-
-	// look for tags which are CLOSE to the sphere!!
-	for uuid := range device.Advertisement.ServiceUuids {
-		if uuid == stickNFindServiceUuid {
-			if device.Rssi > minRSSI {
-				err := NewBLETag(tagDriver, device)
-				if err != nil {
-					log.Errorf("Error creating BLE Tag device ", err)
-				}
-			}
-		}
-	}
-}